@@ -0,0 +1,695 @@
+package safehdrhistogram
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+const (
+	// DefaultAggregatorWindow is the default duration of the time windows of
+	// an Aggregator
+	DefaultAggregatorWindow = time.Minute
+	// DefaultAggregatorRetention is the default number of time windows
+	// retained by an Aggregator
+	DefaultAggregatorRetention = 60
+	// DefaultMaxRequestSize is the default size limit (in bytes) of the body
+	// of a request to an Aggregator
+	DefaultMaxRequestSize = 8 << 20
+	// DefaultAggregatorHighestTrackableValue is the default highest value of
+	// the merged histograms of an Aggregator (an hour in microseconds)
+	DefaultAggregatorHighestTrackableValue = int64(time.Hour / time.Microsecond)
+	// DefaultAggregatorSignificantValueDigits is the default number of
+	// significant value digits of the merged histograms of an Aggregator
+	DefaultAggregatorSignificantValueDigits = 3
+)
+
+// AggregatorConfig represents the values used to construct an Aggregator
+// and is designed for use in yaml or JSON configuration files
+type AggregatorConfig struct {
+	// LowestDiscernibleValue, HighestTrackableValue, and
+	// NumberOfSignificantValueDigits are used to create the merged
+	// histograms. Values of a snapshot that are out of range are dropped.
+	// If LowestDiscernibleValue is not > 0, 1 is used. If
+	// HighestTrackableValue is less than twice LowestDiscernibleValue,
+	// DefaultAggregatorHighestTrackableValue (or twice
+	// LowestDiscernibleValue, if larger) is used. If
+	// NumberOfSignificantValueDigits is not 1 to 5,
+	// DefaultAggregatorSignificantValueDigits is used
+	LowestDiscernibleValue         int64 `yaml:"lowestDiscernibleValue" json:"lowestDiscernibleValue"`
+	HighestTrackableValue          int64 `yaml:"highestTrackableValue" json:"highestTrackableValue"`
+	NumberOfSignificantValueDigits int   `yaml:"numberOfSignificantValueDigits" json:"numberOfSignificantValueDigits"`
+
+	// Window is the duration of the time windows that snapshots are merged
+	// into. If 0, DefaultAggregatorWindow is used
+	Window time.Duration `yaml:"window" json:"window"`
+	// Retention is the number of time windows retained, including the
+	// current window. If 0, DefaultAggregatorRetention is used
+	Retention int `yaml:"retention" json:"retention"`
+	// MaxRequestSize is the size limit (in bytes) of the body of a request.
+	// If 0, DefaultMaxRequestSize is used
+	MaxRequestSize int64 `yaml:"maxRequestSize" json:"maxRequestSize"`
+	// MaxDecodedSize is the size limit (in bytes) of the decoded snapshots
+	// of a batch (see Histogram.ByteSize), where a batch that exceeds it is
+	// rejected. If 0, DefaultMaxDecodedSize is used
+	MaxDecodedSize int64 `yaml:"maxDecodedSize" json:"maxDecodedSize"`
+
+	// Clock determines the current window (and which windows are retained).
+	// If nil, SystemClock is used
+	Clock Clock `yaml:"-" json:"-"`
+}
+
+// AggregatorBatch is the (JSON) body of a request to the snapshots endpoint
+// of an Aggregator
+//
+//	Notes
+//		If ID is not empty, a batch with the same ID that is received again
+//		(such as when a Pusher retries a request whose response was lost) is
+//		acknowledged but not merged. IDs are remembered for the retention of
+//		the Aggregator
+//
+type AggregatorBatch struct {
+	ID        string             `json:"id,omitempty"`
+	Snapshots []*EncodedSnapshot `json:"snapshots"`
+}
+
+// AggregatorStats reports the runtime statistics of an Aggregator
+//
+//	Notes
+//		Stats are cumulative from the creation of the Aggregator, with the
+//		exception of Windows and Names
+//
+type AggregatorStats struct {
+	// Merged is the number of snapshots merged
+	Merged int64 `json:"merged"`
+	// Late is the number of snapshots discarded because their window is no
+	// longer retained
+	Late int64 `json:"late"`
+	// Rejected is the number of snapshots rejected because they (or another
+	// snapshot of the same batch) were invalid
+	Rejected int64 `json:"rejected"`
+	// DroppedValues is the number of values that were not merged because
+	// they were out of range
+	DroppedValues int64 `json:"droppedValues"`
+	// Duplicates is the number of batches that were not merged because a
+	// batch with the same ID was already merged
+	Duplicates int64 `json:"duplicates"`
+	// Windows is the number of retained windows
+	Windows int `json:"windows"`
+	// Names is the number of distinct names in the retained windows
+	Names int `json:"names"`
+}
+
+// ErrUnitMismatch is returned when a snapshot has a different unit (or value
+// scaling ratio) to the snapshots already merged for its name
+var ErrUnitMismatch = errors.New("safehdrhistogram: unit does not match the merged snapshots")
+
+// Aggregator collects snapshots from many sources (see EncodedSnapshot),
+// and merges them by name into time windows, so percentiles can be queried
+// across sources and windows
+//
+//	Notes
+//		A snapshot is merged into the window that contains its EndTime.
+//		Windows older than the retention are discarded, as are snapshots
+//		for them
+//
+//		Aggregator is an http.Handler that serves the following endpoints:
+//			POST /snapshots		merge an AggregatorBatch
+//			GET  /percentiles	the merged percentiles by name (see below)
+//			GET  /names			the names of the merged histograms
+//			GET  /stats			the AggregatorStats
+//
+//		Use http.StripPrefix to serve the endpoints under a prefix. The body
+//		of a snapshots request may be gzip compressed (see
+//		Content-Encoding), and MaxRequestSize applies to the uncompressed
+//		body. MaxDecodedSize limits the memory used to decode a batch
+//
+//		The percentiles endpoint supports the following query parameters:
+//			name	a path.Match pattern used to filter names (repeatable)
+//			from	the start of the query, in milliseconds since the epoch
+//			to		the end of the query, in milliseconds since the epoch
+//			last	the duration of the query, ending now (e.g. 5m)
+//			ticks	percentile ticks per half distance (default 1)
+//			p		an explicit percentile to report, e.g. 99.9 (repeatable)
+//			stats	include the mean, standard deviation, and sum
+//
+type Aggregator struct {
+	config   AggregatorConfig
+	clock    Clock
+	windowMs int64
+	mux      *http.ServeMux
+
+	// windows are the retained windows, by start time, protected by a mutex
+	lock    sync.Mutex
+	windows map[int64]*aggregatorWindow
+	stats   AggregatorStats
+
+	// batchIDs are the IDs of the merged batches, and the times they were
+	// merged
+	batchIDs map[string]int64
+}
+
+// aggregatorWindow is a time window of an Aggregator
+type aggregatorWindow struct {
+	aggregates map[string]*aggregate
+}
+
+// aggregate is the merged snapshots of a name within a window
+type aggregate struct {
+	hist       *hdrhistogram.Histogram
+	unit       Unit
+	valueScale float64
+	sources    map[string]struct{}
+	endTime    int64
+}
+
+// NewAggregator creates an Aggregator based on values from an
+// AggregatorConfig
+func NewAggregator(config AggregatorConfig) *Aggregator {
+	if config.LowestDiscernibleValue <= 0 {
+		config.LowestDiscernibleValue = 1
+	}
+	if config.HighestTrackableValue < 2*config.LowestDiscernibleValue {
+		config.HighestTrackableValue = DefaultAggregatorHighestTrackableValue
+		if config.HighestTrackableValue < 2*config.LowestDiscernibleValue {
+			config.HighestTrackableValue = 2 * config.LowestDiscernibleValue
+		}
+	}
+	if config.NumberOfSignificantValueDigits < 1 || config.NumberOfSignificantValueDigits > 5 {
+		config.NumberOfSignificantValueDigits = DefaultAggregatorSignificantValueDigits
+	}
+	if config.Window <= 0 {
+		config.Window = DefaultAggregatorWindow
+	}
+	if config.Retention <= 0 {
+		config.Retention = DefaultAggregatorRetention
+	}
+	if config.MaxRequestSize <= 0 {
+		config.MaxRequestSize = DefaultMaxRequestSize
+	}
+	if config.MaxDecodedSize <= 0 {
+		config.MaxDecodedSize = DefaultMaxDecodedSize
+	}
+
+	agg := &Aggregator{
+		config:   config,
+		clock:    config.Clock,
+		windowMs: config.Window.Milliseconds(),
+		windows:  map[int64]*aggregatorWindow{},
+		batchIDs: map[string]int64{},
+	}
+
+	if agg.clock == nil {
+		agg.clock = SystemClock
+	}
+	if agg.windowMs < 1 {
+		agg.windowMs = 1
+	}
+
+	agg.mux = http.NewServeMux()
+	agg.mux.HandleFunc("/snapshots", agg.serveSnapshots)
+	agg.mux.HandleFunc("/percentiles", agg.servePercentiles)
+	agg.mux.HandleFunc("/names", agg.serveNames)
+	agg.mux.HandleFunc("/stats", agg.serveStats)
+
+	return agg
+}
+
+// windowOf returns the start of the window that contains t (in milliseconds
+// since the epoch)
+func (agg *Aggregator) windowOf(t int64) int64 {
+	start := t - t%agg.windowMs
+	if t < 0 && t%agg.windowMs != 0 {
+		start -= agg.windowMs
+	}
+
+	return start
+}
+
+// prune discards the windows (and batch IDs) that are no longer retained,
+// and returns the start of the oldest retained window (the caller must hold
+// the lock)
+func (agg *Aggregator) prune() int64 {
+	oldest := agg.windowOf(nowMs(agg.clock)) - int64(agg.config.Retention-1)*agg.windowMs
+
+	for start := range agg.windows {
+		if start < oldest {
+			delete(agg.windows, start)
+		}
+	}
+
+	for id, merged := range agg.batchIDs {
+		if merged < oldest {
+			delete(agg.batchIDs, id)
+		}
+	}
+
+	return oldest
+}
+
+// Merge merges snapshots into the windows that contain their end times
+//
+//	Notes
+//		The snapshots are validated before any are merged, so if an error is
+//		returned, none of the snapshots are merged. Snapshots for windows
+//		that are no longer retained are discarded without error (see
+//		AggregatorStats.Late)
+//
+func (agg *Aggregator) Merge(snapshots ...*EncodedSnapshot) error {
+	return agg.MergeBatch(&AggregatorBatch{Snapshots: snapshots})
+}
+
+// MergeBatch merges the snapshots of a batch (see Merge), unless a batch
+// with the same ID was already merged
+func (agg *Aggregator) MergeBatch(batch *AggregatorBatch) error {
+	snapshots := batch.Snapshots
+	decoded := make([]*hdrhistogram.Histogram, len(snapshots))
+
+	// the snapshots are decoded before merging, so their total size is
+	// limited
+	remaining := agg.config.MaxDecodedSize
+
+	for i, encoded := range snapshots {
+		if encoded == nil {
+			agg.reject(len(snapshots))
+			return errors.New("safehdrhistogram: missing snapshot")
+		}
+
+		snapshot, err := encoded.DecodeLimit(remaining)
+		if err != nil {
+			agg.reject(len(snapshots))
+			return err
+		}
+
+		decoded[i] = snapshot.ToHistogram()
+		remaining -= int64(decoded[i].ByteSize())
+	}
+
+	agg.lock.Lock()
+	defer agg.lock.Unlock()
+
+	oldest := agg.prune()
+
+	if batch.ID != "" {
+		if _, ok := agg.batchIDs[batch.ID]; ok {
+			agg.stats.Duplicates++
+			return nil
+		}
+	}
+
+	// validate the units before merging, so the batch is merged entirely or
+	// not at all
+	units := map[string]*EncodedSnapshot{}
+	for _, encoded := range snapshots {
+		first, ok := units[encoded.Name]
+		if !ok {
+			units[encoded.Name] = encoded
+		}
+
+		err := agg.checkUnit(encoded)
+		if err == nil && ok && (first.Unit != encoded.Unit || first.ValueUnitScalingRatio != encoded.ValueUnitScalingRatio) {
+			err = fmt.Errorf("%w: %q", ErrUnitMismatch, encoded.Name)
+		}
+		if err != nil {
+			agg.stats.Rejected += int64(len(snapshots))
+			return err
+		}
+	}
+
+	for i, encoded := range snapshots {
+		start := agg.windowOf(encoded.EndTime)
+		if start < oldest {
+			agg.stats.Late++
+			continue
+		}
+
+		window, ok := agg.windows[start]
+		if !ok {
+			window = &aggregatorWindow{aggregates: map[string]*aggregate{}}
+			agg.windows[start] = window
+		}
+
+		merged, ok := window.aggregates[encoded.Name]
+		if !ok {
+			merged = &aggregate{
+				hist: hdrhistogram.New(
+					agg.config.LowestDiscernibleValue,
+					agg.config.HighestTrackableValue,
+					agg.config.NumberOfSignificantValueDigits),
+				unit:       encoded.Unit,
+				valueScale: encoded.ValueUnitScalingRatio,
+				sources:    map[string]struct{}{},
+			}
+			merged.hist.SetTag(encoded.Name)
+			merged.hist.SetStartTimeMs(encoded.StartTime)
+			window.aggregates[encoded.Name] = merged
+		}
+
+		agg.stats.DroppedValues += merged.hist.Merge(decoded[i])
+		agg.stats.Merged++
+
+		merged.sources[encoded.Source] = struct{}{}
+		if encoded.StartTime < merged.hist.StartTimeMs() {
+			merged.hist.SetStartTimeMs(encoded.StartTime)
+		}
+		if encoded.EndTime > merged.endTime {
+			merged.endTime = encoded.EndTime
+		}
+	}
+
+	if batch.ID != "" {
+		agg.batchIDs[batch.ID] = nowMs(agg.clock)
+	}
+
+	return nil
+}
+
+// checkUnit returns ErrUnitMismatch if the unit (or value scaling ratio) of
+// a snapshot differs from the snapshots already merged for its name (the
+// caller must hold the lock)
+func (agg *Aggregator) checkUnit(encoded *EncodedSnapshot) error {
+	for _, window := range agg.windows {
+		if merged, ok := window.aggregates[encoded.Name]; ok {
+			if merged.unit != encoded.Unit || merged.valueScale != encoded.ValueUnitScalingRatio {
+				return fmt.Errorf("%w: %q", ErrUnitMismatch, encoded.Name)
+			}
+
+			// every window has the same unit for a name
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// reject counts rejected snapshots
+func (agg *Aggregator) reject(count int) {
+	agg.lock.Lock()
+	defer agg.lock.Unlock()
+
+	agg.stats.Rejected += int64(count)
+}
+
+// Names returns the (sorted) names of the histograms in the retained
+// windows
+func (agg *Aggregator) Names() []string {
+	agg.lock.Lock()
+	defer agg.lock.Unlock()
+
+	agg.prune()
+
+	return agg.names(nil)
+}
+
+// names returns the (sorted) names that match any of the patterns, or every
+// name if there are no patterns (the caller must hold the lock)
+func (agg *Aggregator) names(patterns []string) []string {
+	unique := map[string]struct{}{}
+	for _, window := range agg.windows {
+		for name := range window.aggregates {
+			if matchName(name, patterns) {
+				unique[name] = struct{}{}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(unique))
+	for name := range unique {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Sources returns the (sorted) sources of the snapshots merged for name in
+// the retained windows
+func (agg *Aggregator) Sources(name string) []string {
+	agg.lock.Lock()
+	defer agg.lock.Unlock()
+
+	agg.prune()
+
+	unique := map[string]struct{}{}
+	for _, window := range agg.windows {
+		if merged, ok := window.aggregates[name]; ok {
+			for source := range merged.sources {
+				unique[source] = struct{}{}
+			}
+		}
+	}
+
+	sources := make([]string, 0, len(unique))
+	for source := range unique {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	return sources
+}
+
+// Snapshot returns a snapshot of the merged histogram for name, across the
+// windows that overlap from (inclusive) and to (exclusive), in milliseconds
+// since the epoch
+//
+//	Notes
+//		If from (or to) is 0, the query is unbounded. Snapshot returns nil
+//		if no snapshots for name were merged into the windows
+//
+func (agg *Aggregator) Snapshot(name string, from, to int64) *Snapshot {
+	agg.lock.Lock()
+	defer agg.lock.Unlock()
+
+	agg.prune()
+
+	return agg.snapshot(name, from, to)
+}
+
+// snapshot merges the histograms for name across the windows that overlap
+// from and to (the caller must hold the lock)
+func (agg *Aggregator) snapshot(name string, from, to int64) *Snapshot {
+	var result *hdrhistogram.Histogram
+	var snapshot *Snapshot
+
+	for start, window := range agg.windows {
+		if (from != 0 && start+agg.windowMs <= from) || (to != 0 && start >= to) {
+			continue
+		}
+
+		merged, ok := window.aggregates[name]
+		if !ok {
+			continue
+		}
+
+		if result == nil {
+			result = hdrhistogram.New(
+				agg.config.LowestDiscernibleValue,
+				agg.config.HighestTrackableValue,
+				agg.config.NumberOfSignificantValueDigits)
+			result.SetTag(name)
+			result.SetStartTimeMs(merged.hist.StartTimeMs())
+
+			snapshot = &Snapshot{
+				Tag:                   name,
+				Unit:                  merged.unit,
+				ValueUnitScalingRatio: merged.valueScale,
+			}
+		}
+
+		result.Merge(merged.hist)
+		if merged.hist.StartTimeMs() < result.StartTimeMs() {
+			result.SetStartTimeMs(merged.hist.StartTimeMs())
+		}
+		if merged.endTime > snapshot.EndTime {
+			snapshot.EndTime = merged.endTime
+		}
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	snapshot.Snapshot = result.Export()
+	snapshot.StartTime = result.StartTimeMs()
+
+	return snapshot
+}
+
+// Percentiles returns the percentiles of the merged histogram for name (see
+// Snapshot)
+//
+//	Notes
+//		If opts is nil, DefaultPercentilesOptions are used. Percentiles
+//		returns nil if no snapshots for name were merged into the windows
+//
+func (agg *Aggregator) Percentiles(name string, from, to int64, opts *PercentilesOptions) *Percentiles {
+	snapshot := agg.Snapshot(name, from, to)
+	if snapshot == nil {
+		return nil
+	}
+
+	return snapshot.percentiles(opts)
+}
+
+// Stats returns the runtime statistics of the Aggregator
+func (agg *Aggregator) Stats() *AggregatorStats {
+	agg.lock.Lock()
+	defer agg.lock.Unlock()
+
+	agg.prune()
+
+	stats := agg.stats
+	stats.Windows = len(agg.windows)
+	stats.Names = len(agg.names(nil))
+
+	return &stats
+}
+
+// ServeHTTP serves the endpoints of the Aggregator
+func (agg *Aggregator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	agg.mux.ServeHTTP(w, r)
+}
+
+// serveSnapshots merges the snapshots of an AggregatorBatch
+func (agg *Aggregator) serveSnapshots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reader := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		unzipper, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer unzipper.Close()
+
+		reader = unzipper
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(reader, agg.config.MaxRequestSize+1))
+	if err != nil {
+		http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > agg.config.MaxRequestSize {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var batch AggregatorBatch
+	if err = json.Unmarshal(body, &batch); err != nil {
+		http.Error(w, "invalid batch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = agg.MergeBatch(&batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// servePercentiles renders the merged percentiles by name
+func (agg *Aggregator) servePercentiles(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	patterns := query["name"]
+
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			http.Error(w, fmt.Sprintf("invalid name pattern %q", pattern), http.StatusBadRequest)
+			return
+		}
+	}
+
+	opts, err := percentilesOptionsParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := agg.rangeParams(query.Get("from"), query.Get("to"), query.Get("last"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	agg.lock.Lock()
+	agg.prune()
+
+	snapshots := map[string]*Snapshot{}
+	for _, name := range agg.names(patterns) {
+		if snapshot := agg.snapshot(name, from, to); snapshot != nil {
+			snapshots[name] = snapshot
+		}
+	}
+
+	agg.lock.Unlock()
+
+	// the percentiles are created without holding the lock
+	result := make(map[string]*Percentiles, len(snapshots))
+	for name, snapshot := range snapshots {
+		result[name] = snapshot.percentiles(opts)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// rangeParams parses the from, to, and last query parameters
+func (agg *Aggregator) rangeParams(fromParam, toParam, lastParam string) (from, to int64, err error) {
+	if fromParam != "" {
+		if from, err = strconv.ParseInt(fromParam, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid from %q", fromParam)
+		}
+	}
+
+	if toParam != "" {
+		if to, err = strconv.ParseInt(toParam, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid to %q", toParam)
+		}
+	}
+
+	if lastParam != "" {
+		if fromParam != "" || toParam != "" {
+			return 0, 0, errors.New("last can't be combined with from or to")
+		}
+
+		last, err := time.ParseDuration(lastParam)
+		if err != nil || last <= 0 {
+			return 0, 0, fmt.Errorf("invalid last %q", lastParam)
+		}
+
+		now := nowMs(agg.clock)
+		return now - last.Milliseconds(), now + 1, nil
+	}
+
+	return from, to, nil
+}
+
+// serveNames renders the names of the merged histograms
+func (agg *Aggregator) serveNames(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(agg.Names())
+}
+
+// serveStats renders the AggregatorStats
+func (agg *Aggregator) serveStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(agg.Stats())
+}
@@ -0,0 +1,408 @@
+package safehdrhistogram
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// encodedSnapshot creates an EncodedSnapshot of values for testing
+func encodedSnapshot(t *testing.T, source, name string, endTime int64, values ...int64) *EncodedSnapshot {
+	hist := NewHistogramFromConfig(HistogramConfig{
+		LowestDiscernibleValue:         1,
+		HighestTrackableValue:          1000000,
+		NumberOfSignificantValueDigits: 3,
+		CommandBufferSize:              1024,
+		Unit:                           UnitMicroseconds,
+		Clock:                          NewManualClock(time.Unix(0, endTime*int64(time.Millisecond))),
+	})
+
+	for _, value := range values {
+		hist.Record(value)
+	}
+
+	encoded, err := EncodeSnapshot(name, hist.Snapshot(false))
+	hist.Close()
+
+	assert.NoError(t, err, "EncodeSnapshot should not fail")
+	encoded.Source = source
+
+	return encoded
+}
+
+// encodeCounts creates V2 compressed (base64) counts with an arbitrary
+// header and payload for testing
+func encodeCounts(digits int32, lowest, highest int64, payload []byte) string {
+	var contents bytes.Buffer
+	_ = binary.Write(&contents, binary.BigEndian, []int32{hdrhistogram.V2EncodingCookieBase | 0x10, int32(len(payload)), 0, digits})
+	_ = binary.Write(&contents, binary.BigEndian, []int64{lowest, highest})
+	_ = binary.Write(&contents, binary.BigEndian, 1.0)
+	contents.Write(payload)
+
+	var compressed bytes.Buffer
+	writer := zlib.NewWriter(&compressed)
+	_, _ = writer.Write(contents.Bytes())
+	_ = writer.Close()
+
+	var encoded bytes.Buffer
+	_ = binary.Write(&encoded, binary.BigEndian, []int32{hdrhistogram.V2CompressedEncodingCookieBase | 0x10, int32(compressed.Len())})
+	encoded.Write(compressed.Bytes())
+
+	return base64.StdEncoding.EncodeToString(encoded.Bytes())
+}
+
+// postBatch posts snapshots to the snapshots endpoint of an Aggregator
+func postBatch(url string, snapshots ...*EncodedSnapshot) (int, error) {
+	body, err := json.Marshal(AggregatorBatch{Snapshots: snapshots})
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := http.Post(url+"/snapshots", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+// getPercentiles queries the percentiles endpoint of an Aggregator
+func getPercentiles(url, query string) (map[string]*Percentiles, error) {
+	resp, err := http.Get(url + "/percentiles?" + query)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := map[string]*Percentiles{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+
+	return result, err
+}
+
+func Test_Aggregator(t *testing.T) {
+	t.Run("Merge Sources", func(t *testing.T) {
+		t.Parallel()
+
+		start := time.Unix(1600000000, 0)
+		agg := NewAggregator(AggregatorConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			Clock:                          NewManualClock(start),
+		})
+
+		server := httptest.NewServer(agg)
+		defer server.Close()
+
+		now := start.UnixNano() / int64(time.Millisecond)
+
+		// each source records half of 1..100
+		var odd, even []int64
+		for value := int64(1); value <= 100; value += 2 {
+			odd = append(odd, value)
+			even = append(even, value+1)
+		}
+
+		status, err := postBatch(server.URL,
+			encodedSnapshot(t, "host-a", "get", now, odd...),
+			encodedSnapshot(t, "host-a", "put", now, 7))
+		if !assert.NoError(t, err, "post should not fail") || !assert.Equal(t, http.StatusNoContent, status, "unexpected status") {
+			return
+		}
+
+		status, err = postBatch(server.URL, encodedSnapshot(t, "host-b", "get", now, even...))
+		if !assert.NoError(t, err, "post should not fail") || !assert.Equal(t, http.StatusNoContent, status, "unexpected status") {
+			return
+		}
+
+		result, err := getPercentiles(server.URL, "name=g*&p=50&p=99")
+		if !assert.NoError(t, err, "response should be JSON") {
+			return
+		}
+		if !assert.Len(t, result, 1, "only get should match") {
+			return
+		}
+
+		get := result["get"]
+		if !assert.Equal(t, int64(100), get.TotalCount, "every value should be merged") {
+			return
+		}
+		if !assert.Equal(t, []Percentile{{Percentile: 0.5, Value: 50, Count: 50}, {Percentile: 0.99, Value: 99, Count: 99}}, get.Percentiles, "the percentiles should span both sources") {
+			return
+		}
+		if !assert.Equal(t, UnitMicroseconds, get.Unit, "the unit should be preserved") {
+			return
+		}
+
+		if !assert.Equal(t, []string{"host-a", "host-b"}, agg.Sources("get"), "both sources should be tracked") {
+			return
+		}
+		if !assert.Equal(t, []string{"get", "put"}, agg.Names(), "both names should be merged") {
+			return
+		}
+
+		stats := agg.Stats()
+		if !assert.Equal(t, int64(3), stats.Merged, "three snapshots should be merged") {
+			return
+		}
+		if !assert.Equal(t, 1, stats.Windows, "the snapshots should share a window") {
+			return
+		}
+	})
+
+	t.Run("Default Config", func(t *testing.T) {
+		t.Parallel()
+
+		// the histogram fields of a zero config are defaulted
+		start := time.Unix(1600000000, 0)
+		agg := NewAggregator(AggregatorConfig{Clock: NewManualClock(start)})
+
+		server := httptest.NewServer(agg)
+		defer server.Close()
+
+		now := start.UnixNano() / int64(time.Millisecond)
+
+		status, err := postBatch(server.URL, encodedSnapshot(t, "host-a", "get", now, 1, 100, 900000))
+		if !assert.NoError(t, err, "post should not fail") || !assert.Equal(t, http.StatusNoContent, status, "unexpected status") {
+			return
+		}
+
+		result, err := getPercentiles(server.URL, "name=get")
+		if !assert.NoError(t, err, "response should be JSON") {
+			return
+		}
+		if !assert.Equal(t, int64(3), result["get"].TotalCount, "every value should be merged") {
+			return
+		}
+		if !assert.True(t, hdrhistogram.New(1, DefaultAggregatorHighestTrackableValue, 3).ValuesAreEquivalent(900000, result["get"].MaxValue), "the max should be merged") {
+			return
+		}
+	})
+
+	t.Run("Time Windows", func(t *testing.T) {
+		t.Parallel()
+
+		// the start of a minute
+		start := time.Unix(1599999960, 0)
+		clock := NewManualClock(start)
+		agg := NewAggregator(AggregatorConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			Window:                         time.Minute,
+			Retention:                      3,
+			Clock:                          clock,
+		})
+
+		server := httptest.NewServer(agg)
+		defer server.Close()
+
+		// one snapshot in the middle of each minute, where the value is the
+		// minute (from 1)
+		now := start.UnixNano() / int64(time.Millisecond)
+		for minute := int64(1); minute <= 3; minute++ {
+			status, err := postBatch(server.URL, encodedSnapshot(t, "host", "get", now+minute*60000-30000, minute))
+			if !assert.NoError(t, err, "post should not fail") || !assert.Equal(t, http.StatusNoContent, status, "unexpected status") {
+				return
+			}
+		}
+
+		clock.Advance(150 * time.Second)
+
+		// query the second minute
+		from := now + 60000
+		result, err := getPercentiles(server.URL, "from="+strconv.FormatInt(from, 10)+"&to="+strconv.FormatInt(from+60000, 10))
+		if !assert.NoError(t, err, "response should be JSON") {
+			return
+		}
+		if !assert.Equal(t, int64(1), result["get"].TotalCount, "only the second window should be queried") {
+			return
+		}
+		if !assert.Equal(t, int64(2), result["get"].MaxValue, "only the second window should be queried") {
+			return
+		}
+
+		// the last minute overlaps the second and third windows
+		result, err = getPercentiles(server.URL, "last=1m")
+		if !assert.NoError(t, err, "response should be JSON") {
+			return
+		}
+		if !assert.Equal(t, int64(2), result["get"].TotalCount, "the last two windows should be queried") {
+			return
+		}
+
+		// the first window is discarded once the retention passes, and
+		// snapshots for it are late
+		clock.Advance(time.Minute)
+
+		status, err := postBatch(server.URL, encodedSnapshot(t, "host", "get", now+30000, 1))
+		if !assert.NoError(t, err, "post should not fail") || !assert.Equal(t, http.StatusNoContent, status, "a late snapshot should not fail") {
+			return
+		}
+
+		stats := agg.Stats()
+		if !assert.Equal(t, int64(1), stats.Late, "the snapshot should be late") {
+			return
+		}
+		if !assert.Equal(t, 2, stats.Windows, "the first window should be discarded") {
+			return
+		}
+		if !assert.Equal(t, int64(2), agg.Snapshot("get", 0, 0).ToHistogram().TotalCount(), "the retained windows should be merged") {
+			return
+		}
+	})
+
+	t.Run("Invalid Requests", func(t *testing.T) {
+		t.Parallel()
+
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		agg := NewAggregator(AggregatorConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			MaxRequestSize:                 4096,
+		})
+
+		server := httptest.NewServer(agg)
+		defer server.Close()
+
+		// an invalid snapshot rejects the whole batch
+		invalid := encodedSnapshot(t, "host", "put", now, 1)
+		invalid.Counts = "not counts"
+
+		status, err := postBatch(server.URL, encodedSnapshot(t, "host", "get", now, 1), invalid)
+		if !assert.NoError(t, err, "post should not fail") || !assert.Equal(t, http.StatusBadRequest, status, "an invalid snapshot should fail") {
+			return
+		}
+		if !assert.Empty(t, agg.Names(), "no snapshots should be merged") {
+			return
+		}
+
+		// the unit of a name can't change
+		status, _ = postBatch(server.URL, encodedSnapshot(t, "host", "get", now, 1))
+		if !assert.Equal(t, http.StatusNoContent, status, "unexpected status") {
+			return
+		}
+
+		mismatch := encodedSnapshot(t, "host", "get", now, 1)
+		mismatch.Unit = UnitMilliseconds
+		if !assert.True(t, errors.Is(agg.Merge(mismatch), ErrUnitMismatch), "a different unit should fail") {
+			return
+		}
+
+		resp, err := http.Post(server.URL+"/snapshots", "application/json", strings.NewReader(strings.Repeat(" ", 8192)))
+		if !assert.NoError(t, err, "post should not fail") {
+			return
+		}
+		resp.Body.Close()
+		if !assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, "a large request should fail") {
+			return
+		}
+
+		resp, err = http.Get(server.URL + "/snapshots")
+		if !assert.NoError(t, err, "get should not fail") {
+			return
+		}
+		resp.Body.Close()
+		if !assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode, "snapshots should require POST") {
+			return
+		}
+
+		resp, err = http.Get(server.URL + "/percentiles?last=1m&from=1")
+		if !assert.NoError(t, err, "get should not fail") {
+			return
+		}
+		resp.Body.Close()
+		if !assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "last and from should not be combined") {
+			return
+		}
+
+		stats := agg.Stats()
+		if !assert.Equal(t, int64(3), stats.Rejected, "the invalid snapshots should be counted") {
+			return
+		}
+	})
+	t.Run("Malformed Snapshots", func(t *testing.T) {
+		t.Parallel()
+
+		agg := NewAggregator(AggregatorConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			MaxDecodedSize:                 1 << 20,
+		})
+
+		server := httptest.NewServer(agg)
+		defer server.Close()
+
+		// truncated counts used to panic the handler
+		resp, err := http.Post(server.URL+"/snapshots", "application/json", strings.NewReader(`{"snapshots":[{"name":"x","counts":"AAAA"}]}`))
+		if !assert.NoError(t, err, "post should not fail") {
+			return
+		}
+		resp.Body.Close()
+		if !assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "truncated counts should fail") {
+			return
+		}
+
+		// a zero count followed by 10 million zeros and a count of 1 is out
+		// of range
+		payload := make([]byte, 1+2*binary.MaxVarintLen64)
+		n := 1 + binary.PutVarint(payload[1:], -10000000)
+		n += binary.PutVarint(payload[n:], 1)
+		payload = payload[:n]
+
+		malformed := map[string]string{
+			"not base64":        "not counts",
+			"truncated":         "AAAA",
+			"invalid digits":    encodeCounts(0, 1, 1000, nil),
+			"invalid range":     encodeCounts(3, 1000, 1000, nil),
+			"too large":         encodeCounts(5, 1, 1<<62, nil),
+			"truncated payload": encodeCounts(3, 1, 1000, payload)[:40],
+			"out of range":      encodeCounts(3, 1, 1000, payload),
+		}
+
+		for reason, counts := range malformed {
+			encoded := &EncodedSnapshot{Name: "x", Counts: counts}
+			if err := agg.Merge(encoded); !assert.True(t, errors.Is(err, ErrInvalidSnapshot), "%s should be invalid: %v", reason, err) {
+				return
+			}
+			if _, err := encoded.DecodeLimit(1 << 20); !assert.True(t, errors.Is(err, ErrInvalidSnapshot), "%s should be invalid: %v", reason, err) {
+				return
+			}
+		}
+
+		// the size limit applies to the batch
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		valid := encodedSnapshot(t, "host", "get", now, 1)
+		if !assert.NoError(t, agg.Merge(valid), "a snapshot should fit") {
+			return
+		}
+
+		batch := make([]*EncodedSnapshot, 20)
+		for i := range batch {
+			batch[i] = valid
+		}
+		if err = agg.Merge(batch...); !assert.True(t, errors.Is(err, ErrInvalidSnapshot), "the batch should exceed the limit") {
+			return
+		}
+
+		if !assert.Equal(t, []string{"get"}, agg.Names(), "the malformed snapshots should not be merged") {
+			return
+		}
+	})
+}
@@ -0,0 +1,815 @@
+package safehdrhistogram
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// appendLogHeader identifies an append log file (and the version of the
+// format)
+var appendLogHeader = []byte("SHDRLOG\x03")
+
+// appendLogHeaderV1 is the header of a version 1 append log, which has no
+// values entries. Logs of earlier versions are replayed, and upgraded to
+// the current version when they are opened for writing
+var appendLogHeaderV1 = []byte("SHDRLOG\x01")
+
+// appendLogVersion returns the version of the format of a log from its
+// header, or 0 if header isn't the header of an append log
+func appendLogVersion(header []byte) byte {
+	magic := appendLogHeader[:len(appendLogHeader)-1]
+	if len(header) != len(appendLogHeader) || !bytes.HasPrefix(header, magic) {
+		return 0
+	}
+
+	if version := header[len(magic)]; version <= appendLogHeader[len(magic)] {
+		return version
+	}
+
+	return 0
+}
+
+// entry types of the append log format. Each entry is the type followed by
+// varint encoded fields:
+//
+//	define: id, start time, length of name, name
+//	record: id, value
+//	reset:  id, time
+//	values: id, value, count (since version 2)
+//	evict:  id, time (since version 3)
+//
+// where id identifies a histogram within the current session (see define),
+// and times are in milliseconds since the epoch
+const (
+	appendLogDefine byte = 1 + iota
+	appendLogRecord
+	appendLogReset
+	appendLogValues
+	appendLogEvict
+)
+
+// DefaultSyncInterval is the interval at which an AppendLog is synced when
+// using SyncInterval
+const DefaultSyncInterval = time.Second
+
+// SyncPolicy determines when an AppendLog is flushed and synced (see
+// os.File.Sync) to durable storage
+type SyncPolicy string
+
+const (
+	// SyncAlways syncs the log after every entry, so no entries are lost if
+	// the process (or system) crashes, but is slow
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval syncs the log periodically (see
+	// AppendLogOptions.SyncInterval), so at most an interval of entries is
+	// lost if the process (or system) crashes. This is the default policy
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever only writes the log when its buffer is full (or Sync or
+	// Close is called), and leaves syncing to the operating system
+	SyncNever SyncPolicy = "never"
+)
+
+// AppendLogOptions are the options of an AppendLog
+type AppendLogOptions struct {
+	// Sync is the sync policy of the log. If empty, SyncInterval is used
+	Sync SyncPolicy `yaml:"sync" json:"sync"`
+	// SyncInterval is the interval used by SyncInterval. If 0,
+	// DefaultSyncInterval is used
+	SyncInterval time.Duration `yaml:"syncInterval" json:"syncInterval"`
+}
+
+// AppendLogEntryType is the type of an AppendLogEntry
+type AppendLogEntryType int
+
+const (
+	// AppendLogStart is the first entry for a histogram in a session (since
+	// the log was opened)
+	AppendLogStart AppendLogEntryType = iota
+	// AppendLogRecord is a recorded value
+	AppendLogRecord
+	// AppendLogReset is a reset of a histogram
+	AppendLogReset
+	// AppendLogEvict is the eviction of a histogram (see
+	// MemoryPolicyEvictIdle), after which its name starts a new histogram
+	AppendLogEvict
+)
+
+// AppendLogEntry is an entry of an append log (see ReplayAppendLog)
+type AppendLogEntry struct {
+	Type AppendLogEntryType
+	// Name is the name (tag) of the histogram
+	Name string
+	// Value is the value of a record entry, and Count is the number of
+	// occurrences of the value
+	Value int64
+	Count int64
+	// Time is the time of a start, reset, or evict entry, in milliseconds
+	// since the epoch
+	Time int64
+}
+
+// AppendLogReplay describes the result of replaying an append log
+type AppendLogReplay struct {
+	// Entries is the number of (complete) entries replayed
+	Entries int64
+	// Size is the size (in bytes) of the complete entries, including the
+	// header of the log
+	Size int64
+	// Partial is true if a partial (or corrupt) entry was found at the end
+	// of the log and discarded, such as when the process crashed while the
+	// entry was being written
+	Partial bool
+}
+
+// ErrNotAppendLog is returned when replaying a file that isn't an append log
+var ErrNotAppendLog = errors.New("safehdrhistogram: not an append log")
+
+// AppendLog is a durable log of the values recorded to (and the resets of)
+// the histograms of a Histogram or HistogramMap (see
+// HistogramConfig.AppendLog), which can be replayed to rebuild the
+// histograms exactly (see NewHistogramFromAppendLog and
+// NewHistogramMapFromAppendLog)
+//
+//	Notes
+//		The log is written by the command processor, so values that are
+//		dropped because the command buffer is full are not logged. Values
+//		are logged even if they are out of range, so replay drops them too
+//
+//		Evictions (see MemoryPolicyEvictIdle) are logged, so replay evicts
+//		the same histograms. Commands for an evicted histogram that are
+//		processed after its eviction are not logged
+//
+//		If a write fails, the log stops writing and the error is returned by
+//		Err
+//
+type AppendLog struct {
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	sync   SyncPolicy
+	err    error
+	closed bool
+
+	// ids identifies the histograms of the current session, by
+	// *hdrhistogram.Histogram or *sparseHistogram
+	ids    map[interface{}]uint64
+	nextID uint64
+	buf    []byte
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// OpenAppendLog opens (or creates) an append log for writing
+//
+//	Notes
+//		If the log exists, new entries are appended. A partial entry at the
+//		end of the log (see AppendLogReplay.Partial) is truncated first
+//
+//		If opts is nil, the default options are used
+//
+func OpenAppendLog(path string, opts *AppendLogOptions) (*AppendLog, error) {
+	if opts == nil {
+		opts = &AppendLogOptions{}
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := validAppendLogSize(file)
+	if err == nil {
+		err = file.Truncate(size)
+	}
+	if err == nil {
+		_, err = file.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	l := &AppendLog{
+		file:   file,
+		writer: bufio.NewWriter(file),
+		sync:   opts.Sync,
+		ids:    map[interface{}]uint64{},
+		buf:    make([]byte, 0, 64),
+	}
+
+	if l.sync == "" {
+		l.sync = SyncInterval
+	}
+
+	// write the header now, so the log can be replayed before any entries
+	// are written. The header of an existing log is rewritten, as the
+	// current version can be appended to a log of an earlier version
+	if size == 0 {
+		_, err = file.Write(appendLogHeader)
+	} else {
+		_, err = file.WriteAt(appendLogHeader, 0)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	if l.sync == SyncInterval {
+		interval := opts.SyncInterval
+		if interval <= 0 {
+			interval = DefaultSyncInterval
+		}
+
+		l.stop = make(chan struct{})
+		l.done = make(chan struct{})
+		go l.syncEvery(interval)
+	}
+
+	return l, nil
+}
+
+// validAppendLogSize returns the size of the complete entries of a log
+// file (including the header), or 0 if the file is empty or its header is
+// partial
+func validAppendLogSize(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return 0, err
+	}
+
+	replay, err := ReplayAppendLog(file, func(AppendLogEntry) {})
+	if err != nil {
+		return 0, err
+	}
+
+	return replay.Size, nil
+}
+
+// syncEvery syncs the log every interval until the log is closed
+func (l *AppendLog) syncEvery(interval time.Duration) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = l.Sync()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// define writes the define entry for the histogram identified by target,
+// where start is the start time of the histogram
+//
+//	Notes
+//		The histograms of a HistogramMap are defined when they are created,
+//		so a histogram is replayed even if no values are recorded to it.
+//		Otherwise a histogram is defined by its first entry (as the tag of a
+//		Histogram can be set after it is started), but with its start time
+//
+func (l *AppendLog) define(target interface{}, name string, start int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed || l.err != nil {
+		return
+	}
+
+	if _, ok := l.lookup(target, name, start); !ok {
+		return
+	}
+
+	if l.sync == SyncAlways {
+		l.err = l.flush()
+	}
+}
+
+// evict writes the evict entry for the histogram identified by target (if
+// it is defined), where now is the time of the eviction, and forgets its id
+func (l *AppendLog) evict(target interface{}, now int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	id, ok := l.ids[target]
+	if !ok {
+		return
+	}
+	delete(l.ids, target)
+
+	if l.closed || l.err != nil {
+		return
+	}
+
+	l.buf = append(l.buf[:0], appendLogEvict)
+	l.buf = appendUvarint(l.buf, id)
+	l.buf = appendVarint(l.buf, now)
+
+	if _, l.err = l.writer.Write(l.buf); l.err != nil {
+		return
+	}
+
+	if l.sync == SyncAlways {
+		l.err = l.flush()
+	}
+}
+
+// lookup returns the id of the histogram identified by target, writing its
+// define entry first if it hasn't been defined in the current session (the
+// lock must be held by the caller)
+func (l *AppendLog) lookup(target interface{}, name string, start int64) (uint64, bool) {
+	if id, ok := l.ids[target]; ok {
+		return id, true
+	}
+
+	id := l.nextID
+	l.nextID++
+	l.ids[target] = id
+
+	l.buf = append(l.buf[:0], appendLogDefine)
+	l.buf = appendUvarint(l.buf, id)
+	l.buf = appendVarint(l.buf, start)
+	l.buf = appendUvarint(l.buf, uint64(len(name)))
+	l.buf = append(l.buf, name...)
+
+	_, l.err = l.writer.Write(l.buf)
+
+	return id, l.err == nil
+}
+
+// write writes an entry for the histogram identified by target (defining
+// it first if needed and define is true), where fields are the fields of
+// the entry that follow the id
+//
+//	Notes
+//		write is called on the command processing go routine
+//
+func (l *AppendLog) write(target interface{}, name string, start int64, define bool, entryType byte, fields ...int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed || l.err != nil {
+		return
+	}
+
+	id, ok := l.ids[target]
+	if !ok && define {
+		id, ok = l.lookup(target, name, start)
+	}
+	if !ok {
+		return
+	}
+
+	l.buf = append(l.buf[:0], entryType)
+	l.buf = appendUvarint(l.buf, id)
+	for _, field := range fields {
+		l.buf = appendVarint(l.buf, field)
+	}
+
+	if _, l.err = l.writer.Write(l.buf); l.err != nil {
+		return
+	}
+
+	if l.sync == SyncAlways {
+		l.err = l.flush()
+	}
+}
+
+// appendUvarint appends the varint encoding of an unsigned value to buf
+func appendUvarint(buf []byte, value uint64) []byte {
+	var encoded [binary.MaxVarintLen64]byte
+	return append(buf, encoded[:binary.PutUvarint(encoded[:], value)]...)
+}
+
+// appendVarint appends the varint encoding of a signed value to buf
+func appendVarint(buf []byte, value int64) []byte {
+	var encoded [binary.MaxVarintLen64]byte
+	return append(buf, encoded[:binary.PutVarint(encoded[:], value)]...)
+}
+
+// log writes the entry (if any) for a command that is being processed
+func (l *AppendLog) log(cmd command, clock Clock) {
+	target, name := cmd.target()
+	if target == nil {
+		return
+	}
+
+	start := cmd.startTimeMs()
+
+	// the histograms of a HistogramMap (which have a size) are defined when
+	// they are created, so if one isn't defined it has been evicted
+	define := cmd.size == nil
+
+	switch cmd.command {
+	case cmdRecord:
+		if value, n := cmd.values(); n == 1 {
+			l.write(target, name, start, define, appendLogRecord, value)
+		} else {
+			l.write(target, name, start, define, appendLogValues, value, n)
+		}
+	case cmdReset:
+		l.write(target, name, start, define, appendLogReset, nowMs(clock))
+	case cmdSnapshot, cmdPercentiles:
+		if cmd.reset {
+			l.write(target, name, start, define, appendLogReset, nowMs(clock))
+		}
+	}
+}
+
+// flush writes the buffered entries and syncs the file (the lock must be
+// held by the caller)
+func (l *AppendLog) flush() error {
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+
+	return l.file.Sync()
+}
+
+// Sync writes the buffered entries and syncs the log to durable storage
+func (l *AppendLog) Sync() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed || l.err != nil {
+		return l.err
+	}
+
+	l.err = l.flush()
+	return l.err
+}
+
+// Err returns the error that stopped the log from writing, if any
+func (l *AppendLog) Err() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.err
+}
+
+// Close syncs and closes the log
+//
+//	Notes
+//		Close the log after the Histogram (or HistogramMap) that writes to it
+//		is closed, as entries written after the log is closed are discarded
+//
+func (l *AppendLog) Close() error {
+	if l.stop != nil {
+		l.stopOnce.Do(func() {
+			close(l.stop)
+			<-l.done
+		})
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return l.err
+	}
+
+	l.closed = true
+
+	err := l.err
+	if err == nil {
+		err = l.flush()
+	}
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// ReplayAppendLog reads an append log, calling f for each complete entry
+//
+//	Notes
+//		A partial (or corrupt) entry at the end of the log is discarded, and
+//		reported by AppendLogReplay.Partial rather than as an error. An empty
+//		log has no entries
+//
+func ReplayAppendLog(reader io.Reader, f func(entry AppendLogEntry)) (*AppendLogReplay, error) {
+	r := &countingReader{reader: bufio.NewReader(reader)}
+
+	header := make([]byte, len(appendLogHeader))
+	n, err := io.ReadFull(r, header)
+	if err == io.EOF {
+		// an empty log
+		return &AppendLogReplay{}, nil
+	} else if err == io.ErrUnexpectedEOF && bytes.HasPrefix(appendLogHeader, header[:n]) {
+		// the header is partial, so the log is empty
+		return &AppendLogReplay{Partial: true}, nil
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	version := appendLogVersion(header)
+	if version == 0 {
+		return nil, ErrNotAppendLog
+	}
+
+	replay := &AppendLogReplay{Size: r.count}
+	names := map[uint64]string{}
+
+	for {
+		entry, err := readAppendLogEntry(r, names, version)
+		if err == io.EOF {
+			// the end of the log
+			return replay, nil
+		} else if err == io.ErrUnexpectedEOF || err == errCorruptAppendLog {
+			replay.Partial = true
+			return replay, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		replay.Size = r.count
+		replay.Entries++
+
+		f(entry)
+	}
+}
+
+// errCorruptAppendLog is returned by readAppendLogEntry for an entry that
+// can't be decoded
+var errCorruptAppendLog = errors.New("safehdrhistogram: corrupt append log")
+
+// countingReader counts the bytes read from a reader
+type countingReader struct {
+	reader *bufio.Reader
+	count  int64
+}
+
+// Read implements io.Reader
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// ReadByte implements io.ByteReader
+func (r *countingReader) ReadByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.count++
+	}
+	return b, err
+}
+
+// readAppendLogEntry reads an entry, where names are the names of the
+// histograms by id (which are updated by define and evict entries), and
+// version is the version of the log (which determines the entry types)
+func readAppendLogEntry(r *countingReader, names map[uint64]string, version byte) (entry AppendLogEntry, err error) {
+	entryType, err := r.ReadByte()
+	if err != nil {
+		return entry, err
+	}
+
+	id, err := binary.ReadUvarint(r)
+	if err != nil {
+		return entry, unexpected(err)
+	}
+
+	switch entryType {
+	case appendLogDefine:
+		entry.Type = AppendLogStart
+		if entry.Time, err = binary.ReadVarint(r); err != nil {
+			return entry, unexpected(err)
+		}
+
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return entry, unexpected(err)
+		}
+		if length > 1<<16 {
+			return entry, errCorruptAppendLog
+		}
+
+		name := make([]byte, length)
+		if _, err = io.ReadFull(r, name); err != nil {
+			return entry, unexpected(err)
+		}
+
+		names[id] = string(name)
+		entry.Name = string(name)
+
+		return entry, nil
+	case appendLogRecord, appendLogReset, appendLogValues, appendLogEvict:
+		name, defined := names[id]
+		if !defined || (entryType == appendLogValues && version < 2) || (entryType == appendLogEvict && version < 3) {
+			return entry, errCorruptAppendLog
+		}
+
+		field, err := binary.ReadVarint(r)
+		if err != nil {
+			return entry, unexpected(err)
+		}
+
+		entry.Name = name
+		switch entryType {
+		case appendLogRecord:
+			entry.Type = AppendLogRecord
+			entry.Value = field
+			entry.Count = 1
+		case appendLogValues:
+			entry.Type = AppendLogRecord
+			entry.Value = field
+			if entry.Count, err = binary.ReadVarint(r); err != nil {
+				return entry, unexpected(err)
+			}
+		case appendLogEvict:
+			entry.Type = AppendLogEvict
+			entry.Time = field
+			delete(names, id)
+		default:
+			entry.Type = AppendLogReset
+			entry.Time = field
+		}
+
+		return entry, nil
+	default:
+		return entry, errCorruptAppendLog
+	}
+}
+
+// unexpected converts io.EOF to io.ErrUnexpectedEOF, as the end of the log
+// within an entry means the entry is partial
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// replayAppendLogFile replays an append log file, and returns an empty
+// AppendLogReplay if the file doesn't exist
+func replayAppendLogFile(path string, f func(entry AppendLogEntry)) (*AppendLogReplay, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &AppendLogReplay{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReplayAppendLog(file, f)
+}
+
+// NewHistogramFromAppendLog creates a Histogram based on values from a
+// HistogramConfig, and replays an append log to rebuild its values (see
+// AppendLog)
+//
+//	Notes
+//		If the log doesn't exist, the Histogram is empty. The entries are
+//		replayed before the Histogram is created, so they are not written to
+//		config.AppendLog. Every entry is replayed to the Histogram,
+//		regardless of its name
+//
+func NewHistogramFromAppendLog(path string, config HistogramConfig) (*Histogram, *AppendLogReplay, error) {
+	hist := hdrhistogram.New(
+		config.LowestDiscernibleValue,
+		config.HighestTrackableValue,
+		config.NumberOfSignificantValueDigits)
+
+	replayer := newReplayer(config)
+
+	replay, err := replayAppendLogFile(path, func(entry AppendLogEntry) {
+		switch entry.Type {
+		case AppendLogStart:
+			// the first start is the start of the histogram
+			if hist.StartTimeMs() == 0 {
+				hist.SetStartTimeMs(entry.Time)
+				hist.SetTag(entry.Name)
+			}
+		case AppendLogRecord:
+			_ = replayer.record(hist, entry.Value, entry.Count)
+		case AppendLogReset:
+			hist.Reset()
+			hist.SetStartTimeMs(entry.Time)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return newHistogram(hist, config), replay, nil
+}
+
+// NewHistogramMapFromAppendLog creates a HistogramMap based on values from a
+// HistogramConfig, and replays an append log to rebuild its histograms (see
+// AppendLog)
+//
+//	Notes
+//		If the log doesn't exist, the HistogramMap is empty. The entries are
+//		replayed before the HistogramMap is used, so they are not written to
+//		config.AppendLog, but the replayed histograms are defined in it
+//
+func NewHistogramMapFromAppendLog(path string, config HistogramConfig) (*HistogramMap, *AppendLogReplay, error) {
+	hdr := NewHistogramMapFromConfig(config)
+	replayer := newReplayer(config)
+
+	replay, err := replayAppendLogFile(path, func(entry AppendLogEntry) {
+		hdr.replay(replayer, entry)
+	})
+	if err != nil {
+		hdr.Close()
+		return nil, nil, err
+	}
+
+	// define the replayed histograms, as resolve does when a histogram is
+	// created
+	if config.AppendLog != nil {
+		hdr.lock.Lock()
+		for _, name := range hdr.histNames {
+			cmd := hdr.target(name)
+			target, _ := cmd.target()
+			config.AppendLog.define(target, name, cmd.startTimeMs())
+		}
+		hdr.lock.Unlock()
+	}
+
+	return hdr, replay, nil
+}
+
+// newReplayer creates a processor (that doesn't process commands) to replay
+// recorded values, so values are recorded (and histograms are resized)
+// exactly as they were when logged
+func newReplayer(config HistogramConfig) *processor {
+	return &processor{
+		clock:      config.clock(),
+		autoResize: config.AutoResize,
+		maxValue:   config.MaxTrackableValue,
+	}
+}
+
+// replay applies an append log entry to the named histogram
+//
+//	Notes
+//		The command processor can't reference the histograms until commands
+//		for them are queued, so it is safe to do this before the
+//		HistogramMap is used
+//
+func (hdr *HistogramMap) replay(replayer *processor, entry AppendLogEntry) {
+	hdr.lock.Lock()
+	defer hdr.lock.Unlock()
+
+	if entry.Type == AppendLogEvict {
+		hdr.remove(entry.Name)
+		return
+	}
+
+	_, isHist := hdr.hists[entry.Name]
+	_, isSparse := hdr.sparse[entry.Name]
+	created := false
+
+	if !isHist && !isSparse {
+		if err := hdr.create(entry.Name); err != nil {
+			return
+		}
+		created = true
+	}
+
+	cmd := hdr.target(entry.Name)
+
+	switch entry.Type {
+	case AppendLogStart:
+		// the first start is the start of the histogram
+		if created {
+			if cmd.sparse != nil {
+				cmd.sparse.startTimeMs = entry.Time
+			} else {
+				cmd.hist.SetStartTimeMs(entry.Time)
+			}
+		}
+	case AppendLogRecord:
+		if cmd.sparse != nil {
+			_ = replayer.recordSparse(cmd.sparse, entry.Value, entry.Count)
+		} else {
+			_ = replayer.record(cmd.hist, entry.Value, entry.Count)
+		}
+	case AppendLogReset:
+		if cmd.sparse != nil {
+			cmd.sparse.reset(entry.Time)
+		} else {
+			cmd.hist.Reset()
+			cmd.hist.SetStartTimeMs(entry.Time)
+		}
+	}
+
+	atomic.StoreInt64(cmd.size, cmd.byteSize())
+}
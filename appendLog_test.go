@@ -0,0 +1,519 @@
+package safehdrhistogram
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AppendLog(t *testing.T) {
+	t.Run("Histogram Replay", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "latency.log")
+		log, err := OpenAppendLog(path, &AppendLogOptions{Sync: SyncNever})
+		if !assert.NoError(t, err, "OpenAppendLog should not fail") {
+			return
+		}
+
+		config := HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              1024,
+			Clock:                          NewManualClock(time.Unix(1600000000, 0)),
+			AppendLog:                      log,
+		}
+
+		shdr := NewHistogramFromConfig(config).WithTag("latency")
+		for value := int64(1); value <= 100; value++ {
+			shdr.Record(value)
+		}
+
+		// the values before the reset are not replayed
+		if !assert.NoError(t, shdr.Reset(), "Reset should not fail") {
+			return
+		}
+
+		for value := int64(1); value <= 10; value++ {
+			shdr.Record(value * 1000)
+		}
+
+		expected := shdr.Close()
+		if !assert.NoError(t, log.Close(), "Close should not fail") {
+			return
+		}
+
+		config.AppendLog = nil
+		restored, replay, err := NewHistogramFromAppendLog(path, config)
+		if !assert.NoError(t, err, "The log should be replayed") {
+			return
+		}
+		if !assert.False(t, replay.Partial, "The log should be complete") {
+			return
+		}
+		if !assert.Equal(t, int64(112), replay.Entries, "Every entry should be replayed") {
+			return
+		}
+
+		actual := restored.Snapshot(false)
+		if !assert.Equal(t, expected.Export(), actual.Snapshot, "The values should be rebuilt") {
+			return
+		}
+		if !assert.Equal(t, expected.StartTimeMs(), actual.StartTime, "The start time of the reset should be preserved") {
+			return
+		}
+		if !assert.Equal(t, "latency", actual.Tag, "The tag should be preserved") {
+			return
+		}
+
+		restored.Close()
+	})
+
+	t.Run("HistogramMap Replay", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "api.log")
+		log, err := OpenAppendLog(path, nil)
+		if !assert.NoError(t, err, "OpenAppendLog should not fail") {
+			return
+		}
+
+		clock := NewManualClock(time.Unix(1600000000, 0))
+		config := HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              1024,
+			Clock:                          clock,
+			AppendLog:                      log,
+		}
+
+		hdrs := NewHistogramMapFromConfig(config)
+
+		// the histograms are defined when they are created, so idle is
+		// replayed and get starts before the values are recorded
+		hdrs.Snapshot("idle", false)
+		hdrs.Snapshot("get", false)
+		clock.Advance(time.Second)
+
+		for value := int64(1); value <= 50; value++ {
+			hdrs.Record(value, "get", "all")
+			hdrs.Record(value*10, "put", "all")
+		}
+
+		// a snapshot with reset is logged as a reset
+		hdrs.Snapshot("put", true)
+		hdrs.Record(7, "put")
+		hdrs.RecordValues(3, 5, "get")
+
+		expected, _, _ := hdrs.Shutdown(context.Background())
+		if !assert.NoError(t, log.Close(), "Close should not fail") {
+			return
+		}
+
+		// replay as dense and sparse histograms
+		config.AppendLog = nil
+		for _, sparse := range []bool{false, true} {
+			config.Sparse = sparse
+
+			restored, replay, err := NewHistogramMapFromAppendLog(path, config)
+			if !assert.NoError(t, err, "The log should be replayed") {
+				return
+			}
+			if !assert.False(t, replay.Partial, "The log should be complete") {
+				return
+			}
+
+			if !assert.ElementsMatch(t, []string{"all", "get", "idle", "put"}, restored.Names(), "Every histogram should be rebuilt") {
+				return
+			}
+
+			for name, snapshot := range expected {
+				actual := restored.Snapshot(name, false)
+				if !assert.Equal(t, snapshot.Snapshot, actual.Snapshot, "%s should be rebuilt", name) {
+					return
+				}
+				if !assert.Equal(t, snapshot.StartTime, actual.StartTime, "The start time of %s should be preserved", name) {
+					return
+				}
+			}
+
+			restored.Close()
+		}
+	})
+
+	t.Run("Partial Entry", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "partial.log")
+		log, err := OpenAppendLog(path, &AppendLogOptions{Sync: SyncAlways})
+		if !assert.NoError(t, err, "OpenAppendLog should not fail") {
+			return
+		}
+
+		hdrs := NewHistogramMapFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			AppendLog:                      log,
+		})
+		hdrs.Record(1000, "a")
+		hdrs.Record(1000, "a")
+		hdrs.Close()
+
+		// SyncAlways writes every entry to the file as it is logged
+		info, err := os.Stat(path)
+		if !assert.NoError(t, err, "Stat should not fail") {
+			return
+		}
+		if !assert.NoError(t, log.Close(), "Close should not fail") {
+			return
+		}
+
+		after, _ := os.Stat(path)
+		if !assert.Equal(t, info.Size(), after.Size(), "Close should not write buffered entries") {
+			return
+		}
+
+		// simulate a crash while the last entry (1000 is a 2 byte varint) was
+		// being written
+		if !assert.NoError(t, os.Truncate(path, info.Size()-1), "Truncate should not fail") {
+			return
+		}
+
+		var replayed []AppendLogEntry
+		file, _ := os.Open(path)
+		replay, err := ReplayAppendLog(file, func(entry AppendLogEntry) {
+			replayed = append(replayed, entry)
+		})
+		_ = file.Close()
+
+		if !assert.NoError(t, err, "A partial entry should not fail") {
+			return
+		}
+		if !assert.True(t, replay.Partial, "The partial entry should be reported") {
+			return
+		}
+		if !assert.Len(t, replayed, 2, "The start and first record should be replayed") {
+			return
+		}
+		if !assert.Equal(t, AppendLogEntry{Type: AppendLogRecord, Name: "a", Value: 1000, Count: 1}, replayed[1], "The record should be replayed") {
+			return
+		}
+
+		// reopening truncates the partial entry, and appends to the log
+		log, err = OpenAppendLog(path, &AppendLogOptions{Sync: SyncAlways})
+		if !assert.NoError(t, err, "OpenAppendLog should not fail") {
+			return
+		}
+
+		hdrs = NewHistogramMapFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			AppendLog:                      log,
+		})
+		hdrs.Record(2000, "a")
+		hdrs.Close()
+
+		if !assert.NoError(t, log.Close(), "Close should not fail") {
+			return
+		}
+
+		restored, replay, err := NewHistogramMapFromAppendLog(path, HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+		})
+		if !assert.NoError(t, err, "The log should be replayed") {
+			return
+		}
+		if !assert.False(t, replay.Partial, "The partial entry should be truncated") {
+			return
+		}
+		if !assert.Equal(t, int64(2), restored.Snapshot("a", false).ToHistogram().TotalCount(), "The complete entries should be rebuilt") {
+			return
+		}
+
+		restored.Close()
+	})
+
+	t.Run("Eviction Replay", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "evict.log")
+		log, err := OpenAppendLog(path, &AppendLogOptions{Sync: SyncNever})
+		if !assert.NoError(t, err, "OpenAppendLog should not fail") {
+			return
+		}
+
+		clock := NewManualClock(time.Unix(1600000000, 0))
+		config := HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			MemoryBudget:                   2 * denseByteSize(1, 1000000, 3),
+			MemoryPolicy:                   MemoryPolicyEvictIdle,
+			Clock:                          clock,
+			AppendLog:                      log,
+		}
+
+		hdrs := NewHistogramMapFromConfig(config)
+		hdrs.Record(1, "a")
+		clock.Advance(time.Second)
+		hdrs.Record(2, "b")
+		clock.Advance(time.Second)
+
+		// c evicts a, and a (a new histogram) evicts b
+		hdrs.Record(3, "c")
+		clock.Advance(time.Second)
+		hdrs.Record(4, "a")
+
+		expected, _, _ := hdrs.Shutdown(context.Background())
+		if !assert.ElementsMatch(t, []string{"a", "c"}, hdrs.Names(), "a and b should be evicted") {
+			return
+		}
+
+		log.lock.Lock()
+		ids := len(log.ids)
+		log.lock.Unlock()
+		if !assert.Equal(t, 2, ids, "The ids of the evicted histograms should be released") {
+			return
+		}
+
+		if !assert.NoError(t, log.Close(), "Close should not fail") {
+			return
+		}
+
+		replayed := func() map[string]*Snapshot {
+			restored, _, err := NewHistogramMapFromAppendLog(path, HistogramConfig{
+				LowestDiscernibleValue:         1,
+				HighestTrackableValue:          1000000,
+				NumberOfSignificantValueDigits: 3,
+				CommandBufferSize:              DefaultCommandBufferSize,
+			})
+			if !assert.NoError(t, err, "The log should be replayed") {
+				return nil
+			}
+
+			final, _, _ := restored.Shutdown(context.Background())
+			return final
+		}
+
+		actual := replayed()
+		if !assert.Len(t, actual, 2, "The evicted histograms should not be rebuilt") {
+			return
+		}
+		for name, snapshot := range expected {
+			if !assert.Contains(t, actual, name, "%s should be rebuilt", name) {
+				return
+			}
+			if !assert.Equal(t, snapshot.Snapshot, actual[name].Snapshot, "%s should be rebuilt", name) {
+				return
+			}
+			if !assert.Equal(t, snapshot.StartTime, actual[name].StartTime, "The start time of %s should be preserved", name) {
+				return
+			}
+		}
+
+		// the replayed histograms are defined when the log is reopened, so
+		// they are logged (and can be evicted) in the new session
+		log, err = OpenAppendLog(path, &AppendLogOptions{Sync: SyncNever})
+		if !assert.NoError(t, err, "OpenAppendLog should not fail") {
+			return
+		}
+
+		config.AppendLog = log
+		restored, _, err := NewHistogramMapFromAppendLog(path, config)
+		if !assert.NoError(t, err, "The log should be replayed") {
+			return
+		}
+		clock.Advance(time.Second)
+		restored.Record(5, "c")
+		clock.Advance(time.Second)
+		restored.Record(6, "d")
+		expected, _, _ = restored.Shutdown(context.Background())
+
+		if !assert.NoError(t, log.Close(), "Close should not fail") {
+			return
+		}
+
+		if !assert.ElementsMatch(t, []string{"c", "d"}, restored.Names(), "a should be evicted") {
+			return
+		}
+
+		actual = replayed()
+		if !assert.Len(t, actual, 2, "a should not be rebuilt") {
+			return
+		}
+		for name, snapshot := range expected {
+			if !assert.Contains(t, actual, name, "%s should be rebuilt", name) {
+				return
+			}
+			if !assert.Equal(t, snapshot.Snapshot, actual[name].Snapshot, "%s should be rebuilt", name) {
+				return
+			}
+		}
+	})
+
+	t.Run("Version 1", func(t *testing.T) {
+		t.Parallel()
+
+		// a version 1 log has no values entries
+		v1 := append([]byte(nil), appendLogHeaderV1...)
+		v1 = append(v1, appendLogDefine, 0, 0, 1, 'a')
+		v1 = append(v1, appendLogRecord, 0, 84)
+		valid := len(v1)
+		v1 = append(v1, appendLogValues, 0, 6, 10)
+
+		path := filepath.Join(t.TempDir(), "v1.log")
+		if !assert.NoError(t, ioutil.WriteFile(path, v1, 0644), "WriteFile should not fail") {
+			return
+		}
+
+		file, _ := os.Open(path)
+		replay, err := ReplayAppendLog(file, func(AppendLogEntry) {})
+		_ = file.Close()
+
+		if !assert.NoError(t, err, "A version 1 log should be replayed") {
+			return
+		}
+		if !assert.Equal(t, AppendLogReplay{Entries: 2, Size: int64(valid), Partial: true}, *replay, "A values entry should be corrupt") {
+			return
+		}
+
+		// opening the log for writing upgrades it
+		log, err := OpenAppendLog(path, &AppendLogOptions{Sync: SyncNever})
+		if !assert.NoError(t, err, "OpenAppendLog should not fail") {
+			return
+		}
+
+		config := HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			AppendLog:                      log,
+		}
+
+		hdrs := NewHistogramMapFromConfig(config)
+		hdrs.RecordValues(3, 5, "a")
+		hdrs.Close()
+
+		if !assert.NoError(t, log.Close(), "Close should not fail") {
+			return
+		}
+
+		config.AppendLog = nil
+		restored, replay, err := NewHistogramMapFromAppendLog(path, config)
+		if !assert.NoError(t, err, "The upgraded log should be replayed") {
+			return
+		}
+		if !assert.False(t, replay.Partial, "The upgraded log should be complete") {
+			return
+		}
+		if !assert.Equal(t, int64(6), restored.Snapshot("a", false).ToHistogram().TotalCount(), "Every value should be rebuilt") {
+			return
+		}
+
+		restored.Close()
+	})
+
+	t.Run("Not An Append Log", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "invalid.log")
+		if !assert.NoError(t, ioutil.WriteFile(path, []byte("not an append log"), 0644), "WriteFile should not fail") {
+			return
+		}
+
+		if _, _, err := NewHistogramFromAppendLog(path, HistogramConfig{}); !assert.Equal(t, ErrNotAppendLog, err, "Replay should fail") {
+			return
+		}
+		if _, err := OpenAppendLog(path, nil); !assert.Equal(t, ErrNotAppendLog, err, "OpenAppendLog should fail") {
+			return
+		}
+
+		// a missing log is empty
+		shdr, replay, err := NewHistogramFromAppendLog(filepath.Join(t.TempDir(), "missing.log"), HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000,
+			NumberOfSignificantValueDigits: 2,
+			CommandBufferSize:              DefaultCommandBufferSize,
+		})
+		if !assert.NoError(t, err, "A missing log should not fail") {
+			return
+		}
+		if !assert.Equal(t, int64(0), replay.Entries, "There should be no entries") {
+			return
+		}
+
+		shdr.Close()
+
+		// a new log can be replayed before any entries are written
+		path = filepath.Join(t.TempDir(), "new.log")
+		log, err := OpenAppendLog(path, &AppendLogOptions{Sync: SyncNever})
+		if !assert.NoError(t, err, "OpenAppendLog should not fail") {
+			return
+		}
+
+		hdrs, replay, err := NewHistogramMapFromAppendLog(path, HistogramConfig{AppendLog: log})
+		if !assert.NoError(t, err, "A new log should not fail") {
+			return
+		}
+		if !assert.Equal(t, AppendLogReplay{Size: int64(len(appendLogHeader))}, *replay, "There should be no entries") {
+			return
+		}
+
+		hdrs.Close()
+		if !assert.NoError(t, log.Close(), "Close should not fail") {
+			return
+		}
+	})
+
+	t.Run("Sync Interval", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "interval.log")
+		log, err := OpenAppendLog(path, &AppendLogOptions{SyncInterval: 10 * time.Millisecond})
+		if !assert.NoError(t, err, "OpenAppendLog should not fail") {
+			return
+		}
+
+		shdr := NewHistogramFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000,
+			NumberOfSignificantValueDigits: 2,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			AppendLog:                      log,
+		})
+		shdr.Record(42)
+		shdr.Snapshot(false)
+
+		// the entries are written without closing the log
+		if !assert.Eventually(t, func() bool {
+			info, err := os.Stat(path)
+			return err == nil && info.Size() > int64(len(appendLogHeader))
+		}, time.Second, time.Millisecond, "The log should be synced") {
+			return
+		}
+
+		shdr.Close()
+		if !assert.NoError(t, log.Close(), "Close should not fail") {
+			return
+		}
+		if !assert.NoError(t, log.Close(), "Close should be safe to call more than once") {
+			return
+		}
+	})
+}
@@ -0,0 +1,282 @@
+package safehdrhistogram
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultChartWidth is the default width (in columns) of a chart
+	DefaultChartWidth = 80
+	// DefaultChartHeight is the default height (in rows) of a percentile
+	// chart
+	DefaultChartHeight = 20
+)
+
+// ChartOptions controls the rendering of terminal charts
+//
+//	Notes
+//		A nil *ChartOptions uses the defaults (DefaultChartWidth,
+//		DefaultChartHeight, and Unicode characters)
+//
+type ChartOptions struct {
+	// Width is the total width of the chart in columns
+	Width int `yaml:"width" json:"width"`
+	// Height is the height of the plot area of a percentile chart in rows
+	Height int `yaml:"height" json:"height"`
+	// ASCII restricts the chart to ASCII characters
+	ASCII bool `yaml:"ascii" json:"ascii"`
+}
+
+// withDefaults returns a copy of opts where zero values are replaced by
+// defaults
+func (opts *ChartOptions) withDefaults() (result ChartOptions) {
+	if opts != nil {
+		result = *opts
+	}
+
+	if result.Width <= 0 {
+		result.Width = DefaultChartWidth
+	}
+	if result.Height <= 0 {
+		result.Height = DefaultChartHeight
+	}
+
+	return
+}
+
+// eighths are the Unicode blocks used to draw fractional bar widths
+var eighths = []rune{' ', '▏', '▎', '▍', '▌', '▋', '▊', '▉', '█'}
+
+// bar returns a bar of width columns, representing fraction (0 to 1) of the
+// width
+func (opts ChartOptions) bar(fraction float64, width int) string {
+	if opts.ASCII {
+		return strings.Repeat("#", int(math.Round(fraction*float64(width))))
+	}
+
+	units := int(math.Round(fraction * float64(width) * 8))
+	result := strings.Repeat(string(eighths[8]), units/8)
+	if units%8 != 0 {
+		result += string(eighths[units%8])
+	}
+
+	return result
+}
+
+// chartBucket is a range of values, and the count of values in the range
+type chartBucket struct {
+	from, to, count int64
+}
+
+// WriteBarChart draws the counts of a Snapshot as a horizontal bar chart,
+// where each bar is a power of 2 range of values (a log scale)
+//
+//	Notes
+//		The ranges are formatted using the Unit and ValueUnitScalingRatio of
+//		the snapshot (see Percentiles.FormatValue)
+//
+func WriteBarChart(writer io.Writer, snapshot *Snapshot, opts *ChartOptions) (err error) {
+	options := opts.withDefaults()
+
+	// group the counts into power of 2 buckets, where bucket k holds the
+	// values from 2^(k-1) through 2^k-1 (and bucket 0 holds 0)
+	var buckets []chartBucket
+	for _, bar := range snapshot.ToHistogram().Distribution() {
+		if bar.Count == 0 {
+			continue
+		}
+
+		k := bits.Len64(uint64(bar.From))
+		for len(buckets) <= k {
+			n := len(buckets)
+			if n == 0 {
+				buckets = append(buckets, chartBucket{})
+			} else {
+				buckets = append(buckets, chartBucket{from: 1 << uint(n-1), to: 1<<uint(n) - 1})
+			}
+		}
+
+		buckets[k].count += bar.Count
+	}
+
+	// drop the empty buckets below the lowest recorded value
+	for len(buckets) > 0 && buckets[0].count == 0 {
+		buckets = buckets[1:]
+	}
+
+	if len(buckets) == 0 {
+		_, err = fmt.Fprintln(writer, "(no values)")
+		return
+	}
+
+	var maxCount int64
+	for _, bucket := range buckets {
+		if bucket.count > maxCount {
+			maxCount = bucket.count
+		}
+	}
+
+	format := func(value int64) string {
+		return formatValue(value, snapshot.Unit, snapshot.ValueUnitScalingRatio)
+	}
+
+	valueWidth := 0
+	for _, bucket := range buckets {
+		for _, value := range []int64{bucket.from, bucket.to} {
+			if n := utf8.RuneCountInString(format(value)); n > valueWidth {
+				valueWidth = n
+			}
+		}
+	}
+	countWidth := len(strconv.FormatInt(maxCount, 10))
+
+	// "from - to | bar count"
+	barWidth := options.Width - (2*valueWidth + 3) - 3 - (countWidth + 1)
+	if barWidth < 10 {
+		barWidth = 10
+	}
+
+	for _, bucket := range buckets {
+		bar := options.bar(float64(bucket.count)/float64(maxCount), barWidth)
+
+		_, err = fmt.Fprintf(writer, "%*s - %*s | %s%s %*d\n",
+			valueWidth, format(bucket.from),
+			valueWidth, format(bucket.to),
+			bar, strings.Repeat(" ", barWidth-len([]rune(bar))),
+			countWidth, bucket.count)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// WritePercentileChart draws Percentiles as a percentile curve, where the
+// x-axis is log(1/(1-percentile)) so the tail of the distribution is
+// visible (the classic HdrHistogram percentile chart)
+//
+//	Notes
+//		The y-axis labels are formatted using FormatValue
+//
+func WritePercentileChart(writer io.Writer, percentiles *Percentiles, opts *ChartOptions) (err error) {
+	options := opts.withDefaults()
+
+	if percentiles.TotalCount == 0 || len(percentiles.Percentiles) == 0 {
+		_, err = fmt.Fprintln(writer, "(no values)")
+		return
+	}
+
+	// the x-axis spans whole decades of 1/(1-percentile), up to the highest
+	// reported percentile below 100%
+	decades := 1
+	for _, perc := range percentiles.Percentiles {
+		if perc.Percentile < 1.0 {
+			if x := int(math.Ceil(math.Log10(1.0 / (1.0 - perc.Percentile)))); x > decades {
+				decades = x
+			}
+		}
+	}
+
+	maxValue := percentiles.MaxValue
+	if maxValue <= 0 {
+		maxValue = 1
+	}
+	height := options.Height
+
+	// label the top, middle, and bottom rows (where the top takes precedence
+	// in a short chart)
+	labels := map[int]string{}
+	labels[height-1] = percentiles.FormatValue(0)
+	if height > 1 {
+		labels[height/2] = percentiles.FormatValue(maxValue * int64(height-1-height/2) / int64(height-1))
+	}
+	labels[0] = percentiles.FormatValue(maxValue)
+
+	labelWidth := 0
+	for _, label := range labels {
+		if n := utf8.RuneCountInString(label); n > labelWidth {
+			labelWidth = n
+		}
+	}
+	width := options.Width - labelWidth - 2
+	if width < 10 {
+		width = 10
+	}
+
+	point, vertical, horizontal, corner := '•', '│', '─', '└'
+	if options.ASCII {
+		point, vertical, horizontal, corner = '*', '|', '-', '+'
+	}
+
+	// plot the curve, one point per column
+	grid := make([][]rune, height)
+	for row := range grid {
+		grid[row] = []rune(strings.Repeat(" ", width))
+	}
+
+	for col := 0; col < width; col++ {
+		x := float64(col) / float64(width-1) * float64(decades)
+		percentile := 100.0 * (1.0 - math.Pow(10, -x))
+		if col == width-1 {
+			percentile = 100.0
+		}
+
+		value := percentiles.ValueAtPercentile(percentile)
+		row := int(math.Round(float64(value) / float64(maxValue) * float64(height-1)))
+		grid[height-1-row][col] = point
+	}
+
+	for row := range grid {
+		_, err = fmt.Fprintf(writer, "%*s %c%s\n", labelWidth, labels[row], vertical, strings.TrimRight(string(grid[row]), " "))
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = fmt.Fprintf(writer, "%*s %c%s\n", labelWidth, "", corner, strings.Repeat(string(horizontal), width))
+	if err != nil {
+		return
+	}
+
+	// label each decade of the x-axis (0%, 90%, 99%, ...)
+	axis := []rune(strings.Repeat(" ", width+labelWidth+2))
+	next := 0
+	for decade := 0; decade <= decades; decade++ {
+		label := []rune(decadeLabel(decade))
+		col := labelWidth + 2 + int(math.Round(float64(decade)/float64(decades)*float64(width-1)))
+		if col+len(label) > len(axis) {
+			col = len(axis) - len(label)
+		}
+
+		// skip labels that would overlap the previous label
+		if col < next {
+			continue
+		}
+
+		copy(axis[col:], label)
+		next = col + len(label) + 1
+	}
+
+	_, err = fmt.Fprintln(writer, strings.TrimRight(string(axis), " "))
+	return
+}
+
+// decadeLabel returns the percentile label for a decade of the x-axis of a
+// percentile chart (0%, 90%, 99%, 99.9%, ...)
+func decadeLabel(decade int) string {
+	switch decade {
+	case 0:
+		return "0%"
+	case 1:
+		return "90%"
+	default:
+		return strings.TrimSuffix("99."+strings.Repeat("9", decade-2), ".") + "%"
+	}
+}
@@ -0,0 +1,101 @@
+package safehdrhistogram
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Charts(t *testing.T) {
+	t.Run("Bar Chart", func(t *testing.T) {
+		t.Parallel()
+
+		shdr := NewHistogram(1, 30000000, 3)
+		for _, value := range []int64{1, 5, 6, 7, 100} {
+			shdr.Record(value)
+		}
+		snapshot := shdr.Snapshot(false)
+		shdr.Close()
+		// chart plain values
+		snapshot.Unit = ""
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, WriteBarChart(&buf, snapshot, &ChartOptions{Width: 40, ASCII: true}), "WriteBarChart should not fail") {
+			return
+		}
+
+		lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+		// 1, 2-3, 4-7, 8-15, 16-31, 32-63, 64-127
+		if !assert.Len(t, lines, 7, "there should be a bar for every power of 2 from 1 to 127") {
+			return
+		}
+		if !assert.Equal(t, "  4 -   7 | "+strings.Repeat("#", 26)+" 3", lines[2], "the largest bucket should be full width") {
+			return
+		}
+		for _, line := range lines {
+			if !assert.Len(t, line, 40, "every line should be the chart width") {
+				return
+			}
+		}
+	})
+
+	t.Run("Percentile Chart", func(t *testing.T) {
+		t.Parallel()
+
+		shdr := NewHistogram(1, 30000000, 3)
+		for value := int64(1); value <= 100; value++ {
+			shdr.Record(value)
+		}
+		percentiles := shdr.Percentiles(false, nil)
+		shdr.Close()
+		// chart plain values
+		percentiles.Unit = ""
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, WritePercentileChart(&buf, percentiles, &ChartOptions{Width: 40, Height: 10}), "WritePercentileChart should not fail") {
+			return
+		}
+
+		lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+		if !assert.Len(t, lines, 12, "the chart should have the plot rows, an axis, and axis labels") {
+			return
+		}
+		if !assert.True(t, strings.HasPrefix(lines[0], "100 │"), "the first row should be labelled with the max value") {
+			return
+		}
+		if !assert.True(t, strings.HasPrefix(lines[11], "     0%"), "the x-axis should start at 0%") {
+			return
+		}
+	})
+
+	t.Run("Chart Units", func(t *testing.T) {
+		t.Parallel()
+
+		// values recorded in microseconds, and displayed in milliseconds
+		hist := hdrhistogram.New(1, 30000000, 3)
+		_ = hist.RecordValue(1500)
+		snapshot := &Snapshot{Snapshot: hist.Export(), Unit: UnitMilliseconds, ValueUnitScalingRatio: 1000}
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, WriteBarChart(&buf, snapshot, &ChartOptions{Width: 40, ASCII: true}), "WriteBarChart should not fail") {
+			return
+		}
+		if !assert.True(t, strings.HasPrefix(buf.String(), "1ms - 2ms | "), "the ranges should be formatted using the unit") {
+			return
+		}
+
+		percentiles := CreatePercentiles(hist)
+		percentiles.Unit, percentiles.ValueUnitScalingRatio = snapshot.Unit, snapshot.ValueUnitScalingRatio
+
+		buf.Reset()
+		if !assert.NoError(t, WritePercentileChart(&buf, percentiles, &ChartOptions{Width: 40, Height: 10}), "WritePercentileChart should not fail") {
+			return
+		}
+		if !assert.True(t, strings.HasPrefix(buf.String(), "1.5ms │"), "the max value should be formatted using the unit") {
+			return
+		}
+	})
+}
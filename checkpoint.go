@@ -0,0 +1,434 @@
+package safehdrhistogram
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// checkpointVersion is the version of the checkpoint format written by
+// WriteCheckpoint
+const checkpointVersion = 1
+
+// checkpoint is the (gzip compressed JSON) contents of a checkpoint file
+//
+//	Notes
+//		Each histogram is stored as an EncodedSnapshot
+//
+type checkpoint struct {
+	Version    int               `json:"version"`
+	Time       int64             `json:"time"`
+	Histograms []EncodedSnapshot `json:"histograms"`
+}
+
+// WriteCheckpoint writes snapshots, by name, to a checkpoint file
+//
+//	Notes
+//		The checkpoint is written to a temporary file in the same directory
+//		and renamed, so the file at path is always a complete checkpoint
+//
+//		See ReadCheckpoint
+//
+func WriteCheckpoint(path string, snapshots map[string]*Snapshot) error {
+	histograms := make([]EncodedSnapshot, 0, len(snapshots))
+	for name, snapshot := range snapshots {
+		encoded, err := EncodeSnapshot(name, snapshot)
+		if err != nil {
+			return err
+		}
+
+		histograms = append(histograms, *encoded)
+	}
+
+	return writeEncodedCheckpoint(path, histograms)
+}
+
+// writeEncodedCheckpoint writes encoded snapshots to a checkpoint file (see
+// WriteCheckpoint)
+func writeEncodedCheckpoint(path string, histograms []EncodedSnapshot) error {
+	contents := checkpoint{
+		Version:    checkpointVersion,
+		Time:       nowMs(SystemClock),
+		Histograms: histograms,
+	}
+
+	sort.Slice(contents.Histograms, func(i, j int) bool {
+		return contents.Histograms[i].Name < contents.Histograms[j].Name
+	})
+
+	return replaceFile(path, func(writer io.Writer) error {
+		return writeCheckpoint(writer, &contents)
+	})
+}
+
+// tempFileSuffix is appended to the name of a file (with a random suffix)
+// to name the temporary file that replaceFile writes
+const tempFileSuffix = ".tmp"
+
+// replaceFile calls write to write a temporary file in the same directory as
+// path, and renames it to path, so the file at path is always complete
+func replaceFile(path string, write func(writer io.Writer) error) (err error) {
+	// ioutil.TempFile (rather than os.CreateTemp) for go 1.15
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+tempFileSuffix+"*")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}
+	}()
+
+	if err = write(file); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// writeCheckpoint writes the gzip compressed JSON encoding of contents
+func writeCheckpoint(writer io.Writer, contents *checkpoint) error {
+	zipper := gzip.NewWriter(writer)
+
+	if err := json.NewEncoder(zipper).Encode(contents); err != nil {
+		return err
+	}
+
+	return zipper.Close()
+}
+
+// ReadCheckpoint reads the snapshots, by name, from a checkpoint file
+//
+//	Notes
+//		The snapshots of a Histogram are named "" (see Histogram.Checkpoint)
+//
+func ReadCheckpoint(path string) (map[string]*Snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	unzipper, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var contents checkpoint
+	if err = json.NewDecoder(unzipper).Decode(&contents); err != nil {
+		return nil, err
+	}
+
+	if contents.Version != checkpointVersion {
+		return nil, fmt.Errorf("safehdrhistogram: unsupported checkpoint version %d", contents.Version)
+	}
+
+	snapshots := make(map[string]*Snapshot, len(contents.Histograms))
+	for i := range contents.Histograms {
+		snapshot, err := contents.Histograms[i].Decode()
+		if err != nil {
+			return nil, err
+		}
+
+		snapshots[contents.Histograms[i].Name] = snapshot
+	}
+
+	return snapshots, nil
+}
+
+// readCheckpoint reads a checkpoint file, and returns no snapshots if the
+// file doesn't exist
+func readCheckpoint(path string) (map[string]*Snapshot, error) {
+	snapshots, err := ReadCheckpoint(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return snapshots, err
+}
+
+// restore creates a histogram based on config that contains the values,
+// start time, and tag of snapshot
+func restore(snapshot *Snapshot, config HistogramConfig) *hdrhistogram.Histogram {
+	hist := hdrhistogram.New(
+		config.LowestDiscernibleValue,
+		config.HighestTrackableValue,
+		config.NumberOfSignificantValueDigits)
+
+	hist.Merge(snapshot.ToHistogram())
+	hist.SetStartTimeMs(snapshot.StartTime)
+	hist.SetTag(snapshot.Tag)
+
+	return hist
+}
+
+// Checkpoint writes a snapshot of the histogram to a checkpoint file (see
+// WriteCheckpoint)
+//
+//	Notes
+//		The snapshot is named ""
+//
+func (hdr *Histogram) Checkpoint(path string) error {
+	snapshot, err := hdr.SnapshotContext(context.Background(), false)
+	if err != nil {
+		return err
+	}
+
+	return WriteCheckpoint(path, map[string]*Snapshot{"": snapshot})
+}
+
+// NewHistogramFromCheckpoint creates a Histogram based on values from a
+// HistogramConfig, and restores the values, start time, and tag from a
+// checkpoint file (see Histogram.Checkpoint)
+//
+//	Notes
+//		If the checkpoint file doesn't exist, the Histogram is empty. Values
+//		that are out of range for config are dropped
+//
+func NewHistogramFromCheckpoint(path string, config HistogramConfig) (*Histogram, error) {
+	snapshots, err := readCheckpoint(path)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, ok := snapshots[""]
+	if !ok {
+		return NewHistogramFromConfig(config), nil
+	}
+
+	return newHistogram(restore(snapshot, config), config), nil
+}
+
+// Checkpoint writes a snapshot of every histogram to a checkpoint file (see
+// WriteCheckpoint)
+//
+//	Notes
+//		Checkpoint doesn't mark the histograms as used, so it doesn't affect
+//		which histograms are evicted (see MemoryPolicyEvictIdle)
+//
+//		Each snapshot is encoded as it is received, so (sparse) histograms
+//		are not all converted to dense snapshots at once
+//
+func (hdr *HistogramMap) Checkpoint(path string) error {
+	var histograms []EncodedSnapshot
+	err := hdr.eachSnapshot(context.Background(), nil, false, func(name string, snapshot *Snapshot) error {
+		encoded, err := EncodeSnapshot(name, snapshot)
+		if err != nil {
+			return err
+		}
+
+		histograms = append(histograms, *encoded)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeEncodedCheckpoint(path, histograms)
+}
+
+// NewHistogramMapFromCheckpoint creates a HistogramMap based on values from a
+// HistogramConfig, and restores the histograms (including their start times
+// and tags) from a checkpoint file (see HistogramMap.Checkpoint)
+//
+//	Notes
+//		If the checkpoint file doesn't exist, the HistogramMap is empty.
+//		Values that are out of range for config are dropped, and histograms
+//		that exceed the memory budget are handled by the memory policy (see
+//		HistogramConfig.MemoryBudget)
+//
+func NewHistogramMapFromCheckpoint(path string, config HistogramConfig) (*HistogramMap, error) {
+	snapshots, err := readCheckpoint(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := NewHistogramMapFromConfig(config)
+
+	names := make([]string, 0, len(snapshots))
+	for name := range snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		hdr.restore(name, snapshots[name])
+	}
+
+	return hdr, nil
+}
+
+// restore creates a histogram for name that contains the values, start
+// time, and tag of snapshot
+//
+//	Notes
+//		The command processor can't reference the histogram until a command
+//		for it is queued, so it is safe to do this before the HistogramMap is
+//		used
+//
+func (hdr *HistogramMap) restore(name string, snapshot *Snapshot) {
+	hdr.lock.Lock()
+	defer hdr.lock.Unlock()
+
+	if err := hdr.create(name); err != nil {
+		return
+	}
+
+	cmd := hdr.target(name)
+	if cmd.sparse != nil {
+		cmd.sparse.merge(snapshot.ToHistogram())
+		cmd.sparse.startTimeMs = snapshot.StartTime
+		cmd.sparse.tag = snapshot.Tag
+	} else {
+		cmd.hist.Merge(snapshot.ToHistogram())
+		cmd.hist.SetStartTimeMs(snapshot.StartTime)
+		cmd.hist.SetTag(snapshot.Tag)
+	}
+
+	atomic.StoreInt64(cmd.size, cmd.byteSize())
+
+	// define the histogram in the log (with its restored start time) as
+	// resolve does when a histogram is created
+	if hdr.config.AppendLog != nil {
+		target, _ := cmd.target()
+		hdr.config.AppendLog.define(target, name, cmd.startTimeMs())
+	}
+}
+
+// Checkpointer periodically writes checkpoints (see
+// Histogram.StartCheckpoints and HistogramMap.StartCheckpoints)
+type Checkpointer struct {
+	// written is the number of checkpoints written, and is accessed
+	// atomically (and is first in the struct for 64-bit alignment)
+	written int64
+
+	path       string
+	checkpoint func(path string) error
+	closed     <-chan struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	// err is the error of the most recent checkpoint, protected by a mutex
+	lock sync.Mutex
+	err  error
+}
+
+// startCheckpoints starts a go routine that calls checkpoint every interval
+// until the Checkpointer is stopped, or closed is closed
+func startCheckpoints(path string, interval time.Duration, checkpoint func(path string) error, closed <-chan struct{}) *Checkpointer {
+	c := &Checkpointer{
+		path:       path,
+		checkpoint: checkpoint,
+		closed:     closed,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	go func() {
+		defer close(c.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.write()
+			case <-c.stop:
+				return
+			case <-closed:
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+// write writes a checkpoint, and remembers the result
+func (c *Checkpointer) write() error {
+	err := c.checkpoint(c.path)
+	if err == nil {
+		atomic.AddInt64(&c.written, 1)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.err = err
+	return err
+}
+
+// Written returns the number of checkpoints written
+func (c *Checkpointer) Written() int64 {
+	return atomic.LoadInt64(&c.written)
+}
+
+// Err returns the error of the most recent checkpoint, or nil if it
+// succeeded
+func (c *Checkpointer) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.err
+}
+
+// Stop stops writing checkpoints, and writes a final checkpoint
+//
+//	Notes
+//		If the Histogram (or HistogramMap) is closed, the final checkpoint
+//		is not written. Write a checkpoint of the final snapshot(s) returned
+//		by Shutdown instead (see WriteCheckpoint)
+//
+//		Stop is safe to call more than once, but only the first call writes
+//		a checkpoint
+//
+func (c *Checkpointer) Stop() (err error) {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		<-c.done
+
+		select {
+		case <-c.closed:
+		default:
+			err = c.write()
+		}
+	})
+
+	return err
+}
+
+// StartCheckpoints writes a checkpoint of the histogram every interval (see
+// Histogram.Checkpoint), until the Checkpointer is stopped or the Histogram
+// is closed
+func (hdr *Histogram) StartCheckpoints(path string, interval time.Duration) *Checkpointer {
+	return startCheckpoints(path, interval, hdr.Checkpoint, hdr.cmds.quit)
+}
+
+// StartCheckpoints writes a checkpoint of every histogram every interval
+// (see HistogramMap.Checkpoint), until the Checkpointer is stopped or the
+// HistogramMap is closed
+func (hdr *HistogramMap) StartCheckpoints(path string, interval time.Duration) *Checkpointer {
+	return startCheckpoints(path, interval, hdr.Checkpoint, hdr.cmds.quit)
+}
@@ -0,0 +1,275 @@
+package safehdrhistogram
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Checkpoint(t *testing.T) {
+	t.Run("Histogram Checkpoint", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "latency.ckpt")
+		config := HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			Clock:                          NewManualClock(time.Unix(1600000000, 0)),
+		}
+
+		// there is no checkpoint on the first start
+		shdr, err := NewHistogramFromCheckpoint(path, config)
+		if !assert.NoError(t, err, "A missing checkpoint should not fail") {
+			return
+		}
+		shdr.WithTag("latency")
+
+		for value := int64(1); value <= 100; value++ {
+			shdr.Record(value)
+		}
+
+		if !assert.NoError(t, shdr.Checkpoint(path), "Checkpoint should not fail") {
+			return
+		}
+		expected := shdr.Close()
+
+		// restart an hour later
+		config.Clock = NewManualClock(time.Unix(1600003600, 0))
+		shdr, err = NewHistogramFromCheckpoint(path, config)
+		if !assert.NoError(t, err, "The checkpoint should be restored") {
+			return
+		}
+
+		shdr.Record(1000)
+
+		actual := shdr.Snapshot(false)
+		if !assert.Equal(t, expected.StartTimeMs(), actual.StartTime, "The start time should be preserved") {
+			return
+		}
+		if !assert.Equal(t, "latency", actual.Tag, "The tag should be preserved") {
+			return
+		}
+		if !assert.Equal(t, int64(101), actual.ToHistogram().TotalCount(), "The values should be restored") {
+			return
+		}
+
+		shdr.Close()
+	})
+
+	t.Run("HistogramMap Checkpoint", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "api.ckpt")
+		config := HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+		}
+
+		hdrs := NewHistogramMapFromConfig(config)
+		hdrs.Record(10, "get", "all")
+		hdrs.Record(20, "put", "all")
+
+		if !assert.NoError(t, hdrs.Checkpoint(path), "Checkpoint should not fail") {
+			return
+		}
+
+		expected, _, _ := hdrs.Shutdown(context.Background())
+
+		// restore as dense and sparse histograms
+		for _, sparse := range []bool{false, true} {
+			config.Sparse = sparse
+
+			restored, err := NewHistogramMapFromCheckpoint(path, config)
+			if !assert.NoError(t, err, "The checkpoint should be restored") {
+				return
+			}
+
+			if !assert.ElementsMatch(t, []string{"all", "get", "put"}, restored.Names(), "Every histogram should be restored") {
+				return
+			}
+
+			for name, snapshot := range expected {
+				actual := restored.Snapshot(name, false)
+				if !assert.Equal(t, snapshot.Snapshot, actual.Snapshot, "%s should be restored", name) {
+					return
+				}
+				if !assert.Equal(t, snapshot.StartTime, actual.StartTime, "The start time of %s should be preserved", name) {
+					return
+				}
+				if !assert.Equal(t, name, actual.Tag, "The tag of %s should be preserved", name) {
+					return
+				}
+			}
+
+			restored.Close()
+		}
+	})
+
+	t.Run("Checkpoint And AppendLog", func(t *testing.T) {
+		t.Parallel()
+
+		dir := t.TempDir()
+		clock := NewManualClock(time.Unix(1600000000, 0))
+		config := HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			Clock:                          clock,
+		}
+
+		hdrs := NewHistogramMapFromConfig(config)
+		hdrs.Record(10, "get", "put")
+		if !assert.NoError(t, hdrs.Checkpoint(filepath.Join(dir, "api.ckpt")), "Checkpoint should not fail") {
+			return
+		}
+		hdrs.Close()
+
+		log, err := OpenAppendLog(filepath.Join(dir, "api.log"), &AppendLogOptions{Sync: SyncNever})
+		if !assert.NoError(t, err, "OpenAppendLog should not fail") {
+			return
+		}
+
+		clock.Advance(time.Hour)
+		config.AppendLog = log
+		restored, err := NewHistogramMapFromCheckpoint(filepath.Join(dir, "api.ckpt"), config)
+		if !assert.NoError(t, err, "The checkpoint should be restored") {
+			return
+		}
+		restored.Record(20, "get")
+		restored.Close()
+
+		if !assert.NoError(t, log.Close(), "Close should not fail") {
+			return
+		}
+
+		// every restored histogram is defined, with its restored start time
+		starts := map[string]int64{}
+		_, err = replayAppendLogFile(filepath.Join(dir, "api.log"), func(entry AppendLogEntry) {
+			if entry.Type == AppendLogStart {
+				starts[entry.Name] = entry.Time
+			}
+		})
+		if !assert.NoError(t, err, "The log should be replayed") {
+			return
+		}
+		if !assert.Equal(t, map[string]int64{"get": 1600000000000, "put": 1600000000000}, starts, "Every restored histogram should be defined") {
+			return
+		}
+	})
+
+	t.Run("Checkpoint And Eviction", func(t *testing.T) {
+		t.Parallel()
+
+		clock := NewManualClock(time.Unix(1600000000, 0))
+		hdrs := NewHistogramMapFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			MemoryBudget:                   2 * denseByteSize(1, 1000000, 3),
+			MemoryPolicy:                   MemoryPolicyEvictIdle,
+			Clock:                          clock,
+		})
+		defer hdrs.Close()
+
+		hdrs.Record(1, "a")
+		clock.Advance(time.Second)
+		hdrs.Record(1, "b")
+		clock.Advance(time.Second)
+		hdrs.Record(1, "a")
+		clock.Advance(time.Second)
+
+		// a checkpoint doesn't use the histograms
+		if !assert.NoError(t, hdrs.Checkpoint(filepath.Join(t.TempDir(), "api.ckpt")), "Checkpoint should not fail") {
+			return
+		}
+
+		hdrs.Record(1, "c")
+
+		if !assert.ElementsMatch(t, []string{"a", "c"}, hdrs.Names(), "b should be evicted") {
+			return
+		}
+	})
+
+	t.Run("Invalid Checkpoint", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "invalid.ckpt")
+		if !assert.NoError(t, ioutil.WriteFile(path, []byte("not a checkpoint"), 0644), "WriteFile should not fail") {
+			return
+		}
+
+		_, err := NewHistogramMapFromCheckpoint(path, HistogramConfig{})
+		if !assert.Error(t, err, "An invalid checkpoint should fail") {
+			return
+		}
+
+		// a failed checkpoint leaves no temporary files
+		if !assert.Error(t, WriteCheckpoint(filepath.Join(path, "child"), nil), "Writing to an invalid path should fail") {
+			return
+		}
+
+		files, _ := ioutil.ReadDir(filepath.Dir(path))
+		if !assert.Len(t, files, 1, "Only the invalid checkpoint should exist") {
+			return
+		}
+	})
+
+	t.Run("Checkpointer", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "periodic.ckpt")
+		hdrs := NewHistogramMap(1, 1000000, 3)
+		hdrs.Record(42, "a")
+
+		checkpoints := hdrs.StartCheckpoints(path, 10*time.Millisecond)
+		if !assert.Eventually(t, func() bool { return checkpoints.Written() > 0 }, time.Second, time.Millisecond, "A checkpoint should be written") {
+			return
+		}
+
+		hdrs.Record(43, "b")
+
+		if !assert.NoError(t, checkpoints.Stop(), "Stop should write a final checkpoint") {
+			return
+		}
+		if !assert.NoError(t, checkpoints.Err(), "There should be no error") {
+			return
+		}
+
+		snapshots, err := ReadCheckpoint(path)
+		if !assert.NoError(t, err, "The checkpoint should be readable") {
+			return
+		}
+		if !assert.Len(t, snapshots, 2, "The final checkpoint should include b") {
+			return
+		}
+
+		hdrs.Close()
+
+		// the Checkpointer stops when the histogram is closed, and no final
+		// checkpoint is written
+		shdr := NewHistogram(1, 1000, 2)
+		closed := shdr.StartCheckpoints(filepath.Join(t.TempDir(), "closed.ckpt"), time.Hour)
+		shdr.Close()
+
+		if !assert.NoError(t, closed.Stop(), "Stop should not fail") {
+			return
+		}
+		if !assert.Equal(t, int64(0), closed.Written(), "No checkpoint should be written") {
+			return
+		}
+		if _, err = os.Stat(closed.path); !assert.True(t, os.IsNotExist(err), "The checkpoint should not exist") {
+			return
+		}
+	})
+}
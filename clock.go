@@ -0,0 +1,71 @@
+package safehdrhistogram
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the current time, which is used for the start and end
+// times of histograms, snapshots, and percentiles
+//
+//	Notes
+//		A Clock must be safe for concurrent use
+//
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock used when none is configured, and uses time.Now
+var SystemClock Clock = systemClock{}
+
+// systemClock is a Clock that uses time.Now
+type systemClock struct{}
+
+// Now returns time.Now()
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// ManualClock is a Clock whose time only changes when Set or Advance is
+// called, for deterministic tests of timestamps
+type ManualClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+// NewManualClock creates a ManualClock set to now
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now returns the current time of the clock
+func (clock *ManualClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	return clock.now
+}
+
+// Set sets the current time of the clock
+func (clock *ManualClock) Set(now time.Time) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	clock.now = now
+}
+
+// Advance moves the current time of the clock forward by d, and returns the
+// new time
+func (clock *ManualClock) Advance(d time.Duration) time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	clock.now = clock.now.Add(d)
+	return clock.now
+}
+
+// nowMs returns the current time of clock in milliseconds since the epoch,
+// which is the resolution of hdrhistogram.Histogram start and end times
+func nowMs(clock Clock) int64 {
+	return clock.Now().UTC().UnixNano() / 1e6
+}
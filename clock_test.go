@@ -0,0 +1,110 @@
+package safehdrhistogram
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Clock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	startMs := start.UnixNano() / 1e6
+
+	t.Run("ManualClock", func(t *testing.T) {
+		t.Parallel()
+
+		clock := NewManualClock(start)
+		if !assert.Equal(t, start, clock.Now(), "Now() should be the initial time") {
+			return
+		}
+		if !assert.Equal(t, start.Add(time.Second), clock.Advance(time.Second), "Advance() should return the new time") {
+			return
+		}
+
+		clock.Set(start)
+		if !assert.Equal(t, start, clock.Now(), "Now() should be the time that was Set") {
+			return
+		}
+	})
+
+	t.Run("Clock Histogram", func(t *testing.T) {
+		t.Parallel()
+
+		clock := NewManualClock(start)
+		shdr := NewHistogramFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          30000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			Clock:                          clock,
+		})
+
+		clock.Advance(time.Minute)
+		snapshot := shdr.Snapshot(true)
+		if !assert.Equal(t, startMs, snapshot.StartTime, "StartTime should be the time of creation") {
+			return
+		}
+		if !assert.Equal(t, startMs+60000, snapshot.EndTime, "EndTime should be the time of the snapshot") {
+			return
+		}
+
+		// the reset restarts the interval
+		clock.Advance(time.Minute)
+		percentiles := shdr.Percentiles(false, nil)
+		if !assert.Equal(t, startMs+60000, percentiles.StartTime, "StartTime should be the time of the reset") {
+			return
+		}
+		if !assert.Equal(t, startMs+120000, percentiles.EndTime, "EndTime should be the time of the percentiles") {
+			return
+		}
+
+		clock.Advance(time.Minute)
+		if !assert.NoError(t, shdr.Reset(), "Reset should not fail") {
+			return
+		}
+
+		clock.Advance(time.Minute)
+		final, _, err := shdr.Shutdown(context.Background())
+		if !assert.NoError(t, err, "Shutdown should not fail") {
+			return
+		}
+		if !assert.Equal(t, startMs+180000, final.StartTime, "StartTime should be the time of the reset") {
+			return
+		}
+		if !assert.Equal(t, startMs+240000, final.EndTime, "EndTime should be the time of the shutdown") {
+			return
+		}
+	})
+
+	t.Run("Clock HistogramMap", func(t *testing.T) {
+		t.Parallel()
+
+		clock := NewManualClock(start)
+		hists := NewHistogramMapFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          30000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			Clock:                          clock,
+		})
+
+		hists.Record(100, "a")
+
+		clock.Advance(time.Second)
+		snapshot := hists.Snapshot("a", false)
+		if !assert.Equal(t, startMs, snapshot.StartTime, "StartTime should be the time of the first reference") {
+			return
+		}
+		if !assert.Equal(t, startMs+1000, snapshot.EndTime, "EndTime should be the time of the snapshot") {
+			return
+		}
+
+		clock.Advance(time.Second)
+		final := hists.Close()
+		if !assert.Equal(t, startMs+2000, final["a"].EndTimeMs(), "EndTime should be the time of the close") {
+			return
+		}
+	})
+}
@@ -1,6 +1,10 @@
 package safehdrhistogram
 
 import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/HdrHistogram/hdrhistogram-go"
@@ -22,74 +26,516 @@ const (
 	cmdReset
 	// cmdSync allows for waiting for the command to be processed
 	cmdSync
-	// cmdStop indicates that the histogram should be finalized
-	cmdStop
+	// cmdCall calls a func on the processing go routine, for operations that
+	// span more than one histogram
+	cmdCall
+
+	// numCommandTypes is the number of command types
+	numCommandTypes
 )
 
+// commandNames are the names of the command types, as reported by Stats
+var commandNames = [numCommandTypes]string{
+	cmdStart:       "start",
+	cmdRecord:      "record",
+	cmdSnapshot:    "snapshot",
+	cmdPercentiles: "percentiles",
+	cmdReset:       "reset",
+	cmdSync:        "sync",
+	cmdCall:        "call",
+}
+
+// String returns the name of the command type
+func (c commandType) String() string {
+	return commandNames[c]
+}
+
 // command represents a command to be processed. Commands operate on a
 // specific hdrhistogram.Histogram and generally include an argument (such as
 // the value to be recorded, or an acknowledgement channel)
 type command struct {
-	hist    *hdrhistogram.Histogram
+	hist *hdrhistogram.Histogram
+	// sparse is the histogram the command targets if the histogram is
+	// sparse (see HistogramConfig.Sparse), in which case hist is nil
+	sparse *sparseHistogram
+	// size is the estimated size of the histogram, which (if not nil) is
+	// updated atomically as commands are processed (see
+	// HistogramMap.ByteSize)
+	size    *int64
 	command commandType
 	arg     interface{}
+	// reset requests that the histogram is reset after a cmdSnapshot or
+	// cmdPercentiles is processed
+	reset bool
+}
+
+// recordValues is the arg of a cmdRecord command that records n
+// occurrences of a value (the arg of a command that records a single value
+// is the value)
+type recordValues struct {
+	value int64
+	n     int64
+}
+
+// values returns the value, and the number of occurrences of the value, that
+// a cmdRecord command records
+func (cmd command) values() (value, n int64) {
+	if values, ok := cmd.arg.(recordValues); ok {
+		return values.value, values.n
+	}
+
+	return cmd.arg.(int64), 1
+}
+
+// histogram returns the histogram the command targets, which is a (dense)
+// copy if the histogram is sparse
+func (cmd command) histogram() *hdrhistogram.Histogram {
+	if cmd.sparse != nil {
+		return cmd.sparse.histogram()
+	}
+
+	return cmd.hist
+}
+
+// target returns the histogram the command targets (a
+// *hdrhistogram.Histogram or *sparseHistogram) and its tag, or nil if the
+// command has no target
+func (cmd command) target() (interface{}, string) {
+	if cmd.sparse != nil {
+		return cmd.sparse, cmd.sparse.tag
+	}
+	if cmd.hist != nil {
+		return cmd.hist, cmd.hist.Tag()
+	}
+
+	return nil, ""
+}
+
+// startTimeMs returns the start time of the histogram the command targets
+func (cmd command) startTimeMs() int64 {
+	if cmd.sparse != nil {
+		return cmd.sparse.startTimeMs
+	}
+
+	return cmd.hist.StartTimeMs()
+}
+
+// resetHistogram resets the histogram the command targets (see
+// resetHistogram)
+func (cmd command) resetHistogram(clock Clock) {
+	if cmd.sparse != nil {
+		cmd.sparse.reset(nowMs(clock))
+		return
+	}
+
+	resetHistogram(cmd.hist, clock)
+}
+
+// callFunc is the argument of a cmdCall command. It is called with abandoned
+// set to true if the command is abandoned (see Histogram.Shutdown), in which
+// case it should only release any waiters
+type callFunc func(p *processor, abandoned bool)
+
+// ErrClosed is returned by operations on a Histogram or HistogramMap that
+// has been closed
+var ErrClosed = errors.New("safehdrhistogram: histogram is closed")
+
+// commandQueue is a command channel that can be safely closed while other
+// goroutines are sending commands
+//
+//	Notes
+//		Once closed, sends fail with ErrClosed rather than panic
+//
+type commandQueue struct {
+	// highWaterMark is the highest number of queued commands, and dropped
+	// is the number of commands that trySend could not queue because the
+	// channel was full. Both are accessed atomically (and are first in the
+	// struct for 64-bit alignment)
+	highWaterMark int64
+	dropped       int64
+
+	lock   sync.RWMutex
+	closed bool
+	cmds   chan command
+
+	// quit is closed at the start of close, to release senders that are
+	// blocked on a full channel (and holding the read lock)
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+// newCommandQueue creates a commandQueue with the specified buffer size
+func newCommandQueue(bufferSize int) *commandQueue {
+	return &commandQueue{
+		cmds: make(chan command, bufferSize),
+		quit: make(chan struct{}),
+	}
+}
+
+// send sends a command to the command channel, but gives up if ctx is
+// cancelled (or its deadline passes) before the command can be queued
+//
+//	Notes
+//		ctx is checked before the select, as select chooses randomly when
+//		ctx is done and the channel has room, so a command could otherwise
+//		be queued with a ctx that was already done
+//
+func (q *commandQueue) send(ctx context.Context, cmd command) error {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	select {
+	case q.cmds <- cmd:
+		q.updateHighWaterMark()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-q.quit:
+		return ErrClosed
+	}
+}
+
+// trySend sends a command to the command channel without blocking, and
+// returns false if the command could not be queued
+func (q *commandQueue) trySend(cmd command) bool {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	if q.closed {
+		return false
+	}
+
+	select {
+	case q.cmds <- cmd:
+		q.updateHighWaterMark()
+		return true
+	default:
+		atomic.AddInt64(&q.dropped, 1)
+		return false
+	}
+}
+
+// updateHighWaterMark raises the high-water mark to the current number of
+// queued commands
+func (q *commandQueue) updateHighWaterMark() {
+	n := int64(len(q.cmds))
+
+	for {
+		mark := atomic.LoadInt64(&q.highWaterMark)
+		if n <= mark || atomic.CompareAndSwapInt64(&q.highWaterMark, mark, n) {
+			return
+		}
+	}
+}
+
+// isClosed returns true if the queue has been closed
+func (q *commandQueue) isClosed() bool {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return q.closed
+}
+
+// close closes the command channel, which terminates processing once the
+// queued commands are consumed
+//
+//	Notes
+//		close returns false if the queue was already closed
+//
+//		Senders that are blocked on a full channel give up with ErrClosed
+//
+func (q *commandQueue) close() bool {
+	q.quitOnce.Do(func() { close(q.quit) })
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return false
+	}
+
+	close(q.cmds)
+	q.closed = true
+
+	return true
+}
+
+// wait waits for an acknowledgement on done, but gives up if ctx is
+// cancelled (or its deadline passes)
+//
+//	Notes
+//		done should be buffered so the command processor never blocks when
+//		the caller gives up waiting
+//
+//		An acknowledgement of false means the command was abandoned by
+//		Shutdown, and wait returns ErrClosed
+//
+func wait(ctx context.Context, done <-chan bool) error {
+	select {
+	case ok := <-done:
+		if !ok {
+			return ErrClosed
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// processor processes commands on a dedicated go routine until the command
+// channel is closed
+type processor struct {
+	// processed is the number of commands processed by command type,
+	// abandoned is the number of commands that were discarded, resizes is
+	// the number of times a histogram was resized, and outOfRange is the
+	// number of values that could not be recorded. All are accessed
+	// atomically (and are first in the struct for 64-bit alignment)
+	processed  [numCommandTypes]int64
+	abandoned  int64
+	resizes    int64
+	outOfRange int64
+
+	// clock provides the start and end times of the histograms
+	clock Clock
+	// unit is the unit of the recorded values, and valueScale is the ratio
+	// that converts them to unit
+	unit       Unit
+	valueScale float64
+
+	// autoResize grows a histogram when a value exceeds its highest
+	// trackable value, up to maxValue (0 is unlimited), and calls onResize
+	autoResize bool
+	maxValue   int64
+	onResize   func(event ResizeEvent)
+
+	// latency is the time taken to process each command
+	latency *latencyRecorder
+
+	// log is the append log of recorded values and resets, or nil
+	log *AppendLog
+
+	// done is closed once processing stops
+	done chan struct{}
+
+	// abandon is closed to discard the remaining commands rather than
+	// process them
+	abandon     chan struct{}
+	abandonOnce sync.Once
 }
 
 // process starts a go routine to process commands on the channel
 //
 //	Notes
-//		Processing terminates when the channel is closed. If the caller
-//		provides a done channel, that channel will be signaled after
-//		processing stops
+//		Processing terminates when the channel is closed, at which point
+//		stop is called (on the processing go routine) to finalize the
+//		histograms, and the done channel is closed
+//
+//		Timestamps are taken from clock, but processing latency (see Stats)
+//		is always measured using the system time
 //
-func process(commands <-chan command, done chan bool) {
-	go func(commands <-chan command, done chan bool) {
+func process(commands <-chan command, done chan struct{}, config HistogramConfig, stop func(now int64)) *processor {
+	clock := config.clock()
+
+	// durations are recorded in DefaultDurationUnit when no unit is
+	// configured, so snapshots report that unit
+	unit := config.Unit
+	if unit == "" {
+		unit = DefaultDurationUnit
+	}
+
+	p := &processor{
+		clock:      clock,
+		unit:       unit,
+		valueScale: config.ValueUnitScalingRatio,
+		autoResize: config.AutoResize,
+		maxValue:   config.MaxTrackableValue,
+		onResize:   config.OnResize,
+		latency:    newLatencyRecorder(clock),
+		log:        config.AppendLog,
+		done:       done,
+		abandon:    make(chan struct{}),
+	}
+
+	go func() {
 		for cmd := range commands {
-			if err := processCommand(cmd); err != nil {
-				// TODO: do something with OutOfRange errors that can occur
-				// when recording a value. Not much more than a warning IMO
+			select {
+			case <-p.abandon:
+				p.discard(cmd)
+				continue
+			default:
 			}
+
+			// count the command before it is processed, so the count includes
+			// any command that has been acknowledged
+			atomic.AddInt64(&p.processed[cmd.command], 1)
+			start := time.Now()
+
+			if err := p.processCommand(cmd); err != nil {
+				// the only error is a value that is out of range (and can't be
+				// resized to fit), which is counted and otherwise ignored
+				atomic.AddInt64(&p.outOfRange, 1)
+			}
+
+			p.latency.record(time.Since(start))
 		}
 
-		if done != nil {
-			done <- true
+		stop(nowMs(p.clock))
+
+		if p.log != nil {
+			_ = p.log.Sync()
 		}
-	}(commands, done)
+
+		close(p.done)
+	}()
+
+	return p
+}
+
+// abandonQueue requests that every command that has not yet been processed
+// is discarded (see discard), and releases a command that is blocked on its
+// reply
+func (p *processor) abandonQueue() {
+	p.abandonOnce.Do(func() { close(p.abandon) })
+}
+
+// discard counts an abandoned command and, where the command expects a
+// reply, replies with nil (or false for acknowledgements) so waiters are
+// released
+//
+//	Notes
+//		Replies are sent without blocking, so a reply to a full (or
+//		unbuffered) channel with no receiver is dropped
+//
+func (p *processor) discard(cmd command) {
+	atomic.AddInt64(&p.abandoned, 1)
+
+	switch cmd.command {
+	case cmdSnapshot:
+		select {
+		case cmd.arg.(SnapshotChannel) <- nil:
+		default:
+		}
+	case cmdPercentiles:
+		select {
+		case cmd.arg.(percentilesRequest).perc <- nil:
+		default:
+		}
+	case cmdCall:
+		cmd.arg.(callFunc)(p, true)
+	case cmdStart, cmdSync, cmdReset:
+		if cmd.arg != nil {
+			select {
+			case cmd.arg.(chan bool) <- false:
+			default:
+			}
+		}
+	}
+}
+
+// acknowledge replies true to a command that expects an acknowledgement,
+// unless the queue is abandoned (see abandonQueue) before the reply is
+// received
+func (p *processor) acknowledge(ack chan bool) {
+	select {
+	case ack <- true:
+	case <-p.abandon:
+	}
 }
 
 // processCommand executes the actions related to a command
-func processCommand(cmd command) (err error) {
+func (p *processor) processCommand(cmd command) (err error) {
+	// log the command before it is processed
+	if p.log != nil {
+		p.log.log(cmd, p.clock)
+	}
+
 	switch cmd.command {
 	case cmdStart:
 		if cmd.hist.StartTimeMs() == 0 {
-			cmd.hist.SetStartTimeMs(time.Now().UTC().UnixNano() / 1e6)
-		}
-
-		if cmd.arg != nil {
-			cmd.arg.(chan bool) <- true
+			cmd.hist.SetStartTimeMs(nowMs(p.clock))
 		}
-	case cmdStop:
-		cmd.hist.SetEndTimeMs(time.Now().UTC().UnixNano() / 1e6)
 
 		if cmd.arg != nil {
-			cmd.arg.(chan bool) <- true
+			p.acknowledge(cmd.arg.(chan bool))
 		}
 	case cmdRecord:
-		err = cmd.hist.RecordValue(cmd.arg.(int64))
+		value, n := cmd.values()
+		if cmd.sparse != nil {
+			err = p.recordSparse(cmd.sparse, value, n)
+		} else {
+			err = p.record(cmd.hist, value, n)
+		}
 	case cmdSnapshot:
-		cmd.arg.(SnapshotChannel) <- CreateSnapshot(cmd.hist)
+		select {
+		case cmd.arg.(SnapshotChannel) <- p.snapshot(cmd.histogram()):
+		case <-p.abandon:
+			// Shutdown has given up waiting for the reply
+		}
+
+		if cmd.reset {
+			cmd.resetHistogram(p.clock)
+		}
 	case cmdPercentiles:
-		cmd.arg.(PercentilesChannel) <- CreatePercentiles(cmd.hist)
+		req := cmd.arg.(percentilesRequest)
+		select {
+		case req.perc <- p.percentiles(cmd.histogram(), req.opts):
+		case <-p.abandon:
+		}
+
+		if cmd.reset {
+			cmd.resetHistogram(p.clock)
+		}
 	case cmdSync:
-		cmd.arg.(chan bool) <- true
+		p.acknowledge(cmd.arg.(chan bool))
+	case cmdCall:
+		cmd.arg.(callFunc)(p, false)
 	case cmdReset:
-		cmd.hist.Reset()
-		cmd.hist.SetStartTimeMs(time.Now().UTC().UnixNano() / 1e6)
+		cmd.resetHistogram(p.clock)
 
 		if cmd.arg != nil {
-			cmd.arg.(chan bool) <- true
+			p.acknowledge(cmd.arg.(chan bool))
 		}
 	}
 
+	// the histogram may have grown (or been reset)
+	if cmd.size != nil {
+		atomic.StoreInt64(cmd.size, cmd.byteSize())
+	}
+
 	return
 }
+
+// snapshot creates a Snapshot of hist, using the clock and unit of the
+// processor
+func (p *processor) snapshot(hist *hdrhistogram.Histogram) *Snapshot {
+	result := createSnapshot(hist, p.clock)
+	result.Unit = p.unit
+	result.ValueUnitScalingRatio = p.valueScale
+
+	return result
+}
+
+// percentiles creates Percentiles for hist, using the clock and unit of the
+// processor
+func (p *processor) percentiles(hist *hdrhistogram.Histogram, opts *PercentilesOptions) *Percentiles {
+	result := createPercentiles(hist, opts, p.clock)
+	result.Unit = p.unit
+	result.ValueUnitScalingRatio = p.valueScale
+
+	return result
+}
+
+// resetHistogram resets a histogram and restarts its time interval at the
+// current time of clock
+func resetHistogram(hist *hdrhistogram.Histogram, clock Clock) {
+	hist.Reset()
+	hist.SetStartTimeMs(nowMs(clock))
+}
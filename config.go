@@ -1,5 +1,11 @@
 package safehdrhistogram
 
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
 // DefaultCommandBufferSize is the default size of the command buffer used to
 // process commands, such as recording a value to a histogram
 const DefaultCommandBufferSize = 256
@@ -11,4 +17,123 @@ type HistogramConfig struct {
 	HighestTrackableValue          int64 `yaml:"highestTrackableValue" json:"highestTrackableValue"`
 	NumberOfSignificantValueDigits int   `yaml:"numberOfSignificantValueDigits" json:"numberOfSignificantValueDigits"`
 	CommandBufferSize              int   `yaml:"commandBufferSize" json:"commandBufferSize"`
+	// Unit is the unit of the recorded values (see RecordDuration). If empty,
+	// durations are recorded (and reported) in DefaultDurationUnit
+	Unit Unit `yaml:"unit" json:"unit"`
+	// ValueUnitScalingRatio is the ratio by which recorded values are
+	// divided to convert them to Unit (e.g. 1000 if values are recorded in
+	// nanoseconds but reported in microseconds). 0 is treated as 1.
+	// RecordDuration multiplies durations by the ratio, so they are
+	// recorded at the same scale as other values
+	ValueUnitScalingRatio float64 `yaml:"valueUnitScalingRatio" json:"valueUnitScalingRatio"`
+
+	// AutoResize grows a histogram (by doubling its highest trackable value)
+	// when a value exceeds HighestTrackableValue, rather than dropping the
+	// value
+	AutoResize bool `yaml:"autoResize" json:"autoResize"`
+	// MaxTrackableValue is the ceiling for AutoResize, where values above
+	// the ceiling are dropped. 0 is no ceiling
+	MaxTrackableValue int64 `yaml:"maxTrackableValue" json:"maxTrackableValue"`
+
+	// Sparse stores only the counts of occupied buckets for each histogram
+	// of a HistogramMap, rather than a dense counts array, so memory is
+	// proportional to the number of distinct (equivalent) values. Sparse
+	// histograms are converted to dense histograms for snapshots, which is
+	// slower, so Sparse suits maps with many names. Checkpoints and the
+	// Registry (and Handler) convert a few histograms at a time, but Close,
+	// Shutdown, StartPushing, and a Streamer hold a dense snapshot of
+	// every histogram at once, so memory briefly grows to that of a dense
+	// map. Histogram ignores Sparse
+	Sparse bool `yaml:"sparse" json:"sparse"`
+
+	// MemoryBudget is the (estimated) memory, in bytes, that the histograms
+	// of a HistogramMap may use, where 0 is unlimited. The budget is applied
+	// when a histogram is created, and MemoryPolicy determines what happens
+	// if the new histogram would exceed it. Histograms that grow once they
+	// are created (Sparse histograms as values are recorded, or histograms
+	// that are resized with AutoResize) can exceed the budget, and their
+	// growth is only counted against the budget when the next histogram is
+	// created. Histogram ignores MemoryBudget
+	MemoryBudget int64 `yaml:"memoryBudget" json:"memoryBudget"`
+	// MemoryPolicy is the action taken when the MemoryBudget would be
+	// exceeded. If empty, MemoryPolicyRefuse is used
+	MemoryPolicy MemoryPolicy `yaml:"memoryPolicy" json:"memoryPolicy"`
+
+	// Clock provides the start and end times of the histograms (and their
+	// snapshots). If nil, SystemClock is used
+	Clock Clock `yaml:"-" json:"-"`
+	// OnResize is called (on the command processing go routine) when a
+	// histogram is resized, and should not block
+	OnResize func(event ResizeEvent) `yaml:"-" json:"-"`
+	// AppendLog is a durable log of the recorded values and resets (see
+	// OpenAppendLog), or nil. SignedHistogram ignores AppendLog
+	AppendLog *AppendLog `yaml:"-" json:"-"`
+}
+
+// clock returns the configured Clock, or SystemClock
+func (config HistogramConfig) clock() Clock {
+	if config.Clock == nil {
+		return SystemClock
+	}
+
+	return config.Clock
+}
+
+// FloatHistogramConfig represents the values used to construct a
+// FloatHistogram and is designed for use in yaml or JSON configuration files
+//
+//	Notes
+//		LowestDiscernibleValue is the resolution of the histogram, and values
+//		are recorded as (rounded) multiples of it. The dynamic range of the
+//		histogram is HighestTrackableValue / LowestDiscernibleValue
+//
+type FloatHistogramConfig struct {
+	LowestDiscernibleValue         float64 `yaml:"lowestDiscernibleValue" json:"lowestDiscernibleValue"`
+	HighestTrackableValue          float64 `yaml:"highestTrackableValue" json:"highestTrackableValue"`
+	NumberOfSignificantValueDigits int     `yaml:"numberOfSignificantValueDigits" json:"numberOfSignificantValueDigits"`
+	CommandBufferSize              int     `yaml:"commandBufferSize" json:"commandBufferSize"`
+	// Unit is the unit of the recorded values (see Unit.Format)
+	Unit Unit `yaml:"unit" json:"unit"`
+
+	// Clock provides the start and end times of the histograms (and their
+	// snapshots). If nil, SystemClock is used
+	Clock Clock `yaml:"-" json:"-"`
+}
+
+// ErrInvalidConfig is returned when a histogram can't be created from a
+// configuration (see NewFloatHistogramFromConfig and
+// NewSignedHistogramFromConfig)
+var ErrInvalidConfig = errors.New("safehdrhistogram: invalid configuration")
+
+// validate returns ErrInvalidConfig (with the reason) if the configuration
+// can't be scaled to the configuration of an integer histogram
+func (config FloatHistogramConfig) validate() error {
+	lowest, highest := config.LowestDiscernibleValue, config.HighestTrackableValue
+
+	switch {
+	case !(lowest > 0) || math.IsInf(lowest, 0):
+		return fmt.Errorf("%w: lowestDiscernibleValue %v must be > 0", ErrInvalidConfig, lowest)
+	case !(highest >= 2*lowest) || math.IsInf(highest, 0):
+		return fmt.Errorf("%w: highestTrackableValue %v must be >= 2 * lowestDiscernibleValue", ErrInvalidConfig, highest)
+	case highest/lowest >= math.MaxInt64/2:
+		return fmt.Errorf("%w: highestTrackableValue / lowestDiscernibleValue is too large", ErrInvalidConfig)
+	case config.NumberOfSignificantValueDigits < 1 || config.NumberOfSignificantValueDigits > 5:
+		return fmt.Errorf("%w: numberOfSignificantValueDigits %d must be 1 to 5", ErrInvalidConfig, config.NumberOfSignificantValueDigits)
+	}
+
+	return nil
+}
+
+// histogramConfig returns the configuration of the integer histogram that
+// records the (scaled) values of a FloatHistogram
+func (config FloatHistogramConfig) histogramConfig() HistogramConfig {
+	return HistogramConfig{
+		LowestDiscernibleValue:         1,
+		HighestTrackableValue:          int64(math.Ceil(config.HighestTrackableValue / config.LowestDiscernibleValue)),
+		NumberOfSignificantValueDigits: config.NumberOfSignificantValueDigits,
+		CommandBufferSize:              config.CommandBufferSize,
+		Unit:                           config.Unit,
+		ValueUnitScalingRatio:          1 / config.LowestDiscernibleValue,
+		Clock:                          config.Clock,
+	}
 }
@@ -0,0 +1,182 @@
+package safehdrhistogram
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// DefaultMaxDecodedSize is the default size limit (in bytes) of a histogram
+// decoded from an EncodedSnapshot
+const DefaultMaxDecodedSize = 64 << 20
+
+// ErrInvalidSnapshot is returned when the counts of an EncodedSnapshot can't
+// be decoded, or describe a histogram that exceeds the size limit
+var ErrInvalidSnapshot = errors.New("safehdrhistogram: invalid encoded snapshot")
+
+// EncodedSnapshot is a Snapshot that is encoded for storage or transport,
+// such as in a checkpoint file, or when sent to an Aggregator
+//
+//	Notes
+//		The counts are stored using the V2 compressed (base64) encoding of
+//		hdrhistogram.Histogram.Encode. The start and end times are stored
+//		separately, as they are not part of the encoding
+//
+type EncodedSnapshot struct {
+	// Source identifies the process (or host) that sent the snapshot to an
+	// Aggregator
+	Source                string  `json:"source,omitempty"`
+	Name                  string  `json:"name"`
+	Tag                   string  `json:"tag"`
+	StartTime             int64   `json:"startTime"`
+	EndTime               int64   `json:"endTime"`
+	Unit                  Unit    `json:"unit,omitempty"`
+	ValueUnitScalingRatio float64 `json:"valueUnitScalingRatio,omitempty"`
+	Counts                string  `json:"counts"`
+}
+
+// EncodeSnapshot encodes a named snapshot (see EncodedSnapshot)
+func EncodeSnapshot(name string, snapshot *Snapshot) (*EncodedSnapshot, error) {
+	counts, err := snapshot.ToHistogram().Encode(hdrhistogram.V2CompressedEncodingCookieBase)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncodedSnapshot{
+		Name:                  name,
+		Tag:                   snapshot.Tag,
+		StartTime:             snapshot.StartTime,
+		EndTime:               snapshot.EndTime,
+		Unit:                  snapshot.Unit,
+		ValueUnitScalingRatio: snapshot.ValueUnitScalingRatio,
+		Counts:                string(counts),
+	}, nil
+}
+
+// Decode decodes the snapshot, limiting the size of the decoded histogram to
+// DefaultMaxDecodedSize (see DecodeLimit)
+func (encoded *EncodedSnapshot) Decode() (*Snapshot, error) {
+	return encoded.DecodeLimit(DefaultMaxDecodedSize)
+}
+
+// DecodeLimit decodes the snapshot, limiting the size (in bytes) of the
+// decoded histogram to maxSize
+//
+//	Notes
+//		The counts are validated before they are decoded, as they may come
+//		from an untrusted source (such as a request to an Aggregator). If the
+//		counts are malformed, or the histogram they describe (see
+//		Histogram.ByteSize) is larger than maxSize, ErrInvalidSnapshot is
+//		returned
+//
+func (encoded *EncodedSnapshot) DecodeLimit(maxSize int64) (*Snapshot, error) {
+	decoded, err := decodeCounts([]byte(encoded.Counts), maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("safehdrhistogram: histogram %q: %w", encoded.Name, err)
+	}
+
+	return &Snapshot{
+		Snapshot:              decoded.Export(),
+		StartTime:             encoded.StartTime,
+		EndTime:               encoded.EndTime,
+		Tag:                   encoded.Tag,
+		Unit:                  encoded.Unit,
+		ValueUnitScalingRatio: encoded.ValueUnitScalingRatio,
+	}, nil
+}
+
+// decodeCounts validates V2 compressed (base64) counts, and decodes them
+//
+//	Notes
+//		hdrhistogram.Decode trusts its input, so it panics on truncated
+//		counts, and allocates whatever the header specifies. The header and
+//		lengths are checked first, and a panic is recovered just in case
+//
+func decodeCounts(counts []byte, maxSize int64) (hist *hdrhistogram.Histogram, err error) {
+	if err = checkCounts(counts, maxSize); err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			hist, err = nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, r)
+		}
+	}()
+
+	return hdrhistogram.Decode(counts)
+}
+
+// checkCounts checks the header, and the compressed and uncompressed
+// lengths, of V2 compressed (base64) counts
+func checkCounts(counts []byte, maxSize int64) error {
+	decoded, err := base64.StdEncoding.DecodeString(string(counts))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+
+	// cookie (4 bytes) and length of the compressed contents (4 bytes)
+	if len(decoded) < 8 {
+		return fmt.Errorf("%w: truncated counts", ErrInvalidSnapshot)
+	}
+	if int32(binary.BigEndian.Uint32(decoded[0:4])) & ^0xf0 != hdrhistogram.V2CompressedEncodingCookieBase {
+		return fmt.Errorf("%w: unsupported encoding", ErrInvalidSnapshot)
+	}
+
+	compressedLength := int64(int32(binary.BigEndian.Uint32(decoded[4:8])))
+	if compressedLength < 0 || compressedLength > int64(len(decoded)-8) {
+		return fmt.Errorf("%w: truncated counts", ErrInvalidSnapshot)
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(decoded[8 : 8+compressedLength]))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	defer reader.Close()
+
+	header := make([]byte, hdrhistogram.ENCODING_HEADER_SIZE)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+
+	if int32(binary.BigEndian.Uint32(header[0:4])) & ^0xf0 != hdrhistogram.V2EncodingCookieBase {
+		return fmt.Errorf("%w: unsupported encoding", ErrInvalidSnapshot)
+	}
+
+	payloadLength := int64(int32(binary.BigEndian.Uint32(header[4:8])))
+	digits := int32(binary.BigEndian.Uint32(header[12:16]))
+	lowest := int64(binary.BigEndian.Uint64(header[16:24]))
+	highest := int64(binary.BigEndian.Uint64(header[24:32]))
+
+	if digits < 1 || digits > 5 || lowest < 1 || highest < 2*lowest {
+		return fmt.Errorf("%w: invalid histogram (%d, %d, %d)", ErrInvalidSnapshot, lowest, highest, digits)
+	}
+
+	if size := denseByteSize(lowest, highest, int(digits)); size > maxSize {
+		return fmt.Errorf("%w: histogram of %d bytes exceeds the limit of %d bytes", ErrInvalidSnapshot, size, maxSize)
+	}
+
+	// each count is a varint of at most 9 bytes
+	countsLen := newSparseHistogram(lowest, highest, int(digits)).countsLen
+	if payloadLength < 0 || payloadLength > 9*countsLen {
+		return fmt.Errorf("%w: invalid payload length %d", ErrInvalidSnapshot, payloadLength)
+	}
+
+	// the payload must be exactly payloadLength bytes, which also bounds
+	// the decompression
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(reader, payloadLength+1))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	if n != payloadLength {
+		return fmt.Errorf("%w: payload of %d bytes, expected %d", ErrInvalidSnapshot, n, payloadLength)
+	}
+
+	return nil
+}
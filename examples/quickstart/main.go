@@ -17,7 +17,7 @@ func dumpPercentiles(hist *safehdrhistogram.Histogram, done <-chan bool) {
 			return
 		case <-time.After(time.Second):
 			var buf bytes.Buffer
-			hist.Percentiles(false).Write(&buf)
+			hist.Percentiles(false, nil).Write(&buf)
 			fmt.Println(buf.String())
 		}
 	}
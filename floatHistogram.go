@@ -0,0 +1,216 @@
+package safehdrhistogram
+
+import (
+	"context"
+	"math"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// FloatHistogram is a concurrency safe histogram of float64 values, such as
+// ratios or CPU seconds
+//
+//	Notes
+//		Values are scaled to integers (multiples of the LowestDiscernibleValue
+//		of the configuration) and recorded to a Histogram
+//
+type FloatHistogram struct {
+	hist  *Histogram
+	ratio float64
+	// unit is the configured unit, which (unlike the unit of a Histogram)
+	// is not defaulted, as float values are not durations
+	unit Unit
+}
+
+// NewFloatHistogram creates a FloatHistogram that tracks values from
+// lowestDiscernibleValue (the resolution) to highestTrackableValue
+//
+//	Notes
+//		See NewFloatHistogramFromConfig
+//
+func NewFloatHistogram(
+	lowestDiscernibleValue,
+	highestTrackableValue float64,
+	numberOfSignificantValueDigits int) (*FloatHistogram, error) {
+
+	return NewFloatHistogramFromConfig(
+		FloatHistogramConfig{
+			LowestDiscernibleValue:         lowestDiscernibleValue,
+			HighestTrackableValue:          highestTrackableValue,
+			NumberOfSignificantValueDigits: numberOfSignificantValueDigits,
+			CommandBufferSize:              DefaultCommandBufferSize,
+		})
+}
+
+// NewFloatHistogramFromConfig creates a FloatHistogram based on values from
+// a FloatHistogramConfig
+//
+//	Notes
+//		ErrInvalidConfig is returned if LowestDiscernibleValue is not > 0,
+//		HighestTrackableValue is less than twice LowestDiscernibleValue (or
+//		the range is too large to scale), or NumberOfSignificantValueDigits
+//		is not 1 to 5
+//
+func NewFloatHistogramFromConfig(config FloatHistogramConfig) (*FloatHistogram, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	histConfig := config.histogramConfig()
+
+	return &FloatHistogram{
+		hist:  NewHistogramFromConfig(histConfig),
+		ratio: histConfig.ValueUnitScalingRatio,
+		unit:  config.Unit,
+	}, nil
+}
+
+// floatSnapshot wraps a Snapshot of the underlying histogram, with the
+// configured unit
+func (hdr *FloatHistogram) floatSnapshot(snapshot *Snapshot) *FloatSnapshot {
+	if snapshot != nil {
+		snapshot.Unit = hdr.unit
+	}
+
+	return newFloatSnapshot(snapshot)
+}
+
+// floatPercentiles converts Percentiles of the underlying histogram, with
+// the configured unit
+func (hdr *FloatHistogram) floatPercentiles(p *Percentiles) *FloatPercentiles {
+	if p != nil {
+		p.Unit = hdr.unit
+	}
+
+	return newFloatPercentiles(p)
+}
+
+// toValue scales a float value to the integer value recorded by the
+// underlying histogram, and returns false if the value can't be recorded
+func toValue(value, ratio float64) (int64, bool) {
+	if value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, false
+	}
+
+	return int64(math.Round(value * ratio)), true
+}
+
+// WithTag sets the tag associated with the FloatHistogram
+//
+//	Notes
+//		Like Histogram.WithTag, this method is not safe for concurrency
+//
+func (hdr *FloatHistogram) WithTag(tag string) *FloatHistogram {
+	hdr.hist.WithTag(tag)
+	return hdr
+}
+
+// Record requests that a value be recorded but will not block if the
+// channel is full
+//
+//	Notes
+//		Record will not block, so if the buffer is full the value is
+//		**dropped**. Negative, NaN, and infinite values are also dropped
+//
+func (hdr *FloatHistogram) Record(value float64) {
+	if v, ok := toValue(value, hdr.ratio); ok {
+		hdr.hist.Record(v)
+	}
+}
+
+// Snapshot blocks until a snapshot request completes
+//
+//	Notes
+//		Snapshot returns nil if the FloatHistogram is closed
+//
+func (hdr *FloatHistogram) Snapshot(reset bool) *FloatSnapshot {
+	return hdr.floatSnapshot(hdr.hist.Snapshot(reset))
+}
+
+// SnapshotContext blocks until a snapshot request completes, or ctx is
+// cancelled (or its deadline passes)
+//
+//	Notes
+//		See Histogram.SnapshotContext
+//
+func (hdr *FloatHistogram) SnapshotContext(ctx context.Context, reset bool) (*FloatSnapshot, error) {
+	snapshot, err := hdr.hist.SnapshotContext(ctx, reset)
+	return hdr.floatSnapshot(snapshot), err
+}
+
+// Percentiles blocks until a percentiles snapshot request completes
+//
+//	Notes
+//		If opts is nil, DefaultPercentilesOptions are used
+//
+//		Percentiles returns nil if the FloatHistogram is closed
+//
+func (hdr *FloatHistogram) Percentiles(reset bool, opts *PercentilesOptions) *FloatPercentiles {
+	return hdr.floatPercentiles(hdr.hist.Percentiles(reset, opts))
+}
+
+// PercentilesContext blocks until a percentiles snapshot request completes,
+// or ctx is cancelled (or its deadline passes)
+//
+//	Notes
+//		See Histogram.PercentilesContext
+//
+func (hdr *FloatHistogram) PercentilesContext(ctx context.Context, reset bool, opts *PercentilesOptions) (*FloatPercentiles, error) {
+	percentiles, err := hdr.hist.PercentilesContext(ctx, reset, opts)
+	return hdr.floatPercentiles(percentiles), err
+}
+
+// Reset resets the histogram
+//
+//	Notes
+//		Reset waits for acknowledgement of the reset, and returns ErrClosed
+//		if the FloatHistogram is closed
+//
+func (hdr *FloatHistogram) Reset() error {
+	return hdr.hist.Reset()
+}
+
+// ResetContext resets the histogram
+//
+//	Notes
+//		See Histogram.ResetContext
+//
+func (hdr *FloatHistogram) ResetContext(ctx context.Context) error {
+	return hdr.hist.ResetContext(ctx)
+}
+
+// Close closes the command channel, waits for all commands to be processed,
+// and returns the final (integer) histogram
+//
+//	Notes
+//		The values of the histogram are scaled (see
+//		FloatHistogramConfig.LowestDiscernibleValue). Use Shutdown for a
+//		final FloatSnapshot
+//
+func (hdr *FloatHistogram) Close() *hdrhistogram.Histogram {
+	return hdr.hist.Close()
+}
+
+// Shutdown closes the command channel, processes the queued commands until
+// ctx is cancelled (or its deadline passes), and returns a final snapshot of
+// the histogram
+//
+//	Notes
+//		See Histogram.Shutdown
+//
+func (hdr *FloatHistogram) Shutdown(ctx context.Context) (final *FloatSnapshot, abandoned int, err error) {
+	snapshot, abandoned, err := hdr.hist.Shutdown(ctx)
+	return hdr.floatSnapshot(snapshot), abandoned, err
+}
+
+// Stats returns the runtime statistics of the command processor of the
+// FloatHistogram
+func (hdr *FloatHistogram) Stats() *Stats {
+	return hdr.hist.Stats()
+}
+
+// Done returns a channel that is closed once the FloatHistogram is closed
+// and all queued commands have been processed
+func (hdr *FloatHistogram) Done() <-chan struct{} {
+	return hdr.hist.Done()
+}
@@ -0,0 +1,217 @@
+package safehdrhistogram
+
+import (
+	"context"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// FloatHistogramMap is a collection of named FloatHistogram instances
+//
+//	Notes
+//		Each histogram is created on demand when first referenced, and every
+//		histogram has the same configuration
+//
+type FloatHistogramMap struct {
+	hists *HistogramMap
+	ratio float64
+}
+
+// NewFloatHistogramMap creates a collection to manage named histograms of
+// float64 values that track values from lowestDiscernibleValue (the
+// resolution) to highestTrackableValue
+//
+//	Notes
+//		See NewFloatHistogramMapFromConfig
+//
+func NewFloatHistogramMap(
+	lowestDiscernibleValue,
+	highestTrackableValue float64,
+	numberOfSignificantValueDigits int) (*FloatHistogramMap, error) {
+
+	return NewFloatHistogramMapFromConfig(
+		FloatHistogramConfig{
+			LowestDiscernibleValue:         lowestDiscernibleValue,
+			HighestTrackableValue:          highestTrackableValue,
+			NumberOfSignificantValueDigits: numberOfSignificantValueDigits,
+			CommandBufferSize:              DefaultCommandBufferSize,
+		})
+}
+
+// NewFloatHistogramMapFromConfig creates a FloatHistogramMap based on values
+// from a FloatHistogramConfig
+//
+//	Notes
+//		ErrInvalidConfig is returned if the configuration is invalid (see
+//		NewFloatHistogramFromConfig)
+//
+func NewFloatHistogramMapFromConfig(config FloatHistogramConfig) (*FloatHistogramMap, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	histConfig := config.histogramConfig()
+
+	return &FloatHistogramMap{
+		hists: NewHistogramMapFromConfig(histConfig),
+		ratio: histConfig.ValueUnitScalingRatio,
+	}, nil
+}
+
+// Names returns the currently active histogram names
+func (hdr *FloatHistogramMap) Names() []string {
+	return hdr.hists.Names()
+}
+
+// Record requests that a value be recorded to one or more histograms but
+// will not block if the channel is full
+//
+//	Notes
+//		Record will not block, so the value is **dropped** if the buffer is
+//		full. Negative, NaN, and infinite values are also dropped
+//
+func (hdr *FloatHistogramMap) Record(value float64, names ...string) {
+	if v, ok := toValue(value, hdr.ratio); ok {
+		hdr.hists.Record(v, names...)
+	}
+}
+
+// Snapshot blocks until a snapshot request completes
+//
+//	Notes
+//		Snapshot returns nil if the FloatHistogramMap is closed
+//
+func (hdr *FloatHistogramMap) Snapshot(name string, reset bool) *FloatSnapshot {
+	return newFloatSnapshot(hdr.hists.Snapshot(name, reset))
+}
+
+// SnapshotContext blocks until a snapshot request completes, or ctx is
+// cancelled (or its deadline passes)
+//
+//	Notes
+//		See HistogramMap.SnapshotContext
+//
+func (hdr *FloatHistogramMap) SnapshotContext(ctx context.Context, name string, reset bool) (*FloatSnapshot, error) {
+	snapshot, err := hdr.hists.SnapshotContext(ctx, name, reset)
+	return newFloatSnapshot(snapshot), err
+}
+
+// Percentiles blocks until a percentiles snapshot request completes
+//
+//	Notes
+//		If opts is nil, DefaultPercentilesOptions are used
+//
+//		Percentiles returns nil if the FloatHistogramMap is closed
+//
+func (hdr *FloatHistogramMap) Percentiles(name string, reset bool, opts *PercentilesOptions) *FloatPercentiles {
+	return newFloatPercentiles(hdr.hists.Percentiles(name, reset, opts))
+}
+
+// PercentilesContext blocks until a percentiles snapshot request completes,
+// or ctx is cancelled (or its deadline passes)
+//
+//	Notes
+//		See HistogramMap.PercentilesContext
+//
+func (hdr *FloatHistogramMap) PercentilesContext(ctx context.Context, name string, reset bool, opts *PercentilesOptions) (*FloatPercentiles, error) {
+	percentiles, err := hdr.hists.PercentilesContext(ctx, name, reset, opts)
+	return newFloatPercentiles(percentiles), err
+}
+
+// Reset resets a named histogram
+//
+//	Notes
+//		Reset waits for acknowledgement of the reset, and returns ErrClosed
+//		if the FloatHistogramMap is closed
+//
+func (hdr *FloatHistogramMap) Reset(name string) error {
+	return hdr.hists.Reset(name)
+}
+
+// ResetContext resets a named histogram
+//
+//	Notes
+//		See HistogramMap.ResetContext
+//
+func (hdr *FloatHistogramMap) ResetContext(ctx context.Context, name string) error {
+	return hdr.hists.ResetContext(ctx, name)
+}
+
+// ResetAll resets all named histograms
+//
+//	Notes
+//		See HistogramMap.ResetAll
+//
+func (hdr *FloatHistogramMap) ResetAll() error {
+	return hdr.hists.ResetAll()
+}
+
+// ResetAllContext resets all named histograms
+//
+//	Notes
+//		See HistogramMap.ResetAllContext
+//
+func (hdr *FloatHistogramMap) ResetAllContext(ctx context.Context) error {
+	return hdr.hists.ResetAllContext(ctx)
+}
+
+// Close closes the command channel, waits for all commands to be processed,
+// and returns the final (integer) histograms by name
+//
+//	Notes
+//		The values of the histograms are scaled (see
+//		FloatHistogramConfig.LowestDiscernibleValue). Use Shutdown for final
+//		FloatSnapshots
+//
+func (hdr *FloatHistogramMap) Close() map[string]*hdrhistogram.Histogram {
+	return hdr.hists.Close()
+}
+
+// Shutdown closes the command channel, processes the queued commands until
+// ctx is cancelled (or its deadline passes), and returns a final snapshot of
+// every histogram by name
+//
+//	Notes
+//		See HistogramMap.Shutdown
+//
+func (hdr *FloatHistogramMap) Shutdown(ctx context.Context) (final map[string]*FloatSnapshot, abandoned int, err error) {
+	snapshots, abandoned, err := hdr.hists.Shutdown(ctx)
+
+	final = make(map[string]*FloatSnapshot, len(snapshots))
+	for name, snapshot := range snapshots {
+		final[name] = newFloatSnapshot(snapshot)
+	}
+
+	return final, abandoned, err
+}
+
+// Stats returns the runtime statistics of the command processor of the
+// FloatHistogramMap
+func (hdr *FloatHistogramMap) Stats() *Stats {
+	return hdr.hists.Stats()
+}
+
+// ByteSize returns the estimated memory used by the histograms, in bytes
+//
+//	Notes
+//		See HistogramMap.ByteSize
+//
+func (hdr *FloatHistogramMap) ByteSize() int64 {
+	return hdr.hists.ByteSize()
+}
+
+// ByteSizes returns the estimated memory used by each histogram, in bytes,
+// by name
+//
+//	Notes
+//		See HistogramMap.ByteSize
+//
+func (hdr *FloatHistogramMap) ByteSizes() map[string]int64 {
+	return hdr.hists.ByteSizes()
+}
+
+// Done returns a channel that is closed once the FloatHistogramMap is closed
+// and all queued commands have been processed
+func (hdr *FloatHistogramMap) Done() <-chan struct{} {
+	return hdr.hists.Done()
+}
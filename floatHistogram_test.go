@@ -0,0 +1,157 @@
+package safehdrhistogram
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FloatHistogram(t *testing.T) {
+	t.Run("Record FloatHistogram", func(t *testing.T) {
+		t.Parallel()
+
+		fhdr, err := NewFloatHistogram(0.001, 1000, 3)
+		if !assert.NoError(t, err, "NewFloatHistogram should not fail") {
+			return
+		}
+		fhdr.WithTag("cpu")
+
+		for _, value := range []float64{0.25, 0.5, 0.75, 1.5} {
+			fhdr.Record(value)
+		}
+
+		// values that can't be recorded are dropped
+		fhdr.Record(-1)
+		fhdr.Record(math.NaN())
+		fhdr.Record(math.Inf(1))
+
+		snapshot := fhdr.Snapshot(false)
+		if !assert.Equal(t, int64(4), snapshot.TotalCount(), "Four values should be recorded") {
+			return
+		}
+		if !assert.InDelta(t, 0.25, snapshot.Min(), 0.001, "Min should be 0.25") {
+			return
+		}
+		if !assert.InDelta(t, 1.5, snapshot.Max(), 0.002, "Max should be 1.5") {
+			return
+		}
+		if !assert.InDelta(t, 0.75, snapshot.Mean(), 0.002, "Mean should be 0.75") {
+			return
+		}
+		if !assert.InDelta(t, 0.5, snapshot.ValueAtPercentile(50), 0.001, "p50 should be 0.5") {
+			return
+		}
+
+		percentiles := fhdr.Percentiles(false, &PercentilesOptions{
+			Percentiles: []float64{50, 100},
+			IncludeMean: true,
+		})
+		if !assert.Equal(t, "cpu", percentiles.Tag, "Percentiles should have the tag") {
+			return
+		}
+		if !assert.Len(t, percentiles.Percentiles, 2, "There should be two percentiles") {
+			return
+		}
+		if !assert.InDelta(t, 0.5, percentiles.Percentiles[0].Value, 0.001, "p50 should be 0.5") {
+			return
+		}
+		if !assert.InDelta(t, 1.5, percentiles.Percentiles[1].Value, 0.002, "p100 should be 1.5") {
+			return
+		}
+		if !assert.InDelta(t, 0.75, *percentiles.Mean, 0.002, "Mean should be 0.75") {
+			return
+		}
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, percentiles.Write(&buf), "Write should not fail") {
+			return
+		}
+		if !assert.Contains(t, buf.String(), "[Min = 0.25, Max = 1.5", "Write should output float values") {
+			return
+		}
+
+		if !assert.NoError(t, fhdr.Reset(), "Reset should not fail") {
+			return
+		}
+
+		final, abandoned, err := fhdr.Shutdown(context.Background())
+		if !assert.NoError(t, err, "Shutdown should not fail") {
+			return
+		}
+		if !assert.Equal(t, 0, abandoned, "No commands should be abandoned") {
+			return
+		}
+		if !assert.Equal(t, int64(0), final.TotalCount(), "The histogram should be reset") {
+			return
+		}
+		if !assert.Nil(t, fhdr.Snapshot(false), "Snapshot() after Shutdown should be nil") {
+			return
+		}
+	})
+
+	t.Run("Record FloatHistogramMap", func(t *testing.T) {
+		t.Parallel()
+
+		fhdrs, err := NewFloatHistogramMapFromConfig(FloatHistogramConfig{
+			LowestDiscernibleValue:         0.01,
+			HighestTrackableValue:          100,
+			NumberOfSignificantValueDigits: 2,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			Unit:                           UnitMilliseconds,
+		})
+		if !assert.NoError(t, err, "NewFloatHistogramMapFromConfig should not fail") {
+			return
+		}
+
+		fhdrs.Record(1.25, "a", "b")
+		fhdrs.Record(2.5, "b")
+
+		if !assert.ElementsMatch(t, []string{"a", "b"}, fhdrs.Names(), "Names should be a and b") {
+			return
+		}
+
+		b := fhdrs.Percentiles("b", false, nil)
+		if !assert.Equal(t, int64(2), b.TotalCount, "b should have two values") {
+			return
+		}
+		if !assert.InDelta(t, 2.5, b.MaxValue, 0.03, "Max of b should be 2.5") {
+			return
+		}
+		if !assert.Equal(t, UnitMilliseconds, b.Unit, "Percentiles should have the unit") {
+			return
+		}
+
+		final := fhdrs.Close()
+		if !assert.Equal(t, int64(1), final["a"].TotalCount(), "a should have one value") {
+			return
+		}
+	})
+
+	t.Run("Invalid Config", func(t *testing.T) {
+		t.Parallel()
+
+		invalid := []FloatHistogramConfig{
+			{LowestDiscernibleValue: 0, HighestTrackableValue: 1000, NumberOfSignificantValueDigits: 3},
+			{LowestDiscernibleValue: -0.001, HighestTrackableValue: 1000, NumberOfSignificantValueDigits: 3},
+			{LowestDiscernibleValue: math.NaN(), HighestTrackableValue: 1000, NumberOfSignificantValueDigits: 3},
+			{LowestDiscernibleValue: 0.001, HighestTrackableValue: 0.001, NumberOfSignificantValueDigits: 3},
+			{LowestDiscernibleValue: 0.001, HighestTrackableValue: math.Inf(1), NumberOfSignificantValueDigits: 3},
+			{LowestDiscernibleValue: 1e-300, HighestTrackableValue: 1e300, NumberOfSignificantValueDigits: 3},
+			{LowestDiscernibleValue: 0.001, HighestTrackableValue: 1000, NumberOfSignificantValueDigits: 0},
+			{LowestDiscernibleValue: 0.001, HighestTrackableValue: 1000, NumberOfSignificantValueDigits: 6},
+		}
+
+		for _, config := range invalid {
+			if _, err := NewFloatHistogramFromConfig(config); !assert.True(t, errors.Is(err, ErrInvalidConfig), "%+v should be invalid", config) {
+				return
+			}
+			if _, err := NewFloatHistogramMapFromConfig(config); !assert.True(t, errors.Is(err, ErrInvalidConfig), "%+v should be invalid", config) {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,179 @@
+package safehdrhistogram
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// FloatSnapshot represents a snapshot of a FloatHistogram
+//
+//	Notes
+//		The underlying Snapshot records integer values, which are divided by
+//		Snapshot.ValueUnitScalingRatio to convert them to float values
+//
+type FloatSnapshot struct {
+	Snapshot *Snapshot
+}
+
+// newFloatSnapshot wraps a Snapshot of a FloatHistogram, or returns nil if
+// snapshot is nil
+func newFloatSnapshot(snapshot *Snapshot) *FloatSnapshot {
+	if snapshot == nil {
+		return nil
+	}
+
+	return &FloatSnapshot{Snapshot: snapshot}
+}
+
+// scale returns the ratio that converts the integer values of the snapshot
+// to float values
+func (snapshot *FloatSnapshot) scale() float64 {
+	return valueScale(snapshot.Snapshot.ValueUnitScalingRatio)
+}
+
+// TotalCount returns the number of recorded values
+func (snapshot *FloatSnapshot) TotalCount() int64 {
+	return snapshot.Snapshot.ToHistogram().TotalCount()
+}
+
+// Min returns the (approximate) lowest recorded value
+func (snapshot *FloatSnapshot) Min() float64 {
+	return float64(snapshot.Snapshot.ToHistogram().Min()) / snapshot.scale()
+}
+
+// Max returns the (approximate) highest recorded value
+func (snapshot *FloatSnapshot) Max() float64 {
+	return float64(snapshot.Snapshot.ToHistogram().Max()) / snapshot.scale()
+}
+
+// Mean returns the (approximate) mean of the recorded values
+func (snapshot *FloatSnapshot) Mean() float64 {
+	return snapshot.Snapshot.ToHistogram().Mean() / snapshot.scale()
+}
+
+// ValueAtPercentile returns the (approximate) value at percentile (expressed
+// as 0 to 100, e.g. 99.9)
+func (snapshot *FloatSnapshot) ValueAtPercentile(percentile float64) float64 {
+	return float64(snapshot.Snapshot.ToHistogram().ValueAtQuantile(percentile)) / snapshot.scale()
+}
+
+// Percentiles creates FloatPercentiles from the snapshot using the specified
+// options
+//
+//	Notes
+//		If opts is nil, DefaultPercentilesOptions are used
+//
+func (snapshot *FloatSnapshot) Percentiles(opts *PercentilesOptions) *FloatPercentiles {
+	return newFloatPercentiles(snapshot.Snapshot.percentiles(opts))
+}
+
+// FloatPercentile represents a percentile, it's (float) value, and cumulative
+// count
+type FloatPercentile struct {
+	Value      float64 `json:"value"`
+	Percentile float64 `json:"percentile"`
+	Count      int64   `json:"count"`
+}
+
+// FloatPercentiles represents a percentiles snapshot of a FloatHistogram
+//
+//	Notes
+//		Percentiles are ordered lowest percentile to highest
+//
+type FloatPercentiles struct {
+	MinValue    float64           `json:"minValue"`
+	MaxValue    float64           `json:"maxValue"`
+	TotalCount  int64             `json:"totalCount"`
+	Percentiles []FloatPercentile `json:"percentiles"`
+	StartTime   int64             `json:"startTime"`
+	EndTime     int64             `json:"endTime"`
+	Tag         string            `json:"tag"`
+	Unit        Unit              `json:"unit,omitempty"`
+	Mean        *float64          `json:"mean,omitempty"`
+	StdDev      *float64          `json:"stdDev,omitempty"`
+	Sum         *float64          `json:"sum,omitempty"`
+}
+
+// newFloatPercentiles converts the integer values of Percentiles to float
+// values (see Percentiles.ValueUnitScalingRatio), or returns nil if p is nil
+func newFloatPercentiles(p *Percentiles) *FloatPercentiles {
+	if p == nil {
+		return nil
+	}
+
+	scale := valueScale(p.ValueUnitScalingRatio)
+
+	result := &FloatPercentiles{
+		MinValue:   float64(p.MinValue) / scale,
+		MaxValue:   float64(p.MaxValue) / scale,
+		TotalCount: p.TotalCount,
+		StartTime:  p.StartTime,
+		EndTime:    p.EndTime,
+		Tag:        p.Tag,
+		Unit:       p.Unit,
+	}
+
+	for _, perc := range p.Percentiles {
+		result.Percentiles = append(
+			result.Percentiles,
+			FloatPercentile{
+				Value:      float64(perc.Value) / scale,
+				Percentile: perc.Percentile,
+				Count:      perc.Count,
+			})
+	}
+
+	if p.Mean != nil {
+		mean := *p.Mean / scale
+		result.Mean = &mean
+	}
+
+	if p.StdDev != nil {
+		stdDev := *p.StdDev / scale
+		result.StdDev = &stdDev
+	}
+
+	if p.Sum != nil {
+		sum := float64(*p.Sum) / scale
+		result.Sum = &sum
+	}
+
+	return result
+}
+
+// Write produces reasonably well formatted output for FloatPercentiles
+//
+//	Notes
+//		Values are formatted using Unit.Format
+//
+func (p *FloatPercentiles) Write(writer io.Writer) (err error) {
+	_, err = fmt.Fprintf(writer, "%12s %12s %12s\n", "Value", "Percentile", "TotalCount")
+	if err != nil {
+		return
+	}
+
+	for _, perc := range p.Percentiles {
+		_, err = fmt.Fprintf(writer, "%12s %12f %12d\n", p.Unit.Format(perc.Value), perc.Percentile, perc.Count)
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = fmt.Fprintf(writer, "  [Min = %s, Max = %s, Total count = %d]\n",
+		p.Unit.Format(p.MinValue),
+		p.Unit.Format(p.MaxValue),
+		p.TotalCount,
+	)
+
+	return
+}
+
+// valueScale returns ratio, or 1 if ratio is not a positive number
+func valueScale(ratio float64) float64 {
+	if ratio <= 0 || math.IsNaN(ratio) || math.IsInf(ratio, 0) {
+		return 1
+	}
+
+	return ratio
+}
@@ -0,0 +1,214 @@
+package safehdrhistogram
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+)
+
+const (
+	// FormatJSON renders Percentiles as JSON
+	FormatJSON = "json"
+	// FormatText renders Percentiles using Percentiles.Write
+	FormatText = "text"
+	// FormatHgrm renders the HdrHistogram percentile distribution (.hgrm)
+	FormatHgrm = "hgrm"
+)
+
+// Handler is an http.Handler that renders the percentiles of the histograms
+// in a Registry, which is useful for inspecting a live process
+//
+//	Notes
+//		Histograms are identified by their registry name (see
+//		Registry.HistogramNames)
+//
+//		The following query parameters are supported:
+//			format	json (default), text, or hgrm
+//			name	a path.Match pattern used to filter names (repeatable)
+//			reset	reset the histograms after the percentiles are taken
+//			ticks	percentile ticks per half distance (default 1)
+//			p		an explicit percentile to report, e.g. 99.9 (repeatable)
+//			stats	include the mean, standard deviation, and sum
+//			scale	value scaling ratio for hgrm output (defaults to the
+//					ValueUnitScalingRatio of each histogram)
+//			list	only list the names of the histograms
+//
+type Handler struct {
+	registry *Registry
+}
+
+// NewHandler creates a Handler for the histograms in registry
+//
+//	Notes
+//		If registry is nil, DefaultRegistry is used
+//
+func NewHandler(registry *Registry) *Handler {
+	if registry == nil {
+		registry = DefaultRegistry
+	}
+
+	return &Handler{registry: registry}
+}
+
+// Publish publishes the percentiles of every histogram in the registry as
+// an expvar.Var
+//
+//	Notes
+//		Publish panics if name is already published (see expvar.Publish)
+//
+func (h *Handler) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return h.registry.PercentilesAll(false, nil)
+	}))
+}
+
+// ServeHTTP renders the percentiles of the histograms known to the handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	patterns := query["name"]
+
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			http.Error(w, fmt.Sprintf("invalid name pattern %q", pattern), http.StatusBadRequest)
+			return
+		}
+	}
+
+	reset, err := boolParam(query.Get("reset"))
+	if err != nil {
+		http.Error(w, "invalid reset: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list, err := boolParam(query.Get("list"))
+	if err != nil {
+		http.Error(w, "invalid list: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts, err := percentilesOptionsParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// a scale of 0 uses the ValueUnitScalingRatio of each histogram
+	scale := 0.0
+	if value := query.Get("scale"); value != "" {
+		if scale, err = strconv.ParseFloat(value, 64); err != nil || scale <= 0 {
+			http.Error(w, fmt.Sprintf("invalid scale %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = FormatJSON
+	}
+
+	if list {
+		h.serveNames(w, format, h.registry.histogramNames(patterns))
+		return
+	}
+
+	switch format {
+	case FormatJSON:
+		result := map[string]*Percentiles{}
+		for _, perc := range h.registry.percentiles(patterns, reset, opts) {
+			result[perc.name] = perc.percentiles
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(result)
+	case FormatText:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, perc := range h.registry.percentiles(patterns, reset, opts) {
+			fmt.Fprintf(w, "# %s\n", perc.name)
+			if err := perc.percentiles.Write(w); err != nil {
+				return
+			}
+			fmt.Fprintln(w)
+		}
+	case FormatHgrm:
+		// the hgrm footer always reports the mean and standard deviation
+		opts.IncludeMean = true
+		opts.IncludeStdDev = true
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, perc := range h.registry.percentiles(patterns, reset, opts) {
+			fmt.Fprintf(w, "# %s\n", perc.name)
+			if err := perc.percentiles.WriteHgrm(w, scale); err != nil {
+				return
+			}
+			fmt.Fprintln(w)
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unsupported format %q", format), http.StatusBadRequest)
+	}
+}
+
+// serveNames renders a list of histogram names
+func (h *Handler) serveNames(w http.ResponseWriter, format string, names []string) {
+	if format == FormatJSON {
+		if names == nil {
+			names = []string{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(names)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, name := range names {
+		fmt.Fprintln(w, name)
+	}
+}
+
+// percentilesOptionsParams parses the ticks, p, and stats query parameters
+// (see Handler)
+func percentilesOptionsParams(query url.Values) (*PercentilesOptions, error) {
+	stats, err := boolParam(query.Get("stats"))
+	if err != nil {
+		return nil, errors.New("invalid stats: " + err.Error())
+	}
+
+	opts := &PercentilesOptions{
+		TicksPerHalfDistance: 1,
+		IncludeMean:          stats,
+		IncludeStdDev:        stats,
+		IncludeSum:           stats,
+	}
+
+	if value := query.Get("ticks"); value != "" {
+		ticks, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || ticks < 1 {
+			return nil, fmt.Errorf("invalid ticks %q", value)
+		}
+		opts.TicksPerHalfDistance = int32(ticks)
+	}
+
+	for _, value := range query["p"] {
+		percentile, err := strconv.ParseFloat(value, 64)
+		if err != nil || percentile < 0 || percentile > 100 {
+			return nil, fmt.Errorf("invalid percentile %q", value)
+		}
+		opts.Percentiles = append(opts.Percentiles, percentile)
+	}
+
+	return opts, nil
+}
+
+// boolParam parses an optional boolean query parameter
+func boolParam(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+
+	return strconv.ParseBool(value)
+}
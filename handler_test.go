@@ -0,0 +1,86 @@
+package safehdrhistogram
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Handler(t *testing.T) {
+	t.Run("Handler JSON", func(t *testing.T) {
+		t.Parallel()
+
+		shdr := NewHistogram(1, 30000000, 3)
+		defer shdr.Close()
+		hists := NewHistogramMap(1, 30000000, 3)
+		defer hists.Close()
+
+		shdr.Record(100)
+		hists.Record(200, "get-user", "api")
+
+		registry := NewRegistry()
+		if !assert.NoError(t, registry.RegisterHistogram("latency", shdr), "register should succeed") {
+			return
+		}
+		if !assert.NoError(t, registry.RegisterHistogramMap("requests", hists), "register should succeed") {
+			return
+		}
+
+		handler := NewHandler(registry)
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?ticks=2", nil))
+		if !assert.Equal(t, http.StatusOK, rec.Code, "unexpected status") {
+			return
+		}
+
+		result := map[string]*Percentiles{}
+		if !assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result), "response should be JSON") {
+			return
+		}
+		if !assert.Len(t, result, 3, "response should contain every histogram") {
+			return
+		}
+		if !assert.Equal(t, int64(1), result["requests/get-user"].TotalCount, "requests/get-user should have one value") {
+			return
+		}
+	})
+
+	t.Run("Handler filter and list", func(t *testing.T) {
+		t.Parallel()
+
+		hists := NewHistogramMap(1, 30000000, 3)
+		defer hists.Close()
+
+		hists.Record(200, "get-user", "api")
+
+		registry := NewRegistry()
+		if !assert.NoError(t, registry.RegisterHistogramMap("requests", hists), "register should succeed") {
+			return
+		}
+
+		handler := NewHandler(registry)
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?list=true&format=text&name=requests/get-*", nil))
+		if !assert.Equal(t, "requests/get-user\n", rec.Body.String(), "list should be filtered by name") {
+			return
+		}
+
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?format=hgrm&name=requests/api", nil))
+		if !assert.True(t, strings.HasPrefix(rec.Body.String(), "# requests/api\n"), "hgrm output should start with the name") {
+			return
+		}
+
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?format=xml", nil))
+		if !assert.Equal(t, http.StatusBadRequest, rec.Code, "unsupported format should be rejected") {
+			return
+		}
+	})
+}
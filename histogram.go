@@ -1,6 +1,10 @@
 package safehdrhistogram
 
 import (
+	"context"
+	"sync/atomic"
+	"time"
+
 	"github.com/HdrHistogram/hdrhistogram-go"
 )
 
@@ -8,9 +12,11 @@ import (
 // command channel to safely manipulate the histogram when there are multiple
 // readers and writers
 type Histogram struct {
-	hist *hdrhistogram.Histogram
-	cmds chan command
-	done chan bool
+	hist   *hdrhistogram.Histogram
+	config HistogramConfig
+	cmds   *commandQueue
+	proc   *processor
+	done   chan struct{}
 }
 
 // NewHistogram creates an instance of hdrhistogram.Histogram that is
@@ -37,36 +43,39 @@ func NewHistogramFromConfig(config HistogramConfig) *Histogram {
 			config.LowestDiscernibleValue,
 			config.HighestTrackableValue,
 			config.NumberOfSignificantValueDigits),
-		config.CommandBufferSize)
+		config)
 }
 
 // newHistogram creates a new Histogram and starts processing
 //
 //	Notes
 //		This func waits for the Start command to be processed before
-//		returning
+//		returning. Only the command buffer size, clock, and unit of config
+//		are used
 //
-func newHistogram(hist *hdrhistogram.Histogram, commandBufferSize int) *Histogram {
+func newHistogram(hist *hdrhistogram.Histogram, config HistogramConfig) *Histogram {
 	hdr := &Histogram{
-		hist: hist,
-		done: make(chan bool),
-		cmds: make(chan command, commandBufferSize),
+		hist:   hist,
+		config: config,
+		done:   make(chan struct{}),
+		cmds:   newCommandQueue(config.CommandBufferSize),
 	}
 
 	// start the cmd processor using the done channel associated with the
-	// histogram, which is signalled when all processing completes
-	process(hdr.cmds, hdr.done)
+	// histogram, which is closed when all processing completes
+	hdr.proc = process(hdr.cmds.cmds, hdr.done, hdr.config, func(now int64) {
+		hdr.hist.SetEndTimeMs(now)
+	})
 
 	// create a acknowledgment channel for the start command
-	done := make(chan bool)
-	defer close(done)
+	done := make(chan bool, 1)
 
 	// request a start
-	hdr.cmds <- command{
+	_ = hdr.cmds.send(context.Background(), command{
 		hist:    hdr.hist,
 		command: cmdStart,
 		arg:     done,
-	}
+	})
 
 	// wait for acknowledgement of the start command
 	<-done
@@ -76,7 +85,13 @@ func newHistogram(hist *hdrhistogram.Histogram, commandBufferSize int) *Histogra
 
 // NewHistogramFromSnapshot re-creates a Histogram from a snapshot
 func NewHistogramFromSnapshot(snapshot *Snapshot) *Histogram {
-	return newHistogram(snapshot.ToHistogram(), DefaultCommandBufferSize)
+	return newHistogram(
+		snapshot.ToHistogram(),
+		HistogramConfig{
+			CommandBufferSize:     DefaultCommandBufferSize,
+			Unit:                  snapshot.Unit,
+			ValueUnitScalingRatio: snapshot.ValueUnitScalingRatio,
+		})
 }
 
 // WithTag sets the tag associated with the Histogram
@@ -101,16 +116,66 @@ func (hdr *Histogram) WithTag(tag string) *Histogram {
 //		RequestRecord will not block, so if the buffer is full the value is
 //		**dropped**
 //
+//		Record is a no-op once the Histogram is closed
+//
 func (hdr *Histogram) Record(value int64) {
-	select {
-	case hdr.cmds <- command{
+	// if the buffer is full (or the histogram is closed) the value is not
+	// recorded
+	hdr.cmds.trySend(command{
 		hist:    hdr.hist,
 		command: cmdRecord,
 		arg:     value,
-	}:
-	default:
-		// value is not recorded
+	})
+}
+
+// RecordValues requests that n occurrences of a value be recorded (such as a
+// sampled value), but will not block if the channel is full
+//
+//	Notes
+//		Like Record, RecordValues will not block, so if the buffer is full the
+//		values are **dropped**. RecordValues is a no-op if n < 1
+//
+func (hdr *Histogram) RecordValues(value, n int64) {
+	if n < 1 {
+		return
 	}
+
+	hdr.cmds.trySend(command{
+		hist:    hdr.hist,
+		command: cmdRecord,
+		arg:     recordValues{value: value, n: n},
+	})
+}
+
+// RecordDuration records a duration, converted to the Unit of the Histogram
+// and multiplied by the ValueUnitScalingRatio (see HistogramConfig.Unit)
+//
+//	Notes
+//		Like Record, RecordDuration will not block, so if the buffer is full
+//		the duration is **dropped**
+//
+func (hdr *Histogram) RecordDuration(d time.Duration) {
+	hdr.Record(durationValue(d, hdr.config.Unit, hdr.config.ValueUnitScalingRatio))
+}
+
+// Time calls f and records the duration of the call (see RecordDuration)
+func (hdr *Histogram) Time(f func()) {
+	timer := hdr.Start()
+	defer timer.Stop()
+
+	f()
+}
+
+// Start starts a Timer that records the elapsed duration when it is stopped
+// (see RecordDuration)
+//
+//	Notes
+//		The duration is measured using the Clock of the Histogram
+//
+//			defer hist.Start().Stop()
+//
+func (hdr *Histogram) Start() *Timer {
+	return newTimer(hdr.config.clock(), hdr.RecordDuration)
 }
 
 // RequestSnapshot requests a snapshot of the Histogram but doesn't wait
@@ -120,46 +185,67 @@ func (hdr *Histogram) Record(value int64) {
 //		RequestSnapshot will block if the command buffer is full, but
 //		otherwise, the request is made and returns to the caller
 //
-func (hdr *Histogram) RequestSnapshot(snap SnapshotChannel, reset bool) {
+//		RequestSnapshot returns ErrClosed if the Histogram is closed
+//
+func (hdr *Histogram) RequestSnapshot(snap SnapshotChannel, reset bool) error {
 	// request a snapshot. The snap channel will be signalled with the
 	// snapshot data when the command is processed
-	hdr.cmds <- command{
+	return hdr.cmds.send(context.Background(), command{
 		hist:    hdr.hist,
 		command: cmdSnapshot,
 		arg:     snap,
-	}
-
-	if reset {
-		hdr.cmds <- command{
-			hist:    hdr.hist,
-			command: cmdReset,
-		}
-	}
+		reset:   reset,
+	})
 }
 
 // Snapshot blocks until a snapshot request completes
+//
+//	Notes
+//		Snapshot returns nil if the Histogram is closed
+//
 func (hdr *Histogram) Snapshot(reset bool) *Snapshot {
-	// create a channel for the snapshot
-	snap := make(SnapshotChannel)
-	defer close(snap)
+	snapshot, _ := hdr.SnapshotContext(context.Background(), reset)
+	return snapshot
+}
+
+// SnapshotContext blocks until a snapshot request completes, or ctx is
+// cancelled (or its deadline passes)
+//
+//	Notes
+//		If ctx is done before the snapshot command is queued, the reset is
+//		not performed. Once queued, the snapshot (and reset) will be
+//		processed even if the caller gives up waiting
+//
+//		SnapshotContext returns ErrClosed if the Histogram is closed
+//
+func (hdr *Histogram) SnapshotContext(ctx context.Context, reset bool) (*Snapshot, error) {
+	// create a channel for the snapshot. The channel is buffered (and not
+	// closed) so processing never blocks if we stop waiting
+	snap := make(SnapshotChannel, 1)
 
 	// request a snapshot. The snap channel will be signalled with the
 	//  snapshot data when the command is processed
-	hdr.cmds <- command{
+	err := hdr.cmds.send(ctx, command{
 		hist:    hdr.hist,
 		command: cmdSnapshot,
 		arg:     snap,
+		reset:   reset,
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if reset {
-		hdr.cmds <- command{
-			hist:    hdr.hist,
-			command: cmdReset,
+	// return the Snapshot
+	select {
+	case snapshot := <-snap:
+		if snapshot == nil {
+			// the snapshot was abandoned by Shutdown
+			return nil, ErrClosed
 		}
+		return snapshot, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-
-	// return the Snapshot
-	return <-snap
 }
 
 // RequestPercentiles requests a percentiles snapshot of the Histogram but
@@ -169,88 +255,183 @@ func (hdr *Histogram) Snapshot(reset bool) *Snapshot {
 //		RequestPercentiles will block if the command buffer is full, but
 //		otherwise, the request is made and returns to the caller
 //
-func (hdr *Histogram) RequestPercentiles(perc PercentilesChannel, reset bool) {
-	// request a snapshot. The snap channel will be signalled with the
-	// snapshot data when the command is processed
-	hdr.cmds <- command{
+//		If opts is nil, DefaultPercentilesOptions are used
+//
+//		RequestPercentiles returns ErrClosed if the Histogram is closed
+//
+func (hdr *Histogram) RequestPercentiles(perc PercentilesChannel, reset bool, opts *PercentilesOptions) error {
+	// request a snapshot. The perc channel will be signalled with the
+	// percentiles data when the command is processed
+	return hdr.cmds.send(context.Background(), command{
 		hist:    hdr.hist,
 		command: cmdPercentiles,
-		arg:     perc,
-	}
-
-	if reset {
-		hdr.cmds <- command{
-			hist:    hdr.hist,
-			command: cmdReset,
-		}
-	}
+		arg:     percentilesRequest{perc: perc, opts: opts},
+		reset:   reset,
+	})
 }
 
-// Snapshot blocks until a snapshot request completes
-func (hdr *Histogram) Percentiles(reset bool) *Percentiles {
-	// create a channel for the percentiles
-	perc := make(PercentilesChannel)
-	defer close(perc)
+// Percentiles blocks until a percentiles snapshot request completes
+//
+//	Notes
+//		If opts is nil, DefaultPercentilesOptions are used
+//
+//		Percentiles returns nil if the Histogram is closed
+//
+func (hdr *Histogram) Percentiles(reset bool, opts *PercentilesOptions) *Percentiles {
+	percentiles, _ := hdr.PercentilesContext(context.Background(), reset, opts)
+	return percentiles
+}
 
-	// request a snapshot. The snap channel will be signalled with the
-	//  snapshot data when the command is processed
-	hdr.cmds <- command{
+// PercentilesContext blocks until a percentiles snapshot request completes,
+// or ctx is cancelled (or its deadline passes)
+//
+//	Notes
+//		If opts is nil, DefaultPercentilesOptions are used
+//
+//		If ctx is done before the percentiles command is queued, the reset
+//		is not performed. Once queued, the percentiles (and reset) will be
+//		processed even if the caller gives up waiting
+//
+//		PercentilesContext returns ErrClosed if the Histogram is closed
+//
+func (hdr *Histogram) PercentilesContext(ctx context.Context, reset bool, opts *PercentilesOptions) (*Percentiles, error) {
+	// create a channel for the percentiles. The channel is buffered (and not
+	// closed) so processing never blocks if we stop waiting
+	perc := make(PercentilesChannel, 1)
+
+	// request a snapshot. The perc channel will be signalled with the
+	//  percentiles data when the command is processed
+	err := hdr.cmds.send(ctx, command{
 		hist:    hdr.hist,
 		command: cmdPercentiles,
-		arg:     perc,
+		arg:     percentilesRequest{perc: perc, opts: opts},
+		reset:   reset,
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if reset {
-		hdr.cmds <- command{
-			hist:    hdr.hist,
-			command: cmdReset,
+	// return the Percentiles
+	select {
+	case percentiles := <-perc:
+		if percentiles == nil {
+			// the percentiles were abandoned by Shutdown
+			return nil, ErrClosed
 		}
+		return percentiles, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-
-	// return the Percentiles
-	return <-perc
 }
 
 // Reset resets the histogram
 //
 //	Notes
-//		Reset waits for acknowledgement of the reset
+//		Reset waits for acknowledgement of the reset, and returns ErrClosed
+//		if the Histogram is closed
+//
+func (hdr *Histogram) Reset() error {
+	return hdr.ResetContext(context.Background())
+}
+
+// ResetContext resets the histogram
+//
+//	Notes
+//		ResetContext waits for acknowledgement of the reset, or until ctx is
+//		cancelled (or its deadline passes). Once queued, the reset will be
+//		processed even if the caller gives up waiting
+//
+//		ResetContext returns ErrClosed if the Histogram is closed
 //
-func (hdr *Histogram) Reset() {
-	// use a channel to wait for confirmation of reset
-	done := make(chan bool)
-	defer close(done)
+func (hdr *Histogram) ResetContext(ctx context.Context) error {
+	// use a (buffered) channel to wait for confirmation of reset
+	done := make(chan bool, 1)
 
 	// request a reset
-	hdr.cmds <- command{
+	err := hdr.cmds.send(ctx, command{
 		hist:    hdr.hist,
 		command: cmdReset,
 		arg:     done,
+	})
+	if err != nil {
+		return err
 	}
 
 	// wait for acknowledgement
-	<-done
+	return wait(ctx, done)
 }
 
 // Close closes the command channel, waits for all commands to be processed,
 // and returns the final histogram
+//
+//	Notes
+//		Close is safe to call more than once, and from multiple goroutines.
+//		Every call waits for processing to complete and returns the final
+//		histogram. Once closed, Record is a no-op and every other method
+//		returns ErrClosed (or nil)
+//
 func (hdr *Histogram) Close() *hdrhistogram.Histogram {
-	// send a stop command
-	hdr.cmds <- command{
-		hist:    hdr.hist,
-		command: cmdStop,
-	}
-
 	// close the channel to terminate processing once queued commands are
-	// consumed. Leave the channel as non-nil so any callers will panic.
-	// the alternative is to set it to nil and callers will deadlock
-	// (RequestRecord is an exception)
-	close(hdr.cmds)
+	// consumed
+	hdr.cmds.close()
 
-	// done is unbuffered so process will block until we read
+	// done is closed when processing completes
 	<-hdr.done
-	close(hdr.done)
 
 	// return the final histogram
 	return hdr.hist
 }
+
+// Shutdown closes the command channel, processes the queued commands until
+// ctx is cancelled (or its deadline passes), and returns a final snapshot of
+// the histogram
+//
+//	Notes
+//		Commands that are still queued when ctx is done are abandoned rather
+//		than processed. Shutdown returns the number of abandoned commands
+//		along with ctx.Err(), and callers waiting on an abandoned command
+//		receive ErrClosed (or nil)
+//
+//		A command that is being processed when ctx is done is allowed to
+//		complete, but its reply is dropped if the receiver isn't ready (such
+//		as a snapshot sent to a channel that is not being read). Shutdown
+//		still waits for a blocked HistogramConfig.OnResize callback
+//
+//		Like Close, Shutdown is safe to call more than once, and from
+//		multiple goroutines
+//
+func (hdr *Histogram) Shutdown(ctx context.Context) (final *Snapshot, abandoned int, err error) {
+	// stop accepting commands
+	hdr.cmds.close()
+
+	// wait for the queued commands to be processed, or abandon them if ctx is
+	// done first
+	select {
+	case <-hdr.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+
+		hdr.proc.abandonQueue()
+		<-hdr.done
+	}
+
+	// processing has stopped, so the histogram is safe to access
+	return hdr.proc.snapshot(hdr.hist), int(atomic.LoadInt64(&hdr.proc.abandoned)), err
+}
+
+// Stats returns the runtime statistics of the command processor of the
+// Histogram
+//
+//	Notes
+//		Stats does not queue a command, so it can be used even when the
+//		command buffer is full (or the Histogram is closed)
+//
+func (hdr *Histogram) Stats() *Stats {
+	return hdr.proc.stats(hdr.cmds)
+}
+
+// Done returns a channel that is closed once the Histogram is closed and
+// all queued commands have been processed
+func (hdr *Histogram) Done() <-chan struct{} {
+	return hdr.done
+}
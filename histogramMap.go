@@ -1,7 +1,10 @@
 package safehdrhistogram
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/HdrHistogram/hdrhistogram-go"
 )
@@ -14,13 +17,27 @@ import (
 //		histogram has the same configuration (see the config field.)
 //
 type HistogramMap struct {
-	config HistogramConfig
-	cmds   chan command
-	done   chan bool
+	// refused, evicted, and downgraded count the actions taken to keep
+	// within the memory budget (see HistogramConfig.MemoryBudget). All are
+	// accessed atomically (and are first in the struct for 64-bit alignment)
+	refused    int64
+	evicted    int64
+	downgraded int64
 
-	// the collection of histograms, protected by a mutex
+	config HistogramConfig
+	cmds   *commandQueue
+	proc   *processor
+	done   chan struct{}
+
+	// the collection of histograms, protected by a mutex. Histograms are
+	// held in hists, or in sparse if config.Sparse is set. sizes is the
+	// estimated size of each histogram (see command.size), and lastUsed is
+	// the time each histogram was last referenced (see MemoryPolicyEvictIdle)
 	lock      sync.RWMutex
 	hists     map[string]*hdrhistogram.Histogram
+	sparse    map[string]*sparseHistogram
+	sizes     map[string]*int64
+	lastUsed  map[string]int64
 	histNames []string
 }
 
@@ -54,52 +71,86 @@ func NewHistogramMap(
 //
 func NewHistogramMapFromConfig(config HistogramConfig) *HistogramMap {
 	hdr := &HistogramMap{
-		done:   make(chan bool),
+		done:   make(chan struct{}),
 		config: config,
-		cmds:   make(chan command, config.CommandBufferSize),
+		cmds:   newCommandQueue(config.CommandBufferSize),
 		hists:  map[string]*hdrhistogram.Histogram{},
+		sparse: map[string]*sparseHistogram{},
+		sizes:  map[string]*int64{},
+
+		lastUsed: map[string]int64{},
 	}
 
-	// start the cmd processor
-	process(hdr.cmds, hdr.done)
+	// start the cmd processor. Histograms are only created before the
+	// command channel is closed (see resolve), so the maps are safe to
+	// iterate when processing stops
+	hdr.proc = process(hdr.cmds.cmds, hdr.done, config, func(now int64) {
+		for _, hist := range hdr.hists {
+			hist.SetEndTimeMs(now)
+		}
+		for _, hist := range hdr.sparse {
+			hist.endTimeMs = now
+		}
+	})
 
 	return hdr
 }
 
-// resolveHistogram looks up a histogram by name, creating and initializing
-// it if it doesn't exist
-func (hdr *HistogramMap) resolveHistogram(name string) *hdrhistogram.Histogram {
+// resolve looks up a histogram by name, creating and initializing it if it
+// doesn't exist, and returns a command that targets it
+//
+//	Notes
+//		resolve returns ErrClosed if the HistogramMap is closed, or
+//		ErrMemoryBudget if the histogram can't be created (see
+//		HistogramConfig.MemoryBudget)
+//
+func (hdr *HistogramMap) resolve(name string) (command, error) {
 	hdr.lock.Lock()
 	defer hdr.lock.Unlock()
 
-	var hist *hdrhistogram.Histogram
-	var ok bool
+	// Close holds the lock while closing the command queue, so no histograms
+	// are created once the map is closed
+	if hdr.cmds.isClosed() {
+		return command{}, ErrClosed
+	}
+
+	_, isHist := hdr.hists[name]
+	_, isSparse := hdr.sparse[name]
 
-	if hist, ok = hdr.hists[name]; !ok {
+	if !isHist && !isSparse {
 		// create a new histogram for this name
-		hist = hdrhistogram.New(
-			hdr.config.LowestDiscernibleValue,
-			hdr.config.HighestTrackableValue,
-			hdr.config.NumberOfSignificantValueDigits)
-
-		hist.SetTag(name)
-
-		// remember it
-		hdr.hists[name] = hist
-		hdr.histNames = append(hdr.histNames, name)
-
-		// issue a start command to initialize it
-		//
-		// Note that unlike the Histogram we do not block until the
-		// start command is processed
-		hdr.cmds <- command{
-			hist:    hist,
-			command: cmdStart,
-			arg:     nil,
+		if err := hdr.create(name); err != nil {
+			return command{}, err
+		}
+
+		// define the histogram in the log when it is created (rather than
+		// when it is first logged), which is before any command for it is
+		// queued
+		cmd := hdr.target(name)
+		if hdr.config.AppendLog != nil {
+			target, _ := cmd.target()
+			hdr.config.AppendLog.define(target, name, cmd.startTimeMs())
 		}
+
+		return cmd, nil
+	} else if hdr.config.MemoryPolicy == MemoryPolicyEvictIdle {
+		hdr.lastUsed[name] = nowMs(hdr.config.clock())
 	}
 
-	return hist
+	return hdr.target(name), nil
+}
+
+// target returns a command that targets an existing histogram
+//
+//	Notes
+//		The lock must be held by the caller
+//
+func (hdr *HistogramMap) target(name string) command {
+	if hist, ok := hdr.sparse[name]; ok {
+		return command{sparse: hist, size: hdr.sizes[name]}
+	}
+
+	return command{hist: hdr.hists[name], size: hdr.sizes[name]}
 }
 
 // Names returns the currently active histogram names
@@ -117,22 +168,94 @@ func (hdr *HistogramMap) Names() []string {
 //		RequestRecord will not block, so the value is **dropped** if the buffer
 //		is full
 //
+//		Record is a no-op once the HistogramMap is closed
+//
 func (hdr *HistogramMap) Record(value int64, names ...string) {
+	hdr.record(value, names)
+}
+
+// RecordValues records n occurrences of a value (such as a sampled value) to
+// one or more histograms
+//
+//	Notes
+//		Like Record, RecordValues will not block, so the values are
+//		**dropped** if the buffer is full. RecordValues is a no-op if n < 1
+//
+func (hdr *HistogramMap) RecordValues(value, n int64, names ...string) {
+	hdr.recordValues(value, n, names)
+}
+
+// recordValues records n occurrences of a value to the named histograms (see
+// RecordValues), and returns the number of histograms the values were queued
+// for
+func (hdr *HistogramMap) recordValues(value, n int64, names []string) int {
+	if n == 1 {
+		return hdr.record(value, names)
+	} else if n > 1 {
+		return hdr.record(recordValues{value: value, n: n}, names)
+	}
+
+	return 0
+}
+
+// record sends a cmdRecord command with arg (see command.values) to the
+// named histograms, and returns the number of commands that were queued
+func (hdr *HistogramMap) record(arg interface{}, names []string) (queued int) {
 	for _, name := range names {
-		// get/create a histogram for name
-		hist := hdr.resolveHistogram(name)
+		// get/create a histogram for name. If the histogram can't be created
+		// (see HistogramConfig.MemoryBudget) the value is dropped
+		cmd, err := hdr.resolve(name)
+		if err == ErrClosed {
+			return
+		} else if err != nil {
+			continue
+		}
 
 		// send the record command without blocking. If the buffer is full, the
 		// value is dropped
-		select {
-		case hdr.cmds <- command{
-			hist:    hist,
-			command: cmdRecord,
-			arg:     value,
-		}:
-		default:
+		cmd.command = cmdRecord
+		cmd.arg = arg
+		if hdr.cmds.trySend(cmd) {
+			queued++
 		}
 	}
+
+	return
+}
+
+// RecordDuration records a duration to one or more histograms, converted to
+// the Unit of the HistogramMap and multiplied by the ValueUnitScalingRatio
+// (see HistogramConfig.Unit)
+//
+//	Notes
+//		Like Record, RecordDuration will not block, so the duration is
+//		**dropped** if the buffer is full
+//
+func (hdr *HistogramMap) RecordDuration(d time.Duration, names ...string) {
+	hdr.Record(durationValue(d, hdr.config.Unit, hdr.config.ValueUnitScalingRatio), names...)
+}
+
+// Time calls f and records the duration of the call to one or more
+// histograms (see RecordDuration)
+func (hdr *HistogramMap) Time(f func(), names ...string) {
+	timer := hdr.Start(names...)
+	defer timer.Stop()
+
+	f()
+}
+
+// Start starts a Timer that records the elapsed duration to one or more
+// histograms when it is stopped (see RecordDuration)
+//
+//	Notes
+//		The duration is measured using the Clock of the HistogramMap
+//
+//			defer hists.Start("get", "all").Stop()
+//
+func (hdr *HistogramMap) Start(names ...string) *Timer {
+	return newTimer(hdr.config.clock(), func(d time.Duration) {
+		hdr.RecordDuration(d, names...)
+	})
 }
 
 // RequestSnapshot requests a snapshot for one or more histograms and is non-blocking
@@ -140,54 +263,80 @@ func (hdr *HistogramMap) Record(value int64, names ...string) {
 //	Notes
 //		Consider buffering for snap if multiple snapshots are requested
 //
-func (hdr *HistogramMap) RequestSnapshot(snap SnapshotChannel, reset bool, names ...string) {
+//		RequestSnapshot returns ErrClosed if the HistogramMap is closed
+//
+func (hdr *HistogramMap) RequestSnapshot(snap SnapshotChannel, reset bool, names ...string) error {
 	for _, name := range names {
 		// get/create a histogram for name
-		hist := hdr.resolveHistogram(name)
-
-		// request a snapshot
-		hdr.cmds <- command{
-			hist:    hist,
-			command: cmdSnapshot,
-			arg:     snap,
+		cmd, err := hdr.resolve(name)
+		if err != nil {
+			return err
 		}
 
-		if reset {
-			// request a reset
-			hdr.cmds <- command{
-				hist:    hist,
-				command: cmdReset,
-			}
+		// request a snapshot
+		cmd.command = cmdSnapshot
+		cmd.arg = snap
+		cmd.reset = reset
+		err = hdr.cmds.send(context.Background(), cmd)
+		if err != nil {
+			return err
 		}
 	}
+
+	return nil
 }
 
 // Snapshot blocks until a snapshot request completes
+//
+//	Notes
+//		Snapshot returns nil if the HistogramMap is closed
+//
 func (hdr *HistogramMap) Snapshot(name string, reset bool) *Snapshot {
+	snapshot, _ := hdr.SnapshotContext(context.Background(), name, reset)
+	return snapshot
+}
+
+// SnapshotContext blocks until a snapshot request completes, or ctx is
+// cancelled (or its deadline passes)
+//
+//	Notes
+//		If ctx is done before the snapshot command is queued, the reset is
+//		not performed. Once queued, the snapshot (and reset) will be
+//		processed even if the caller gives up waiting
+//
+//		SnapshotContext returns ErrClosed if the HistogramMap is closed
+//
+func (hdr *HistogramMap) SnapshotContext(ctx context.Context, name string, reset bool) (*Snapshot, error) {
 	// get/create a histogram for name
-	hist := hdr.resolveHistogram(name)
+	cmd, err := hdr.resolve(name)
+	if err != nil {
+		return nil, err
+	}
 
-	// create a channel for the snapshot
-	snap := make(SnapshotChannel)
-	defer close(snap)
+	// create a channel for the snapshot. The channel is buffered (and not
+	// closed) so processing never blocks if we stop waiting
+	snap := make(SnapshotChannel, 1)
 
 	// request a snapshot
-	hdr.cmds <- command{
-		hist:    hist,
-		command: cmdSnapshot,
-		arg:     snap,
+	cmd.command = cmdSnapshot
+	cmd.arg = snap
+	cmd.reset = reset
+	err = hdr.cmds.send(ctx, cmd)
+	if err != nil {
+		return nil, err
 	}
 
-	if reset {
-		// request a reset
-		hdr.cmds <- command{
-			hist:    hist,
-			command: cmdReset,
+	// block until the snapshot is available, then return it
+	select {
+	case snapshot := <-snap:
+		if snapshot == nil {
+			// the snapshot was abandoned by Shutdown
+			return nil, ErrClosed
 		}
+		return snapshot, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-
-	// block until the snapshot is available, then return it
-	return <-snap
 }
 
 // SnapshotAll performs a snapshot for every named histogram
@@ -197,7 +346,26 @@ func (hdr *HistogramMap) Snapshot(name string, reset bool) *Snapshot {
 //		effectively blocks all other activity as the lock for the
 //		histogram map is held for the duration
 //
-func (hdr *HistogramMap) SnapshotAll(snap SnapshotChannel, reset bool) {
+//		SnapshotAll returns ErrClosed if the HistogramMap is closed
+//
+func (hdr *HistogramMap) SnapshotAll(snap SnapshotChannel, reset bool) error {
+	return hdr.SnapshotAllContext(context.Background(), snap, reset)
+}
+
+// SnapshotAllContext performs a snapshot for every named histogram
+//
+//	Notes
+//		SnapshotAllContext waits for acknowledgement of the snapshots, or
+//		until ctx is cancelled (or its deadline passes), and effectively
+//		blocks all other activity as the lock for the histogram map is held
+//		for the duration
+//
+//		Snapshots that were queued before ctx is done are still processed
+//		(and sent to snap) even if the caller gives up waiting
+//
+//		SnapshotAllContext returns ErrClosed if the HistogramMap is closed
+//
+func (hdr *HistogramMap) SnapshotAllContext(ctx context.Context, snap SnapshotChannel, reset bool) error {
 	// take the lock as we need to iterate the map of histograms
 	hdr.lock.Lock()
 	// we may have this lock for a while but nothing in the cmd processing can
@@ -205,35 +373,164 @@ func (hdr *HistogramMap) SnapshotAll(snap SnapshotChannel, reset bool) {
 	// have already happened
 	defer hdr.lock.Unlock()
 
-	for _, hist := range hdr.hists {
+	for _, name := range hdr.histNames {
+		cmd := hdr.target(name)
+
 		// send a snapshot command
-		hdr.cmds <- command{
-			hist:    hist,
-			command: cmdSnapshot,
-			arg:     snap,
+		cmd.command = cmdSnapshot
+		cmd.arg = snap
+		cmd.reset = reset
+		err := hdr.cmds.send(ctx, cmd)
+		if err != nil {
+			return err
+		}
+	}
+
+	// wait for confirmation of snapshots completing
+	return hdr.sync(ctx)
+}
+
+// snapshotWindow is the number of snapshots that eachSnapshot requests
+// before waiting for them, which bounds the number of (dense) snapshots in
+// memory at once
+const snapshotWindow = 16
+
+// snapshots takes a snapshot of every histogram whose name satisfies match
+// (or every histogram if match is nil), by name
+//
+//	Notes
+//		See eachSnapshot. If an error occurs, the snapshots that were
+//		received are returned with the error, as their resets may already
+//		have been performed
+//
+func (hdr *HistogramMap) snapshots(ctx context.Context, match func(name string) bool, reset bool) (map[string]*Snapshot, error) {
+	snapshots := map[string]*Snapshot{}
+	err := hdr.eachSnapshot(ctx, match, reset, func(name string, snapshot *Snapshot) error {
+		snapshots[name] = snapshot
+		return nil
+	})
+
+	return snapshots, err
+}
+
+// eachSnapshot takes a snapshot of every histogram whose name satisfies
+// match (or every histogram if match is nil), and calls f with each
+// snapshot, stopping at the first error
+//
+//	Notes
+//		Unlike SnapshotContext, eachSnapshot never creates a histogram, and
+//		doesn't mark the histograms as used (see MemoryPolicyEvictIdle), so
+//		background snapshots (such as checkpoints) don't affect which
+//		histograms are evicted
+//
+//		Snapshots are requested snapshotWindow histograms at a time, so
+//		(sparse) histograms are not all converted to dense snapshots at
+//		once, and a histogram that is evicted before it is requested is
+//		skipped. The lock is held while the commands are queued, but not
+//		while waiting for the snapshots
+//
+func (hdr *HistogramMap) eachSnapshot(ctx context.Context, match func(name string) bool, reset bool, f func(name string, snapshot *Snapshot) error) error {
+	hdr.lock.Lock()
+	var names []string
+	for _, name := range hdr.histNames {
+		if match == nil || match(name) {
+			names = append(names, name)
+		}
+	}
+	hdr.lock.Unlock()
+
+	for len(names) > 0 {
+		count := len(names)
+		if count > snapshotWindow {
+			count = snapshotWindow
+		}
+
+		if err := hdr.snapshotNames(ctx, names[:count], reset, f); err != nil {
+			return err
+		}
+
+		names = names[count:]
+	}
+
+	return nil
+}
+
+// snapshotNames takes a snapshot of each of the named histograms (that
+// still exist), and calls f with each snapshot (see eachSnapshot)
+func (hdr *HistogramMap) snapshotNames(ctx context.Context, names []string, reset bool, f func(name string, snapshot *Snapshot) error) error {
+	type request struct {
+		name string
+		snap SnapshotChannel
+	}
+
+	var requests []request
+	var err error
+
+	hdr.lock.Lock()
+	for _, name := range names {
+		_, isHist := hdr.hists[name]
+		_, isSparse := hdr.sparse[name]
+		if !isHist && !isSparse {
+			// evicted since the names were collected
+			continue
 		}
 
-		if reset {
-			// request a reset
-			hdr.cmds <- command{
-				hist:    hist,
-				command: cmdReset,
+		// the channel is buffered (and not closed) so processing never
+		// blocks if we stop waiting
+		snap := make(SnapshotChannel, 1)
+
+		cmd := hdr.target(name)
+		cmd.command = cmdSnapshot
+		cmd.arg = snap
+		cmd.reset = reset
+		if err = hdr.cmds.send(ctx, cmd); err != nil {
+			break
+		}
+
+		requests = append(requests, request{name: name, snap: snap})
+	}
+	hdr.lock.Unlock()
+
+	// the queued snapshots are processed (and their resets performed) even
+	// if sending a later command failed
+	for _, req := range requests {
+		select {
+		case snapshot := <-req.snap:
+			if snapshot == nil {
+				// the snapshot was abandoned by Shutdown
+				if err == nil {
+					err = ErrClosed
+				}
+				continue
 			}
+			if fErr := f(req.name, snapshot); fErr != nil {
+				return fErr
+			}
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 
-	// use a channel to wait for confirmation of snapshots completing
-	done := make(chan bool)
+	return err
+}
+
+// sync waits until every command queued before it has been processed, or
+// until ctx is cancelled (or its deadline passes)
+func (hdr *HistogramMap) sync(ctx context.Context) error {
+	// use a (buffered) channel to wait for confirmation
+	done := make(chan bool, 1)
 
 	// request a sync
-	hdr.cmds <- command{
+	err := hdr.cmds.send(ctx, command{
 		hist:    nil,
 		command: cmdSync,
 		arg:     done,
+	})
+	if err != nil {
+		return err
 	}
 
-	<-done
-	close(done)
+	return wait(ctx, done)
 }
 
 // RequestPercentiles requests a percentiles snapshot for one or more
@@ -242,54 +539,86 @@ func (hdr *HistogramMap) SnapshotAll(snap SnapshotChannel, reset bool) {
 //	Notes
 //		Consider buffering for perc if multiple percentiles are requested
 //
-func (hdr *HistogramMap) RequestPercentiles(perc PercentilesChannel, reset bool, names ...string) {
+//		If opts is nil, DefaultPercentilesOptions are used
+//
+//		RequestPercentiles returns ErrClosed if the HistogramMap is closed
+//
+func (hdr *HistogramMap) RequestPercentiles(perc PercentilesChannel, reset bool, opts *PercentilesOptions, names ...string) error {
 	for _, name := range names {
 		// get/create a histogram for name
-		hist := hdr.resolveHistogram(name)
-
-		// request a snapshot
-		hdr.cmds <- command{
-			hist:    hist,
-			command: cmdPercentiles,
-			arg:     perc,
+		cmd, err := hdr.resolve(name)
+		if err != nil {
+			return err
 		}
 
-		if reset {
-			// request a reset
-			hdr.cmds <- command{
-				hist:    hist,
-				command: cmdReset,
-			}
+		// request a percentiles snapshot
+		cmd.command = cmdPercentiles
+		cmd.arg = percentilesRequest{perc: perc, opts: opts}
+		cmd.reset = reset
+		err = hdr.cmds.send(context.Background(), cmd)
+		if err != nil {
+			return err
 		}
 	}
+
+	return nil
 }
 
 // Percentiles blocks until a percentiles snapshot request completes
-func (hdr *HistogramMap) Percentiles(name string, reset bool) *Percentiles {
-	// get/create a histogram for name
-	hist := hdr.resolveHistogram(name)
+//
+//	Notes
+//		If opts is nil, DefaultPercentilesOptions are used
+//
+//		Percentiles returns nil if the HistogramMap is closed
+//
+func (hdr *HistogramMap) Percentiles(name string, reset bool, opts *PercentilesOptions) *Percentiles {
+	percentiles, _ := hdr.PercentilesContext(context.Background(), name, reset, opts)
+	return percentiles
+}
 
-	// create a channel for the snapshot
-	perc := make(PercentilesChannel)
-	defer close(perc)
+// PercentilesContext blocks until a percentiles snapshot request completes,
+// or ctx is cancelled (or its deadline passes)
+//
+//	Notes
+//		If opts is nil, DefaultPercentilesOptions are used
+//
+//		If ctx is done before the percentiles command is queued, the reset
+//		is not performed. Once queued, the percentiles (and reset) will be
+//		processed even if the caller gives up waiting
+//
+//		PercentilesContext returns ErrClosed if the HistogramMap is closed
+//
+func (hdr *HistogramMap) PercentilesContext(ctx context.Context, name string, reset bool, opts *PercentilesOptions) (*Percentiles, error) {
+	// get/create a histogram for name
+	cmd, err := hdr.resolve(name)
+	if err != nil {
+		return nil, err
+	}
 
-	// request a snapshot
-	hdr.cmds <- command{
-		hist:    hist,
-		command: cmdPercentiles,
-		arg:     perc,
+	// create a channel for the percentiles. The channel is buffered (and not
+	// closed) so processing never blocks if we stop waiting
+	perc := make(PercentilesChannel, 1)
+
+	// request a percentiles snapshot
+	cmd.command = cmdPercentiles
+	cmd.arg = percentilesRequest{perc: perc, opts: opts}
+	cmd.reset = reset
+	err = hdr.cmds.send(ctx, cmd)
+	if err != nil {
+		return nil, err
 	}
 
-	if reset {
-		// request a reset
-		hdr.cmds <- command{
-			hist:    hist,
-			command: cmdReset,
+	// block until the percentiles are available, then return them
+	select {
+	case percentiles := <-perc:
+		if percentiles == nil {
+			// the percentiles were abandoned by Shutdown
+			return nil, ErrClosed
 		}
+		return percentiles, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-
-	// block until the snapshot is available, then return it
-	return <-perc
 }
 
 // PercentilesAll performs a percentiles snapshot for every named histogram
@@ -299,7 +628,31 @@ func (hdr *HistogramMap) Percentiles(name string, reset bool) *Percentiles {
 //		and effectively blocks all other activity as the lock for the
 //		histogram map is held for the duration
 //
-func (hdr *HistogramMap) PercentilesAll(perc PercentilesChannel, reset bool) {
+//		If opts is nil, DefaultPercentilesOptions are used
+//
+//		PercentilesAll returns ErrClosed if the HistogramMap is closed
+//
+func (hdr *HistogramMap) PercentilesAll(perc PercentilesChannel, reset bool, opts *PercentilesOptions) error {
+	return hdr.PercentilesAllContext(context.Background(), perc, reset, opts)
+}
+
+// PercentilesAllContext performs a percentiles snapshot for every named
+// histogram
+//
+//	Notes
+//		PercentilesAllContext waits for acknowledgement of the percentiles
+//		snapshots, or until ctx is cancelled (or its deadline passes), and
+//		effectively blocks all other activity as the lock for the histogram
+//		map is held for the duration
+//
+//		Percentiles snapshots that were queued before ctx is done are still
+//		processed (and sent to perc) even if the caller gives up waiting
+//
+//		If opts is nil, DefaultPercentilesOptions are used
+//
+//		PercentilesAllContext returns ErrClosed if the HistogramMap is closed
+//
+func (hdr *HistogramMap) PercentilesAllContext(ctx context.Context, perc PercentilesChannel, reset bool, opts *PercentilesOptions) error {
 	// take the lock as we need to iterate the map of histograms
 	hdr.lock.Lock()
 	// we may have this lock for a while but nothing in the cmd processing can
@@ -307,73 +660,85 @@ func (hdr *HistogramMap) PercentilesAll(perc PercentilesChannel, reset bool) {
 	// have already happened
 	defer hdr.lock.Unlock()
 
-	for _, hist := range hdr.hists {
-		// send a snapshot command
-		hdr.cmds <- command{
-			hist:    hist,
-			command: cmdPercentiles,
-			arg:     perc,
-		}
+	for _, name := range hdr.histNames {
+		cmd := hdr.target(name)
 
-		if reset {
-			// request a reset
-			hdr.cmds <- command{
-				hist:    hist,
-				command: cmdReset,
-			}
+		// send a percentiles command
+		cmd.command = cmdPercentiles
+		cmd.arg = percentilesRequest{perc: perc, opts: opts}
+		cmd.reset = reset
+		err := hdr.cmds.send(ctx, cmd)
+		if err != nil {
+			return err
 		}
 	}
 
-	// use a channel to wait for confirmation of percentiles snapshots
-	// completing
-	done := make(chan bool)
-
-	// request a sync
-	hdr.cmds <- command{
-		hist:    nil,
-		command: cmdSync,
-		arg:     done,
-	}
-
-	<-done
-	close(done)
+	// wait for confirmation of percentiles snapshots completing
+	return hdr.sync(ctx)
 }
 
 // RequestReset requests a snapshot of one or more histograms and is non-blocking
-func (hdr *HistogramMap) RequestReset(snap SnapshotChannel, names ...string) {
+//
+//	Notes
+//		RequestReset returns ErrClosed if the HistogramMap is closed
+//
+func (hdr *HistogramMap) RequestReset(snap SnapshotChannel, names ...string) error {
 	for _, name := range names {
 		// get/create a histogram for name
-		hist := hdr.resolveHistogram(name)
+		cmd, err := hdr.resolve(name)
+		if err != nil {
+			return err
+		}
 
-		// request a snapshot
-		hdr.cmds <- command{
-			hist:    hist,
-			command: cmdReset,
+		// request a reset
+		cmd.command = cmdReset
+		err = hdr.cmds.send(context.Background(), cmd)
+		if err != nil {
+			return err
 		}
 	}
+
+	return nil
 }
 
 // Reset resets a named histogram
 //
 //	Notes
-//		Reset waits for acknowledgement of the reset
+//		Reset waits for acknowledgement of the reset, and returns ErrClosed
+//		if the HistogramMap is closed
+//
+func (hdr *HistogramMap) Reset(name string) error {
+	return hdr.ResetContext(context.Background(), name)
+}
+
+// ResetContext resets a named histogram
+//
+//	Notes
+//		ResetContext waits for acknowledgement of the reset, or until ctx is
+//		cancelled (or its deadline passes). Once queued, the reset will be
+//		processed even if the caller gives up waiting
+//
+//		ResetContext returns ErrClosed if the HistogramMap is closed
 //
-func (hdr *HistogramMap) Reset(name string) {
+func (hdr *HistogramMap) ResetContext(ctx context.Context, name string) error {
 	// get/create a histogram for name
-	hist := hdr.resolveHistogram(name)
+	cmd, err := hdr.resolve(name)
+	if err != nil {
+		return err
+	}
 
-	// use a channel to wait for confirmation of reset
-	done := make(chan bool)
-	defer close(done)
+	// use a (buffered) channel to wait for confirmation of reset
+	done := make(chan bool, 1)
 
 	// send a reset command
-	hdr.cmds <- command{
-		hist:    hist,
-		command: cmdReset,
-		arg:     done,
+	cmd.command = cmdReset
+	cmd.arg = done
+	err = hdr.cmds.send(ctx, cmd)
+	if err != nil {
+		return err
 	}
 
-	<-done
+	return wait(ctx, done)
 }
 
 // ResetAll resets all named histograms
@@ -383,7 +748,23 @@ func (hdr *HistogramMap) Reset(name string) {
 //		effectively blocks all other activity as the lock for the
 //		histogram map is held for the duration
 //
-func (hdr *HistogramMap) ResetAll() {
+//		ResetAll returns ErrClosed if the HistogramMap is closed
+//
+func (hdr *HistogramMap) ResetAll() error {
+	return hdr.ResetAllContext(context.Background())
+}
+
+// ResetAllContext resets all named histograms
+//
+//	Notes
+//		ResetAllContext waits for acknowledgement of the resets, or until
+//		ctx is cancelled (or its deadline passes), and effectively blocks all
+//		other activity as the lock for the histogram map is held for the
+//		duration
+//
+//		ResetAllContext returns ErrClosed if the HistogramMap is closed
+//
+func (hdr *HistogramMap) ResetAllContext(ctx context.Context) error {
 	// take the lock as we need to iterate the map of histograms
 	hdr.lock.Lock()
 	// we may have this lock for a while but nothing in the cmd processing can
@@ -391,55 +772,123 @@ func (hdr *HistogramMap) ResetAll() {
 	// have already happened
 	defer hdr.lock.Unlock()
 
-	for _, hist := range hdr.hists {
+	for _, name := range hdr.histNames {
+		cmd := hdr.target(name)
+
 		// send a reset command
-		hdr.cmds <- command{
-			hist:    hist,
-			command: cmdReset,
+		cmd.command = cmdReset
+		err := hdr.cmds.send(ctx, cmd)
+		if err != nil {
+			return err
 		}
 	}
 
-	// use a channel to wait for confirmation of percentiles snapshots
-	// completing
-	done := make(chan bool)
+	// wait for confirmation of the resets completing
+	return hdr.sync(ctx)
+}
 
-	// request a sync
-	hdr.cmds <- command{
-		hist:    nil,
-		command: cmdSync,
-		arg:     done,
+// Close closes the command channel, waits for all commands to be processed,
+// and returns the final histograms by name
+//
+//	Notes
+//		Close is safe to call more than once, and from multiple goroutines.
+//		Every call waits for processing to complete and returns the final
+//		histograms. Once closed, Record is a no-op and every other method
+//		returns ErrClosed (or nil)
+//
+//		Sparse histograms (see HistogramConfig.Sparse) are converted to
+//		dense histograms
+//
+func (hdr *HistogramMap) Close() map[string]*hdrhistogram.Histogram {
+	// take the lock so no histograms are created while the channel is
+	// closed. By the time we release it (and any waiters), the cmd channel
+	// is already closed
+	hdr.lock.Lock()
+	defer hdr.lock.Unlock()
+
+	// close the channel to terminate processing once queued commands are
+	// consumed (this is a no-op if the map is already closed)
+	hdr.cmds.close()
+
+	// done is closed when processing completes
+	<-hdr.done
+
+	// return the map of histograms by name, converting any sparse histograms
+	// to dense histograms
+	for name, hist := range hdr.sparse {
+		hdr.hists[name] = hist.histogram()
 	}
+	hdr.sparse = map[string]*sparseHistogram{}
 
-	<-done
-	close(done)
+	return hdr.hists
 }
 
-func (hdr *HistogramMap) Close() map[string]*hdrhistogram.Histogram {
-	// take the lock as we need to iterate the map of histograms
+// Shutdown closes the command channel, processes the queued commands until
+// ctx is cancelled (or its deadline passes), and returns a final snapshot of
+// every histogram by name
+//
+//	Notes
+//		Commands that are still queued when ctx is done are abandoned rather
+//		than processed. Shutdown returns the number of abandoned commands
+//		along with ctx.Err(), and callers waiting on an abandoned command
+//		receive ErrClosed (or nil)
+//
+//		A command that is being processed when ctx is done is allowed to
+//		complete, but its reply is dropped if the receiver isn't ready (such
+//		as a snapshot sent to a channel that is not being read). Shutdown
+//		still waits for a blocked HistogramConfig.OnResize callback
+//
+//		Like Close, Shutdown is safe to call more than once, and from
+//		multiple goroutines
+//
+func (hdr *HistogramMap) Shutdown(ctx context.Context) (final map[string]*Snapshot, abandoned int, err error) {
+	// take the lock so no histograms are created while the channel is
+	// closed, but don't hold it while waiting for processing to stop
+	hdr.lock.Lock()
+	hdr.cmds.close()
+	hdr.lock.Unlock()
+
+	// wait for the queued commands to be processed, or abandon them if ctx is
+	// done first
+	select {
+	case <-hdr.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+
+		hdr.proc.abandonQueue()
+		<-hdr.done
+	}
+
+	// processing has stopped, so the histograms are safe to access
 	hdr.lock.Lock()
-	// we may have this lock for a while but nothing in the cmd processing can
-	// access it and by the time we release it (and any waiters), the cmd
-	// channel is already closed
 	defer hdr.lock.Unlock()
 
-	for _, hist := range hdr.hists {
-		// send a stop command to each histogram
-		hdr.cmds <- command{
-			hist:    hist,
-			command: cmdStop,
-		}
+	final = make(map[string]*Snapshot, len(hdr.histNames))
+	for _, name := range hdr.histNames {
+		final[name] = hdr.proc.snapshot(hdr.target(name).histogram())
 	}
 
-	// close the channel to terminate processing once queued commands are
-	// consumed. Leave the channel as non-nil so any callers will panic.
-	// the alternative is to set it to nil and callers will deadlock
-	close(hdr.cmds)
+	return final, int(atomic.LoadInt64(&hdr.proc.abandoned)), err
+}
 
-	// wait for process to signal (channel is unbuffered so process is blocked
-	// until we read)
-	<-hdr.done
-	close(hdr.done)
+// Stats returns the runtime statistics of the command processor of the
+// HistogramMap
+//
+//	Notes
+//		Stats does not queue a command, so it can be used even when the
+//		command buffer is full (or the HistogramMap is closed)
+//
+func (hdr *HistogramMap) Stats() *Stats {
+	stats := hdr.proc.stats(hdr.cmds)
+	stats.MemoryRefused = atomic.LoadInt64(&hdr.refused)
+	stats.MemoryEvicted = atomic.LoadInt64(&hdr.evicted)
+	stats.MemoryDowngraded = atomic.LoadInt64(&hdr.downgraded)
 
-	// return the map of histograms by name
-	return hdr.hists
+	return stats
+}
+
+// Done returns a channel that is closed once the HistogramMap is closed and
+// all queued commands have been processed
+func (hdr *HistogramMap) Done() <-chan struct{} {
+	return hdr.done
 }
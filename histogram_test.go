@@ -1,7 +1,11 @@
 package safehdrhistogram
 
 import (
+	"bytes"
+	"context"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -55,13 +59,64 @@ func Test_Histogram_Cycle(t *testing.T) {
 			return
 		}
 
-		if !assert.Panics(t, func() { shdr.Record(32) }, "RequestRecord should panic when stopped") {
+		select {
+		case <-shdr.Done():
+		default:
+			assert.Fail(t, "Done() should be closed when stopped")
 			return
 		}
-		if !assert.Panics(t, func() { shdr.Record(32) }, "Record should panic when stopped") {
+
+		if !assert.NotPanics(t, func() { shdr.Record(32) }, "Record should not panic when stopped") {
+			return
+		}
+		if !assert.Equal(t, ErrClosed, shdr.Reset(), "Reset should return ErrClosed when stopped") {
+			return
+		}
+		if !assert.Nil(t, shdr.Snapshot(false), "Snapshot should return nil when stopped") {
+			return
+		}
+		if _, err := shdr.PercentilesContext(context.Background(), false, nil); !assert.Equal(t, ErrClosed, err, "PercentilesContext should return ErrClosed when stopped") {
+			return
+		}
+		if !assert.Equal(t, ErrClosed, shdr.RequestSnapshot(make(SnapshotChannel, 1), false), "RequestSnapshot should return ErrClosed when stopped") {
+			return
+		}
+		if !assert.Equal(t, hist, shdr.Close(), "Close should be idempotent") {
+			return
+		}
+	})
+
+	t.Run("Stop HistogramMap", func(t *testing.T) {
+		t.Parallel()
+
+		hists := NewHistogramMap(1, 30000000, 3)
+		hists.Record(32, "a")
+
+		// close concurrently
+		results := make(chan int, 2)
+		for i := 0; i < 2; i++ {
+			go func() { results <- len(hists.Close()) }()
+		}
+		if !assert.Equal(t, 1, <-results, "Close should return every histogram") {
 			return
 		}
-		if !assert.Panics(t, func() { shdr.Reset() }, "Record should panic when stopped") {
+		if !assert.Equal(t, 1, <-results, "Close should be idempotent") {
+			return
+		}
+
+		<-hists.Done()
+
+		hists.Record(32, "b")
+		if !assert.Equal(t, []string{"a"}, hists.Names(), "Record should not create histograms when stopped") {
+			return
+		}
+		if !assert.Equal(t, ErrClosed, hists.Reset("a"), "Reset should return ErrClosed when stopped") {
+			return
+		}
+		if !assert.Equal(t, ErrClosed, hists.SnapshotAll(make(SnapshotChannel, 1), false), "SnapshotAll should return ErrClosed when stopped") {
+			return
+		}
+		if !assert.Nil(t, hists.Percentiles("a", false, nil), "Percentiles should return nil when stopped") {
 			return
 		}
 	})
@@ -255,7 +310,7 @@ func Test_Histogram_Percentiles(t *testing.T) {
 			shdr.Record(sample)
 		}
 
-		percentiles := shdr.Percentiles(false)
+		percentiles := shdr.Percentiles(false, nil)
 
 		if !assert.NotNil(t, percentiles, "Snapshot.Snapshot should not be nil") {
 			return
@@ -306,7 +361,7 @@ func Test_Histogram_Percentiles(t *testing.T) {
 		}
 
 		perc := make(PercentilesChannel)
-		shdr.RequestPercentiles(perc, false)
+		shdr.RequestPercentiles(perc, false, nil)
 		percentiles := <-perc
 
 		if !assert.NotNil(t, percentiles, "Snapshot.Snapshot should not be nil") {
@@ -372,3 +427,371 @@ func Test_Histogram_Reset(t *testing.T) {
 		}
 	})
 }
+
+func Test_Histogram_PercentilesOptions(t *testing.T) {
+	t.Run("Explicit Percentiles Histogram", func(t *testing.T) {
+		t.Parallel()
+
+		shdr := NewHistogram(1, 30000000, 3)
+
+		// these are the values take from the hdr example
+		input := []int64{
+			459876, 669187, 711612, 816326, 931423, 1033197, 1131895, 2477317,
+			3964974, 12718782,
+		}
+
+		for _, sample := range input {
+			shdr.Record(sample)
+		}
+
+		percentiles := shdr.Percentiles(false, &PercentilesOptions{
+			Percentiles:   []float64{99, 50},
+			IncludeMean:   true,
+			IncludeStdDev: true,
+			IncludeSum:    true,
+		})
+
+		if !assert.Len(t, percentiles.Percentiles, 2, "Percentiles should only contain the requested percentiles") {
+			return
+		}
+		if !assert.Equal(t, 0.5, percentiles.Percentiles[0].Percentile, "Percentiles should be ordered lowest to highest") {
+			return
+		}
+		// this value is from the hdr example that has the same config as used above
+		if !assert.Equal(t, int64(931839), percentiles.Percentiles[0].Value, "value for percentile 50.0 is incorrect") {
+			return
+		}
+		if !assert.Equal(t, int64(5), percentiles.Percentiles[0].Count, "count for percentile 50.0 is incorrect") {
+			return
+		}
+		if !assert.Equal(t, int64(10), percentiles.Percentiles[1].Count, "count for percentile 99.0 is incorrect") {
+			return
+		}
+		if !assert.NotNil(t, percentiles.Mean, "Percentiles Mean should be included") {
+			return
+		}
+		if !assert.NotNil(t, percentiles.StdDev, "Percentiles StdDev should be included") {
+			return
+		}
+		if !assert.NotNil(t, percentiles.Sum, "Percentiles Sum should be included") {
+			return
+		}
+		if !assert.InDelta(t, *percentiles.Mean*float64(len(input)), float64(*percentiles.Sum), 1, "Percentiles Sum should agree with Mean") {
+			return
+		}
+
+		shdr.Close()
+	})
+
+	t.Run("Ticks Percentiles Histogram", func(t *testing.T) {
+		t.Parallel()
+
+		shdr := NewHistogram(1, 30000000, 3)
+		recordSequence(shdr, 1000)
+
+		coarse := shdr.Percentiles(false, nil)
+		fine := shdr.Percentiles(false, &PercentilesOptions{TicksPerHalfDistance: 5})
+
+		if !assert.Equal(t, int64(1000), coarse.TotalCount, "no values should be dropped") {
+			return
+		}
+		if !assert.Greater(t, len(fine.Percentiles), len(coarse.Percentiles), "more ticks should produce more percentiles") {
+			return
+		}
+		if !assert.Nil(t, coarse.Mean, "Percentiles Mean should not be included by default") {
+			return
+		}
+
+		shdr.Close()
+	})
+}
+
+// recordSequence records the values from 1 to n, waiting for each batch of
+// values to be processed so that none are dropped by a full command buffer
+func recordSequence(shdr *Histogram, n int64) {
+	for i := int64(1); i <= n; i++ {
+		shdr.Record(i)
+
+		if i%100 == 0 {
+			shdr.Snapshot(false)
+		}
+	}
+}
+
+func Test_Percentiles_WriteHgrm(t *testing.T) {
+	t.Run("Hgrm Percentiles", func(t *testing.T) {
+		t.Parallel()
+
+		shdr := NewHistogram(1, 30000000, 3)
+		recordSequence(shdr, 1000)
+
+		percentiles := shdr.Percentiles(false, &PercentilesOptions{
+			TicksPerHalfDistance: 5,
+			IncludeMean:          true,
+			IncludeStdDev:        true,
+		})
+		shdr.Close()
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, percentiles.WriteHgrm(&buf, 1000), "WriteHgrm should not fail") {
+			return
+		}
+
+		lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+		if !assert.Equal(t, "       Value     Percentile TotalCount 1/(1-Percentile)", lines[0], "unexpected hgrm header") {
+			return
+		}
+		if !assert.Equal(t, "       0.001 0.000000000000          1           1.00", lines[2], "unexpected first hgrm row") {
+			return
+		}
+		if !assert.Equal(t, "       1.000 1.000000000000       1000", lines[len(lines)-4], "unexpected last hgrm row") {
+			return
+		}
+		if !assert.Equal(t, "#[Mean    =        0.500, StdDeviation   =        0.289]", lines[len(lines)-3], "unexpected hgrm mean footer") {
+			return
+		}
+		if !assert.Equal(t, "#[Max     =        1.000, Total count    =         1000]", lines[len(lines)-2], "unexpected hgrm max footer") {
+			return
+		}
+		if !assert.Equal(t, "#[Buckets =           15, SubBuckets     =         2048]", lines[len(lines)-1], "unexpected hgrm buckets footer") {
+			return
+		}
+	})
+}
+
+func Test_Histogram_Context(t *testing.T) {
+	t.Run("Context Histogram", func(t *testing.T) {
+		t.Parallel()
+
+		shdr := NewHistogram(1, 30000000, 3)
+		shdr.Record(100)
+
+		snapshot, err := shdr.SnapshotContext(context.Background(), false)
+		if !assert.NoError(t, err, "SnapshotContext should not fail") {
+			return
+		}
+		if !assert.Equal(t, int64(1), snapshot.ToHistogram().TotalCount(), "Snapshot should have one value") {
+			return
+		}
+
+		// stall the command processor with a snapshot that nobody reads
+		stalled := make(SnapshotChannel)
+		shdr.RequestSnapshot(stalled, false)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		if _, err := shdr.SnapshotContext(ctx, false); !assert.Equal(t, context.DeadlineExceeded, err, "SnapshotContext should honor the deadline") {
+			return
+		}
+		if _, err := shdr.PercentilesContext(ctx, false, nil); !assert.Equal(t, context.DeadlineExceeded, err, "PercentilesContext should honor the deadline") {
+			return
+		}
+		// the reset is queued (the buffer has room) before its deadline
+		// passes, so it is processed even though the caller gives up waiting
+		resetCtx, resetCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer resetCancel()
+
+		if err := shdr.ResetContext(resetCtx); !assert.Equal(t, context.DeadlineExceeded, err, "ResetContext should honor the deadline") {
+			return
+		}
+
+		// unstall the processor. The abandoned requests must not block it
+		<-stalled
+
+		hist := shdr.Close()
+		if !assert.Equal(t, int64(0), hist.TotalCount(), "the queued reset should still be processed") {
+			return
+		}
+	})
+
+	t.Run("Context HistogramMap", func(t *testing.T) {
+		t.Parallel()
+
+		hists := NewHistogramMap(1, 30000000, 3)
+		hists.Record(100, "a", "b")
+
+		// stall the command processor with a snapshot that nobody reads
+		stalled := make(SnapshotChannel)
+		hists.RequestSnapshot(stalled, false, "a")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		if _, err := hists.SnapshotContext(ctx, "a", false); !assert.Equal(t, context.DeadlineExceeded, err, "SnapshotContext should honor the deadline") {
+			return
+		}
+		if err := hists.ResetAllContext(ctx); !assert.Equal(t, context.DeadlineExceeded, err, "ResetAllContext should honor the deadline") {
+			return
+		}
+
+		<-stalled
+
+		snap := make(SnapshotChannel, 2)
+		if !assert.NoError(t, hists.SnapshotAllContext(context.Background(), snap, false), "SnapshotAllContext should not fail") {
+			return
+		}
+		if !assert.Len(t, snap, 2, "SnapshotAllContext should snapshot every histogram") {
+			return
+		}
+
+		hists.Close()
+	})
+	t.Run("Done Context", func(t *testing.T) {
+		t.Parallel()
+
+		shdr := NewHistogram(1, 30000000, 3)
+		shdr.Record(100)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		// a command is never queued with a ctx that is already done, even
+		// though the command buffer has room
+		for i := 0; i < 100; i++ {
+			if err := shdr.ResetContext(ctx); !assert.Equal(t, context.Canceled, err, "ResetContext should honor the cancellation") {
+				return
+			}
+		}
+
+		hist := shdr.Close()
+		if !assert.Equal(t, int64(1), hist.TotalCount(), "the reset should not be performed") {
+			return
+		}
+	})
+}
+
+func Test_Histogram_Shutdown(t *testing.T) {
+	t.Run("Shutdown Histogram", func(t *testing.T) {
+		t.Parallel()
+
+		shdr := NewHistogram(1, 30000000, 3)
+		shdr.Record(100)
+		shdr.Record(200)
+
+		final, abandoned, err := shdr.Shutdown(context.Background())
+		if !assert.NoError(t, err, "Shutdown should not fail") {
+			return
+		}
+		if !assert.Equal(t, 0, abandoned, "No commands should be abandoned") {
+			return
+		}
+		if !assert.Equal(t, int64(2), final.ToHistogram().TotalCount(), "Final snapshot should have two values") {
+			return
+		}
+		if !assert.NotZero(t, final.EndTime, "Final snapshot should have an end time") {
+			return
+		}
+
+		// the histogram is closed
+		shdr.Record(300)
+		if !assert.Nil(t, shdr.Snapshot(false), "Snapshot() after Shutdown should be nil") {
+			return
+		}
+
+		final, _, err = shdr.Shutdown(context.Background())
+		if !assert.NoError(t, err, "Shutdown should be safe to call twice") {
+			return
+		}
+		if !assert.Equal(t, int64(2), final.ToHistogram().TotalCount(), "Final snapshot should not change") {
+			return
+		}
+	})
+
+	t.Run("Shutdown Histogram Deadline", func(t *testing.T) {
+		t.Parallel()
+
+		shdr := NewHistogramFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          30000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              1024,
+		})
+
+		// stall the command processor with a snapshot that is never read
+		stalled := make(SnapshotChannel)
+		shdr.RequestSnapshot(stalled, false)
+
+		for i := 0; i < 10; i++ {
+			shdr.Record(100)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		final, abandoned, err := shdr.Shutdown(ctx)
+		if !assert.Equal(t, context.Canceled, err, "Shutdown should honor the context") {
+			return
+		}
+		if !assert.GreaterOrEqual(t, abandoned, 10, "The queued records should be abandoned") {
+			return
+		}
+		if !assert.Equal(t, int64(0), final.ToHistogram().TotalCount(), "Abandoned records should not be recorded") {
+			return
+		}
+		if !assert.Equal(t, ErrClosed, shdr.Reset(), "Reset() after Shutdown should return ErrClosed") {
+			return
+		}
+	})
+
+	t.Run("Shutdown HistogramMap", func(t *testing.T) {
+		t.Parallel()
+
+		hists := NewHistogramMap(1, 30000000, 3)
+		hists.Record(100, "a", "b")
+		hists.Record(200, "b")
+
+		final, abandoned, err := hists.Shutdown(context.Background())
+		if !assert.NoError(t, err, "Shutdown should not fail") {
+			return
+		}
+		if !assert.Equal(t, 0, abandoned, "No commands should be abandoned") {
+			return
+		}
+		if !assert.Len(t, final, 2, "There should be a final snapshot per name") {
+			return
+		}
+		if !assert.Equal(t, int64(1), final["a"].ToHistogram().TotalCount(), "a should have one value") {
+			return
+		}
+		if !assert.Equal(t, int64(2), final["b"].ToHistogram().TotalCount(), "b should have two values") {
+			return
+		}
+		if !assert.Equal(t, "b", final["b"].Tag, "Final snapshot should be tagged with its name") {
+			return
+		}
+
+		hists.Record(300, "c")
+		if !assert.Len(t, hists.Close(), 2, "No histograms should be created after Shutdown") {
+			return
+		}
+	})
+
+	t.Run("Shutdown HistogramMap Deadline", func(t *testing.T) {
+		t.Parallel()
+
+		hists := NewHistogramMap(1, 30000000, 3)
+
+		// stall the command processor with a snapshot that is never read
+		stalled := make(SnapshotChannel)
+		if !assert.NoError(t, hists.RequestSnapshot(stalled, false, "a"), "RequestSnapshot should not fail") {
+			return
+		}
+
+		hists.Record(100, "a")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		final, _, err := hists.Shutdown(ctx)
+		if !assert.Equal(t, context.Canceled, err, "Shutdown should honor the context") {
+			return
+		}
+		if !assert.Equal(t, int64(0), final["a"].ToHistogram().TotalCount(), "Abandoned records should not be recorded") {
+			return
+		}
+		if !assert.Equal(t, []string{"a"}, hists.Names(), "Shutdown should release the lock") {
+			return
+		}
+	})
+}
@@ -0,0 +1,298 @@
+package safehdrhistogram
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultMaxPacketSize is the default size limit (in bytes) of the packets
+// received by a Listener, which fits in a single ethernet frame
+const DefaultMaxPacketSize = 1432
+
+// ListenerConfig represents the values used to construct a Listener and is
+// designed for use in yaml or JSON configuration files
+type ListenerConfig struct {
+	// Network is "udp", "udp4", "udp6", or "unixgram". If empty, "udp" is
+	// used
+	Network string `yaml:"network" json:"network"`
+	// Address is the address to listen on, such as ":8125", or the path of
+	// a unix socket
+	Address string `yaml:"address" json:"address"`
+	// MaxPacketSize is the size limit (in bytes) of a packet, where larger
+	// packets are dropped. If 0, DefaultMaxPacketSize is used
+	MaxPacketSize int `yaml:"maxPacketSize" json:"maxPacketSize"`
+}
+
+// ListenerStats reports the runtime statistics of a Listener
+type ListenerStats struct {
+	// Packets is the number of packets received
+	Packets int64 `json:"packets"`
+	// Values is the number of lines (values) recorded
+	Values int64 `json:"values"`
+	// Dropped is the number of lines that were parsed but not recorded,
+	// because the command buffer was full (or the histogram couldn't be
+	// created, see HistogramConfig.MemoryBudget)
+	Dropped int64 `json:"dropped"`
+	// Malformed is the number of lines that couldn't be parsed
+	Malformed int64 `json:"malformed"`
+	// Oversized is the number of packets dropped because they were larger
+	// than MaxPacketSize
+	Oversized int64 `json:"oversized"`
+}
+
+// errMalformedLine is returned by parseLine for a line that can't be parsed
+var errMalformedLine = errors.New("safehdrhistogram: malformed line")
+
+// Listener receives values from other processes as datagrams, and records
+// them to a HistogramMap (see HistogramMap.Listen)
+//
+//	Notes
+//		Each packet contains one or more lines (separated by newlines) of
+//		the form:
+//			name:value[|type][|count][|@rate][|#tags]
+//
+//		which is compatible with StatsD timings (e.g. "db.query:320|ms").
+//		The type, if present, must be ms, h, or d. A count records the value
+//		count times, and a sample rate records the value 1/rate times. Tags
+//		are ignored. Values that aren't integers are rounded, and negative
+//		values are malformed
+//
+//		A malformed line is counted and skipped (see ListenerStats), and the
+//		other lines of the packet are recorded
+//
+type Listener struct {
+	// counters are accessed atomically (and are first in the struct for
+	// 64-bit alignment)
+	packets   int64
+	values    int64
+	dropped   int64
+	malformed int64
+	oversized int64
+
+	conn          net.PacketConn
+	hists         *HistogramMap
+	network       string
+	maxPacketSize int
+
+	closeOnce sync.Once
+	closeErr  error
+	done      chan struct{}
+}
+
+// Listen starts a Listener that records the values it receives to the
+// histograms of the HistogramMap, until the Listener or the HistogramMap is
+// closed (see Listener)
+func (hdr *HistogramMap) Listen(config ListenerConfig) (*Listener, error) {
+	if config.Network == "" {
+		config.Network = "udp"
+	}
+	if config.MaxPacketSize <= 0 {
+		config.MaxPacketSize = DefaultMaxPacketSize
+	}
+
+	conn, err := net.ListenPacket(config.Network, config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		conn:          conn,
+		hists:         hdr,
+		network:       config.Network,
+		maxPacketSize: config.MaxPacketSize,
+		done:          make(chan struct{}),
+	}
+
+	go l.receive()
+
+	// stop listening when the HistogramMap is closed
+	go func() {
+		select {
+		case <-hdr.cmds.quit:
+			_ = l.Close()
+		case <-l.done:
+		}
+	}()
+
+	return l, nil
+}
+
+// receive receives packets until the connection is closed
+func (l *Listener) receive() {
+	defer close(l.done)
+
+	// an extra byte detects packets that are larger than the limit
+	buf := make([]byte, l.maxPacketSize+1)
+
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				continue
+			}
+
+			// the connection is closed
+			return
+		}
+
+		if n > l.maxPacketSize {
+			atomic.AddInt64(&l.oversized, 1)
+		} else {
+			l.record(buf[:n])
+		}
+
+		// count the packet once its lines are counted, so the stats of a
+		// packet are consistent once it is counted
+		atomic.AddInt64(&l.packets, 1)
+	}
+}
+
+// record records the values of a packet
+func (l *Listener) record(packet []byte) {
+	for len(packet) > 0 {
+		line := packet
+		if i := bytes.IndexByte(packet, '\n'); i >= 0 {
+			line, packet = packet[:i], packet[i+1:]
+		} else {
+			packet = nil
+		}
+
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if len(line) == 0 {
+			continue
+		}
+
+		name, value, count, err := parseLine(line)
+		if err != nil {
+			atomic.AddInt64(&l.malformed, 1)
+			continue
+		}
+
+		if l.hists.recordValues(value, count, []string{name}) > 0 {
+			atomic.AddInt64(&l.values, 1)
+		} else {
+			atomic.AddInt64(&l.dropped, 1)
+		}
+	}
+}
+
+// parseLine parses a line of the form name:value[|type][|count][|@rate][|#tags]
+// (see Listener)
+func parseLine(line []byte) (name string, value, count int64, err error) {
+	colon := bytes.LastIndexByte(line, ':')
+	if pipe := bytes.IndexByte(line, '|'); pipe >= 0 {
+		colon = bytes.LastIndexByte(line[:pipe], ':')
+	}
+	if colon < 1 {
+		return "", 0, 0, errMalformedLine
+	}
+
+	fields := bytes.Split(line[colon+1:], []byte{'|'})
+
+	value, err = parseValue(fields[0])
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	count = 1
+	rate := 1.0
+
+	for i, field := range fields[1:] {
+		switch {
+		case len(field) == 0:
+			return "", 0, 0, errMalformedLine
+		case field[0] == '@':
+			rate, err = strconv.ParseFloat(string(field[1:]), 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return "", 0, 0, errMalformedLine
+			}
+		case field[0] == '#':
+			// tags are ignored
+		case field[0] >= '0' && field[0] <= '9':
+			count, err = strconv.ParseInt(string(field), 10, 64)
+			if err != nil || count < 1 {
+				return "", 0, 0, errMalformedLine
+			}
+		case i == 0:
+			// the type must be a timing (or histogram, or distribution)
+			if typ := string(field); typ != "ms" && typ != "h" && typ != "d" {
+				return "", 0, 0, errMalformedLine
+			}
+		default:
+			return "", 0, 0, errMalformedLine
+		}
+	}
+
+	if rate < 1 {
+		sampled := math.Round(float64(count) / rate)
+		if sampled >= math.MaxInt64 {
+			return "", 0, 0, errMalformedLine
+		}
+
+		count = int64(sampled)
+	}
+
+	return string(line[:colon]), value, count, nil
+}
+
+// parseValue parses an integer value, or rounds a decimal value
+func parseValue(field []byte) (int64, error) {
+	value, err := strconv.ParseInt(string(field), 10, 64)
+	if err != nil {
+		decimal, err := strconv.ParseFloat(string(field), 64)
+		if err != nil || math.IsNaN(decimal) || decimal >= math.MaxInt64 {
+			return 0, errMalformedLine
+		}
+
+		value = int64(math.Round(decimal))
+	}
+
+	if value < 0 {
+		return 0, errMalformedLine
+	}
+
+	return value, nil
+}
+
+// Addr returns the address the Listener is listening on
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Stats returns the runtime statistics of the Listener
+func (l *Listener) Stats() *ListenerStats {
+	return &ListenerStats{
+		Packets:   atomic.LoadInt64(&l.packets),
+		Values:    atomic.LoadInt64(&l.values),
+		Dropped:   atomic.LoadInt64(&l.dropped),
+		Malformed: atomic.LoadInt64(&l.malformed),
+		Oversized: atomic.LoadInt64(&l.oversized),
+	}
+}
+
+// Close stops listening, and waits until the packets being received have
+// been recorded
+//
+//	Notes
+//		Close removes the socket of a unixgram Listener. Close is safe to
+//		call more than once
+//
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		l.closeErr = l.conn.Close()
+		<-l.done
+
+		if l.network == "unixgram" {
+			_ = os.Remove(l.conn.LocalAddr().String())
+		}
+	})
+
+	return l.closeErr
+}
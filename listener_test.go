@@ -0,0 +1,203 @@
+package safehdrhistogram
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Listener(t *testing.T) {
+	t.Run("Parse Line", func(t *testing.T) {
+		t.Parallel()
+
+		valid := map[string][3]interface{}{
+			"latency:42":                {"latency", int64(42), int64(1)},
+			"db.query:320|ms":           {"db.query", int64(320), int64(1)},
+			"db.query:12.6|h":           {"db.query", int64(13), int64(1)},
+			"get:5|10":                  {"get", int64(5), int64(10)},
+			"get:5|ms|@0.25":            {"get", int64(5), int64(4)},
+			"get:5|d|2|@0.5|#env:prod":  {"get", int64(5), int64(4)},
+			"host:8080:7|ms":            {"host:8080", int64(7), int64(1)},
+			"get:0|ms|#region:us-east1": {"get", int64(0), int64(1)},
+		}
+
+		for line, expected := range valid {
+			name, value, count, err := parseLine([]byte(line))
+			if !assert.NoError(t, err, "%q should be parsed", line) {
+				return
+			}
+			if !assert.Equal(t, expected, [3]interface{}{name, value, count}, "%q should be parsed", line) {
+				return
+			}
+		}
+
+		malformed := []string{
+			"latency",
+			":42",
+			"latency:",
+			"latency:-1",
+			"latency:abc",
+			"latency:NaN",
+			"latency:42|c",
+			"latency:42|ms|g",
+			"latency:42|0",
+			"latency:42|@0",
+			"latency:42|@2",
+			"latency:42||ms",
+		}
+
+		for _, line := range malformed {
+			if _, _, _, err := parseLine([]byte(line)); !assert.Equal(t, errMalformedLine, err, "%q should be malformed", line) {
+				return
+			}
+		}
+	})
+
+	t.Run("UDP", func(t *testing.T) {
+		t.Parallel()
+
+		hdrs := NewHistogramMapFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              1024,
+		})
+
+		listener, err := hdrs.Listen(ListenerConfig{Address: "127.0.0.1:0", MaxPacketSize: 64})
+		if !assert.NoError(t, err, "Listen should not fail") {
+			return
+		}
+
+		conn, err := net.Dial("udp", listener.Addr().String())
+		if !assert.NoError(t, err, "Dial should not fail") {
+			return
+		}
+		defer conn.Close()
+
+		packets := []string{
+			"get:100|ms\nget:200|ms|@0.5\r\n",
+			"put:7|3\nput:oops|ms\n\n",
+			"get:300|ms|" + strings.Repeat("#tag", 16),
+		}
+		for _, packet := range packets {
+			if _, err = conn.Write([]byte(packet)); !assert.NoError(t, err, "Write should not fail") {
+				return
+			}
+		}
+
+		if !assert.Eventually(t, func() bool { return listener.Stats().Packets == 3 }, time.Second, time.Millisecond, "every packet should be received") {
+			return
+		}
+
+		stats := listener.Stats()
+		if !assert.Equal(t, ListenerStats{Packets: 3, Values: 3, Malformed: 1, Oversized: 1}, *stats, "unexpected stats") {
+			return
+		}
+
+		if !assert.Equal(t, int64(3), hdrs.Snapshot("get", false).ToHistogram().TotalCount(), "the sampled value should be recorded twice") {
+			return
+		}
+		if !assert.Equal(t, int64(3), hdrs.Snapshot("put", false).ToHistogram().TotalCount(), "the value should be recorded count times") {
+			return
+		}
+
+		// closing the HistogramMap closes the Listener
+		hdrs.Close()
+		if !assert.Eventually(t, func() bool {
+			select {
+			case <-listener.done:
+				return true
+			default:
+				return false
+			}
+		}, time.Second, time.Millisecond, "the Listener should be closed") {
+			return
+		}
+		if !assert.NoError(t, listener.Close(), "Close should be safe to call more than once") {
+			return
+		}
+	})
+
+	t.Run("Dropped", func(t *testing.T) {
+		t.Parallel()
+
+		// the budget is too small for any histogram, so no values are queued
+		hdrs := NewHistogramMapFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			MemoryBudget:                   1,
+		})
+		defer hdrs.Close()
+
+		listener, err := hdrs.Listen(ListenerConfig{Address: "127.0.0.1:0"})
+		if !assert.NoError(t, err, "Listen should not fail") {
+			return
+		}
+		defer listener.Close()
+
+		conn, err := net.Dial("udp", listener.Addr().String())
+		if !assert.NoError(t, err, "Dial should not fail") {
+			return
+		}
+		defer conn.Close()
+
+		if _, err = conn.Write([]byte("get:100|ms\nput:200|ms")); !assert.NoError(t, err, "Write should not fail") {
+			return
+		}
+
+		if !assert.Eventually(t, func() bool { return listener.Stats().Packets == 1 }, time.Second, time.Millisecond, "the packet should be received") {
+			return
+		}
+		if !assert.Equal(t, ListenerStats{Packets: 1, Dropped: 2}, *listener.Stats(), "the lines should be dropped rather than counted as values") {
+			return
+		}
+	})
+
+	t.Run("Unixgram", func(t *testing.T) {
+		t.Parallel()
+
+		hdrs := NewHistogramMap(1, 1000000, 3)
+		defer hdrs.Close()
+
+		path := filepath.Join(t.TempDir(), "hdr.sock")
+		listener, err := hdrs.Listen(ListenerConfig{Network: "unixgram", Address: path})
+		if !assert.NoError(t, err, "Listen should not fail") {
+			return
+		}
+
+		conn, err := net.Dial("unixgram", path)
+		if !assert.NoError(t, err, "Dial should not fail") {
+			return
+		}
+		defer conn.Close()
+
+		if _, err = conn.Write([]byte("latency:42")); !assert.NoError(t, err, "Write should not fail") {
+			return
+		}
+
+		if !assert.Eventually(t, func() bool { return listener.Stats().Values == 1 }, time.Second, time.Millisecond, "the value should be received") {
+			return
+		}
+		if !assert.Equal(t, int64(42), hdrs.Snapshot("latency", false).ToHistogram().Max(), "the value should be recorded") {
+			return
+		}
+
+		if !assert.NoError(t, listener.Close(), "Close should not fail") {
+			return
+		}
+
+		// the socket is removed, so the path can be reused
+		listener, err = hdrs.Listen(ListenerConfig{Network: "unixgram", Address: path})
+		if !assert.NoError(t, err, "the socket should be removed") {
+			return
+		}
+
+		listener.Close()
+	})
+}
@@ -0,0 +1,235 @@
+package safehdrhistogram
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// MemoryPolicy determines what a HistogramMap does when creating a histogram
+// would exceed its memory budget (see HistogramConfig.MemoryBudget)
+type MemoryPolicy string
+
+const (
+	// MemoryPolicyRefuse refuses to create the histogram, so values recorded
+	// to it are dropped and other operations return ErrMemoryBudget. This is
+	// the default policy
+	MemoryPolicyRefuse MemoryPolicy = "refuse"
+	// MemoryPolicyEvictIdle evicts the least recently used (idle) histograms
+	// until the new histogram fits
+	MemoryPolicyEvictIdle MemoryPolicy = "evictIdle"
+	// MemoryPolicyDowngrade creates the histogram with fewer significant
+	// value digits (down to 1) until it fits
+	MemoryPolicyDowngrade MemoryPolicy = "downgrade"
+)
+
+// ErrMemoryBudget is returned when a histogram can't be created because it
+// would exceed the memory budget of a HistogramMap
+var ErrMemoryBudget = errors.New("safehdrhistogram: memory budget exceeded")
+
+// byteSize returns the estimated size of the histogram the command targets
+func (cmd command) byteSize() int64 {
+	if cmd.sparse != nil {
+		return int64(cmd.sparse.ByteSize())
+	}
+
+	return int64(cmd.hist.ByteSize())
+}
+
+// denseByteSize returns the ByteSize of a (dense) hdrhistogram.Histogram,
+// without creating it
+func denseByteSize(lowestDiscernibleValue, highestTrackableValue int64, numberOfSignificantValueDigits int) int64 {
+	layout := newSparseHistogram(lowestDiscernibleValue, highestTrackableValue, numberOfSignificantValueDigits)
+
+	// see hdrhistogram.Histogram.ByteSize
+	return 6*8 + 5*4 + layout.countsLen*8
+}
+
+// create creates and initializes a histogram for name, applying the memory
+// budget and policy of the configuration
+//
+//	Notes
+//		The lock must be held by the caller
+//
+//		The budget is only checked here, using the current size of every
+//		histogram, so histograms that have grown since they were created
+//		(see HistogramConfig.MemoryBudget) can exceed it
+//
+func (hdr *HistogramMap) create(name string) error {
+	digits := hdr.config.NumberOfSignificantValueDigits
+	downgraded := false
+
+	for hdr.config.MemoryBudget > 0 {
+		var size int64
+		if hdr.config.Sparse {
+			size = sparseHistogramBytes
+		} else {
+			size = denseByteSize(
+				hdr.config.LowestDiscernibleValue,
+				hdr.config.HighestTrackableValue,
+				digits)
+		}
+
+		if hdr.usage()+size <= hdr.config.MemoryBudget {
+			break
+		}
+
+		ok := false
+		switch hdr.config.MemoryPolicy {
+		case MemoryPolicyEvictIdle:
+			ok = hdr.evictIdle()
+		case MemoryPolicyDowngrade:
+			if ok = !hdr.config.Sparse && digits > 1; ok {
+				digits--
+				downgraded = true
+			}
+		}
+
+		if !ok {
+			atomic.AddInt64(&hdr.refused, 1)
+			return ErrMemoryBudget
+		}
+	}
+
+	if downgraded {
+		atomic.AddInt64(&hdr.downgraded, 1)
+	}
+
+	// initialize the histogram. The command processor can't reference the
+	// histogram until a command for it is queued, so it is safe to do this
+	// here rather than issue a start command (which could block if the
+	// command buffer is full)
+	now := nowMs(hdr.config.clock())
+	var size int64
+
+	if hdr.config.Sparse {
+		hist := newSparseHistogram(
+			hdr.config.LowestDiscernibleValue,
+			hdr.config.HighestTrackableValue,
+			digits)
+
+		hist.tag = name
+		hist.startTimeMs = now
+		size = int64(hist.ByteSize())
+
+		hdr.sparse[name] = hist
+	} else {
+		hist := hdrhistogram.New(
+			hdr.config.LowestDiscernibleValue,
+			hdr.config.HighestTrackableValue,
+			digits)
+
+		hist.SetTag(name)
+		hist.SetStartTimeMs(now)
+		size = int64(hist.ByteSize())
+
+		hdr.hists[name] = hist
+	}
+
+	// remember it
+	hdr.sizes[name] = &size
+	hdr.lastUsed[name] = now
+	hdr.histNames = append(hdr.histNames, name)
+
+	return nil
+}
+
+// usage returns the estimated size of every histogram
+//
+//	Notes
+//		The lock must be held by the caller
+//
+func (hdr *HistogramMap) usage() (total int64) {
+	for _, size := range hdr.sizes {
+		total += atomic.LoadInt64(size)
+	}
+
+	return total
+}
+
+// evictIdle evicts the least recently used histogram, and returns false if
+// there are no histograms to evict
+//
+//	Notes
+//		Commands already queued for the evicted histogram are still processed,
+//		but the histogram is no longer referenced by the HistogramMap
+//
+//		The lock must be held by the caller
+//
+func (hdr *HistogramMap) evictIdle() bool {
+	if len(hdr.histNames) == 0 {
+		return false
+	}
+
+	idle := 0
+	for i, name := range hdr.histNames {
+		if hdr.lastUsed[name] < hdr.lastUsed[hdr.histNames[idle]] {
+			idle = i
+		}
+	}
+
+	name := hdr.histNames[idle]
+
+	// log the eviction, so replay evicts the histogram too
+	if hdr.config.AppendLog != nil {
+		target, _ := hdr.target(name).target()
+		hdr.config.AppendLog.evict(target, nowMs(hdr.config.clock()))
+	}
+
+	hdr.remove(name)
+	atomic.AddInt64(&hdr.evicted, 1)
+
+	return true
+}
+
+// remove removes the histogram for name (if any) from the map
+//
+//	Notes
+//		The lock must be held by the caller
+//
+func (hdr *HistogramMap) remove(name string) {
+	delete(hdr.hists, name)
+	delete(hdr.sparse, name)
+	delete(hdr.sizes, name)
+	delete(hdr.lastUsed, name)
+
+	for i, histName := range hdr.histNames {
+		if histName == name {
+			hdr.histNames = append(hdr.histNames[:i], hdr.histNames[i+1:]...)
+			break
+		}
+	}
+}
+
+// ByteSize returns the estimated memory used by the histograms, in bytes
+//
+//	Notes
+//		Sizes are updated as commands are processed, so the estimate does not
+//		include growth (see HistogramConfig.AutoResize and
+//		HistogramConfig.Sparse) from commands that are still queued
+//
+func (hdr *HistogramMap) ByteSize() int64 {
+	hdr.lock.Lock()
+	defer hdr.lock.Unlock()
+
+	return hdr.usage()
+}
+
+// ByteSizes returns the estimated memory used by each histogram, in bytes,
+// by name
+//
+//	Notes
+//		See ByteSize
+//
+func (hdr *HistogramMap) ByteSizes() map[string]int64 {
+	hdr.lock.Lock()
+	defer hdr.lock.Unlock()
+
+	sizes := make(map[string]int64, len(hdr.sizes))
+	for name, size := range hdr.sizes {
+		sizes[name] = atomic.LoadInt64(size)
+	}
+
+	return sizes
+}
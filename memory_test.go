@@ -0,0 +1,251 @@
+package safehdrhistogram
+
+import (
+	"context"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Memory(t *testing.T) {
+	t.Run("ByteSize", func(t *testing.T) {
+		t.Parallel()
+
+		hdrs := NewHistogramMap(1, 1000000, 3)
+		hdrs.Record(1, "a", "b")
+
+		size := int64(hdrhistogram.New(1, 1000000, 3).ByteSize())
+		if !assert.Equal(t, size, denseByteSize(1, 1000000, 3), "The estimate should match the dense histogram") {
+			return
+		}
+		if !assert.Equal(t, map[string]int64{"a": size, "b": size}, hdrs.ByteSizes(), "Each histogram should be reported") {
+			return
+		}
+		if !assert.Equal(t, 2*size, hdrs.ByteSize(), "The total should be the sum of the histograms") {
+			return
+		}
+
+		hdrs.Close()
+	})
+
+	t.Run("Sparse ByteSize", func(t *testing.T) {
+		t.Parallel()
+
+		hdrs := NewHistogramMapFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			Sparse:                         true,
+		})
+
+		for value := int64(1); value <= 100; value++ {
+			hdrs.Record(value, "a")
+		}
+
+		// wait for the values to be recorded
+		hdrs.Snapshot("a", false)
+
+		if !assert.Equal(t, int64(sparseHistogramBytes+100*sparseBucketBytes), hdrs.ByteSize(), "The size should grow with the occupied buckets") {
+			return
+		}
+
+		if !assert.NoError(t, hdrs.Reset("a"), "Reset should not fail") {
+			return
+		}
+		if !assert.Equal(t, int64(sparseHistogramBytes), hdrs.ByteSize(), "The size should shrink when reset") {
+			return
+		}
+
+		hdrs.Close()
+	})
+
+	t.Run("Sparse Budget", func(t *testing.T) {
+		t.Parallel()
+
+		hdrs := NewHistogramMapFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			Sparse:                         true,
+			MemoryBudget:                   2 * sparseHistogramBytes,
+		})
+		defer hdrs.Close()
+
+		for value := int64(1); value <= 100; value++ {
+			hdrs.Record(value, "a")
+		}
+
+		// the budget is only checked when a histogram is created, so a can
+		// grow past it
+		hdrs.Snapshot("a", false)
+		if !assert.Greater(t, hdrs.ByteSize(), int64(2*sparseHistogramBytes), "a should exceed the budget") {
+			return
+		}
+
+		// but its growth is counted when the next histogram is created
+		hdrs.Record(1, "b")
+		if !assert.Equal(t, []string{"a"}, hdrs.Names(), "b should be refused") {
+			return
+		}
+	})
+
+	t.Run("Sparse Snapshot Memory", func(t *testing.T) {
+		// not parallel, so other tests don't affect the heap
+
+		const names = 256
+		hdrs := NewHistogramMapFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          3600000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			Sparse:                         true,
+		})
+		defer hdrs.Close()
+
+		for i := 0; i < names; i++ {
+			hdrs.Record(int64(i+1), strconv.Itoa(i))
+		}
+
+		var stats runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		base, peak := stats.HeapAlloc, stats.HeapAlloc
+
+		// measure the live heap as the snapshots are consumed
+		count := 0
+		err := hdrs.eachSnapshot(context.Background(), nil, false, func(name string, snapshot *Snapshot) error {
+			if count++; count%8 == 0 {
+				runtime.GC()
+				runtime.ReadMemStats(&stats)
+				if stats.HeapAlloc > peak {
+					peak = stats.HeapAlloc
+				}
+			}
+			return nil
+		})
+		if !assert.NoError(t, err, "eachSnapshot should not fail") {
+			return
+		}
+		if !assert.Equal(t, names, count, "Every histogram should be snapshotted") {
+			return
+		}
+
+		// every dense snapshot at once would be names * dense
+		dense := denseByteSize(1, 3600000000, 3)
+		if !assert.Less(t, int64(peak-base), names*dense/4, "The dense snapshots should not all be held at once") {
+			return
+		}
+	})
+
+	t.Run("MemoryPolicyRefuse", func(t *testing.T) {
+		t.Parallel()
+
+		size := denseByteSize(1, 1000000, 3)
+		hdrs := NewHistogramMapFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			MemoryBudget:                   2*size + size/2,
+		})
+
+		hdrs.Record(1, "a", "b", "c")
+		hdrs.Record(2, "c", "a")
+
+		if !assert.Equal(t, []string{"a", "b"}, hdrs.Names(), "c should be refused") {
+			return
+		}
+		if !assert.Equal(t, int64(2), hdrs.Snapshot("a", false).ToHistogram().TotalCount(), "a should be recorded after c is refused") {
+			return
+		}
+
+		_, err := hdrs.SnapshotContext(context.Background(), "c", false)
+		if !assert.Equal(t, ErrMemoryBudget, err, "Snapshot of c should fail") {
+			return
+		}
+		if !assert.Equal(t, int64(3), hdrs.Stats().MemoryRefused, "Every refusal should be counted") {
+			return
+		}
+
+		hdrs.Close()
+	})
+
+	t.Run("MemoryPolicyEvictIdle", func(t *testing.T) {
+		t.Parallel()
+
+		clock := NewManualClock(time.Unix(1600000000, 0))
+		size := denseByteSize(1, 1000000, 3)
+		hdrs := NewHistogramMapFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			MemoryBudget:                   2 * size,
+			MemoryPolicy:                   MemoryPolicyEvictIdle,
+			Clock:                          clock,
+		})
+
+		hdrs.Record(1, "a")
+		clock.Advance(time.Second)
+		hdrs.Record(1, "b")
+		clock.Advance(time.Second)
+		hdrs.Record(1, "a")
+		clock.Advance(time.Second)
+
+		// b is the least recently used
+		hdrs.Record(1, "c")
+
+		if !assert.ElementsMatch(t, []string{"a", "c"}, hdrs.Names(), "b should be evicted") {
+			return
+		}
+		if !assert.Equal(t, int64(1), hdrs.Stats().MemoryEvicted, "The eviction should be counted") {
+			return
+		}
+		if !assert.Equal(t, 2*size, hdrs.ByteSize(), "The budget should not be exceeded") {
+			return
+		}
+
+		final := hdrs.Close()
+		if !assert.Equal(t, int64(2), final["a"].TotalCount(), "a should be kept") {
+			return
+		}
+	})
+
+	t.Run("MemoryPolicyDowngrade", func(t *testing.T) {
+		t.Parallel()
+
+		hdrs := NewHistogramMapFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			MemoryBudget:                   denseByteSize(1, 1000000, 3) + denseByteSize(1, 1000000, 2),
+			MemoryPolicy:                   MemoryPolicyDowngrade,
+		})
+
+		hdrs.Record(1, "a", "b", "c")
+
+		if !assert.Equal(t, []string{"a", "b"}, hdrs.Names(), "c should be refused") {
+			return
+		}
+		if !assert.Equal(t, int64(2), hdrs.Snapshot("b", false).Snapshot.SignificantFigures, "b should be downgraded") {
+			return
+		}
+
+		stats := hdrs.Stats()
+		if !assert.Equal(t, int64(1), stats.MemoryDowngraded, "The downgrade should be counted") {
+			return
+		}
+		if !assert.Equal(t, int64(1), stats.MemoryRefused, "The refusal should be counted") {
+			return
+		}
+
+		hdrs.Close()
+	})
+}
@@ -3,7 +3,8 @@ package safehdrhistogram
 import (
 	"fmt"
 	"io"
-	"time"
+	"sort"
+	"strconv"
 
 	"github.com/HdrHistogram/hdrhistogram-go"
 )
@@ -18,6 +19,37 @@ type Percentile struct {
 	Count      int64   `json:"count"`
 }
 
+// PercentilesOptions controls the percentiles and statistics that are included
+// in Percentiles
+//
+//	Notes
+//		A nil *PercentilesOptions is equivalent to DefaultPercentilesOptions
+//
+type PercentilesOptions struct {
+	// TicksPerHalfDistance is the number of percentile reporting ticks per
+	// half distance to 100%, and is ignored if Percentiles is not empty
+	TicksPerHalfDistance int32 `yaml:"ticksPerHalfDistance" json:"ticksPerHalfDistance"`
+	// Percentiles is an explicit list of percentiles to report, such as
+	// 50, 90, 99, 99.9, and 99.99
+	Percentiles []float64 `yaml:"percentiles" json:"percentiles"`
+	// IncludeMean includes the mean of the recorded values
+	IncludeMean bool `yaml:"includeMean" json:"includeMean"`
+	// IncludeStdDev includes the standard deviation of the recorded values
+	IncludeStdDev bool `yaml:"includeStdDev" json:"includeStdDev"`
+	// IncludeSum includes the (approximate) sum of the recorded values
+	IncludeSum bool `yaml:"includeSum" json:"includeSum"`
+}
+
+// DefaultPercentilesOptions are the options used when no options are
+// specified, and report percentiles using 1 tick per half distance
+var DefaultPercentilesOptions = PercentilesOptions{TicksPerHalfDistance: 1}
+
+// percentilesRequest is the argument of a cmdPercentiles command
+type percentilesRequest struct {
+	perc PercentilesChannel
+	opts *PercentilesOptions
+}
+
 // Percentiles represents a percentiles snapshot of a hdrhistogram.Histogram
 //
 //	Notes
@@ -31,9 +63,44 @@ type Percentiles struct {
 	StartTime   int64        `json:"startTime"`
 	EndTime     int64        `json:"endTime"`
 	Tag         string       `json:"tag"`
+	Unit        Unit         `json:"unit,omitempty"`
+	// ValueUnitScalingRatio is the ratio by which values are divided to
+	// convert them to Unit (see HistogramConfig)
+	ValueUnitScalingRatio float64  `json:"valueUnitScalingRatio,omitempty"`
+	Mean                  *float64 `json:"mean,omitempty"`
+	StdDev                *float64 `json:"stdDev,omitempty"`
+	Sum                   *int64   `json:"sum,omitempty"`
+	// Buckets and SubBuckets describe the layout of the histogram, and are
+	// reported in the footer of WriteHgrm
+	Buckets    int32 `json:"buckets,omitempty"`
+	SubBuckets int32 `json:"subBuckets,omitempty"`
+}
+
+// FormatValue formats a value for display, using the Unit and
+// ValueUnitScalingRatio of the Percentiles (e.g. 12.3ms or 4.1MiB)
+func (p *Percentiles) FormatValue(value int64) string {
+	return formatValue(value, p.Unit, p.ValueUnitScalingRatio)
+}
+
+// formatValue formats a recorded value for display, dividing it by ratio (if
+// ratio > 0) and formatting it using unit (see Percentiles.FormatValue)
+func formatValue(value int64, unit Unit, ratio float64) string {
+	if ratio <= 0 || ratio == 1 {
+		if unit == "" {
+			return strconv.FormatInt(value, 10)
+		}
+
+		return unit.Format(float64(value))
+	}
+
+	return unit.Format(float64(value) / ratio)
 }
 
 // Write produces reasonably well formatted output for Percentiles
+//
+//	Notes
+//		Values are formatted using FormatValue
+//
 func (p *Percentiles) Write(writer io.Writer) (err error) {
 	_, err = writer.Write([]byte(fmt.Sprintf("%12s %12s %12s\n", "Value", "Percentile", "TotalCount")))
 	if err != nil {
@@ -41,15 +108,15 @@ func (p *Percentiles) Write(writer io.Writer) (err error) {
 	}
 
 	for _, perc := range p.Percentiles {
-		_, err = writer.Write([]byte(fmt.Sprintf("%12d %12f %12d\n", perc.Value, perc.Percentile, perc.Count)))
+		_, err = writer.Write([]byte(fmt.Sprintf("%12s %12f %12d\n", p.FormatValue(perc.Value), perc.Percentile, perc.Count)))
 		if err != nil {
 			return
 		}
 	}
 
-	footer := fmt.Sprintf("  [Min = %d, Max = %d, Total count = %d]\n",
-		p.MinValue,
-		p.MaxValue,
+	footer := fmt.Sprintf("  [Min = %s, Max = %s, Total count = %d]\n",
+		p.FormatValue(p.MinValue),
+		p.FormatValue(p.MaxValue),
 		p.TotalCount,
 	)
 	_, err = writer.Write([]byte(footer))
@@ -57,27 +124,194 @@ func (p *Percentiles) Write(writer io.Writer) (err error) {
 	return
 }
 
+// WriteHgrm produces the HdrHistogram percentile distribution (.hgrm) output
+// for Percentiles, which can be read by the HdrHistogram plotting tools
+//
+//	Notes
+//		Values are divided by valueScale (the value unit scaling ratio). If
+//		valueScale <= 0, the ValueUnitScalingRatio of the Percentiles is used
+//
+//		The footer reports a Mean and StdDeviation of 0 unless the
+//		Percentiles were created with IncludeMean and IncludeStdDev. The
+//		Buckets line is omitted if the bucket layout is unknown (such as
+//		Percentiles decoded from JSON without it)
+//
+func (p *Percentiles) WriteHgrm(writer io.Writer, valueScale float64) (err error) {
+	if valueScale <= 0 {
+		valueScale = p.ValueUnitScalingRatio
+	}
+	if valueScale <= 0 {
+		valueScale = 1
+	}
+
+	_, err = fmt.Fprintf(writer, "%12s %14s %10s %14s\n\n", "Value", "Percentile", "TotalCount", "1/(1-Percentile)")
+	if err != nil {
+		return
+	}
+
+	for _, perc := range p.Percentiles {
+		if perc.Percentile < 1.0 {
+			_, err = fmt.Fprintf(writer, "%12.3f %2.12f %10d %14.2f\n",
+				float64(perc.Value)/valueScale,
+				perc.Percentile,
+				perc.Count,
+				1.0/(1.0-perc.Percentile))
+		} else {
+			_, err = fmt.Fprintf(writer, "%12.3f %2.12f %10d\n",
+				float64(perc.Value)/valueScale,
+				perc.Percentile,
+				perc.Count)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	var mean, stdDev float64
+	if p.Mean != nil {
+		mean = *p.Mean
+	}
+	if p.StdDev != nil {
+		stdDev = *p.StdDev
+	}
+
+	_, err = fmt.Fprintf(writer, "#[Mean    = %12.3f, StdDeviation   = %12.3f]\n#[Max     = %12.3f, Total count    = %12d]\n",
+		mean/valueScale,
+		stdDev/valueScale,
+		float64(p.MaxValue)/valueScale,
+		p.TotalCount,
+	)
+	if err != nil || p.Buckets == 0 {
+		return
+	}
+
+	_, err = fmt.Fprintf(writer, "#[Buckets = %12d, SubBuckets     = %12d]\n", p.Buckets, p.SubBuckets)
+
+	return
+}
+
 // CreatePercentiles creates an instance of Percentiles from a
 // hdrhistogram.Histogram
-func CreatePercentiles(hist *hdrhistogram.Histogram) (result *Percentiles) {
+func CreatePercentiles(hist *hdrhistogram.Histogram) *Percentiles {
+	return CreatePercentilesWithOptions(hist, nil)
+}
+
+// CreatePercentilesWithOptions creates an instance of Percentiles from a
+// hdrhistogram.Histogram using the specified options
+//
+//	Notes
+//		If opts is nil, DefaultPercentilesOptions are used
+//
+//		The EndTime of the percentiles is the current time of SystemClock
+//
+func CreatePercentilesWithOptions(hist *hdrhistogram.Histogram, opts *PercentilesOptions) *Percentiles {
+	return createPercentiles(hist, opts, SystemClock)
+}
+
+// createPercentiles creates an instance of Percentiles from a
+// hdrhistogram.Histogram using the specified options, where the EndTime is
+// the current time of clock
+func createPercentiles(hist *hdrhistogram.Histogram, opts *PercentilesOptions, clock Clock) (result *Percentiles) {
+	if opts == nil {
+		opts = &DefaultPercentilesOptions
+	}
+
 	result = &Percentiles{
 		MinValue:   hist.Min(),
 		MaxValue:   hist.Max(),
 		TotalCount: hist.TotalCount(),
 		StartTime:  hist.StartTimeMs(),
-		EndTime:    time.Now().UTC().UnixNano() / 1e6,
+		EndTime:    nowMs(clock),
 		Tag:        hist.Tag(),
 	}
 
-	dist := hist.CumulativeDistributionWithTicks(1)
-	for _, slice := range dist {
-		result.Percentiles = append(
-			result.Percentiles,
-			Percentile{
-				Percentile: slice.Quantile / 100.0,
-				Value:      slice.ValueAt,
-				Count:      slice.Count,
-			})
+	result.Buckets, result.SubBuckets = bucketLayout(hist)
+
+	if len(opts.Percentiles) > 0 {
+		dist := hist.Distribution()
+		for _, percentile := range opts.Percentiles {
+			value := hist.ValueAtQuantile(percentile)
+			result.Percentiles = append(
+				result.Percentiles,
+				Percentile{
+					Percentile: percentile / 100.0,
+					Value:      value,
+					Count:      countAtOrBelow(dist, value),
+				})
+		}
+
+		// keep the percentiles ordered lowest to highest
+		sort.SliceStable(result.Percentiles, func(i, j int) bool {
+			return result.Percentiles[i].Percentile < result.Percentiles[j].Percentile
+		})
+	} else {
+		ticks := opts.TicksPerHalfDistance
+		if ticks < 1 {
+			ticks = 1
+		}
+
+		dist := hist.CumulativeDistributionWithTicks(ticks)
+		for _, slice := range dist {
+			result.Percentiles = append(
+				result.Percentiles,
+				Percentile{
+					Percentile: slice.Quantile / 100.0,
+					Value:      slice.ValueAt,
+					Count:      slice.Count,
+				})
+		}
+	}
+
+	if opts.IncludeMean {
+		mean := hist.Mean()
+		result.Mean = &mean
+	}
+
+	if opts.IncludeStdDev {
+		stdDev := hist.StdDev()
+		result.StdDev = &stdDev
+	}
+
+	if opts.IncludeSum {
+		sum := sumOf(hist.Distribution())
+		result.Sum = &sum
+	}
+
+	return
+}
+
+// bucketLayout returns the number of buckets and sub-buckets of hist, which
+// hdrhistogram.Histogram does not export
+func bucketLayout(hist *hdrhistogram.Histogram) (buckets, subBuckets int32) {
+	layout := newSparseHistogram(hist.LowestTrackableValue(), hist.HighestTrackableValue(), int(hist.SignificantFigures()))
+
+	// see hdrhistogram.New
+	subBuckets = int32(1) << (layout.subBucketHalfCountMagnitude + 1)
+	buckets = int32(layout.countsLen/int64(subBuckets/2)) - 1
+
+	return
+}
+
+// countAtOrBelow returns the number of recorded values that are less than or
+// equivalent to value
+func countAtOrBelow(dist []hdrhistogram.Bar, value int64) (count int64) {
+	for _, bar := range dist {
+		if bar.From > value {
+			break
+		}
+		count += bar.Count
+	}
+
+	return
+}
+
+// sumOf returns the approximate sum of the recorded values, using the median
+// equivalent value of each bar (which is consistent with Histogram.Mean)
+func sumOf(dist []hdrhistogram.Bar) (sum int64) {
+	for _, bar := range dist {
+		if bar.Count != 0 {
+			sum += bar.Count * (bar.From + (bar.To-bar.From+1)/2)
+		}
 	}
 
 	return
@@ -0,0 +1,158 @@
+package safehdrhistogram
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ValueAtPercentile returns the value of the lowest reported percentile that
+// is at or above percentile (expressed as 0 to 100, e.g. 99.9)
+//
+//	Notes
+//		The result is only exact when percentile was explicitly requested
+//		(see PercentilesOptions.Percentiles), otherwise it is the value of the
+//		next reported percentile. If no reported percentile is high enough,
+//		MaxValue is returned
+//
+func (p *Percentiles) ValueAtPercentile(percentile float64) int64 {
+	for _, perc := range p.Percentiles {
+		if perc.Percentile*100.0 >= percentile {
+			return perc.Value
+		}
+	}
+
+	return p.MaxValue
+}
+
+// WriteCSV produces CSV output for Percentiles, with a header row
+func (p *Percentiles) WriteCSV(writer io.Writer) error {
+	w := csv.NewWriter(writer)
+
+	if err := w.Write([]string{"Value", "Percentile", "TotalCount"}); err != nil {
+		return err
+	}
+
+	for _, perc := range p.Percentiles {
+		err := w.Write([]string{
+			strconv.FormatInt(perc.Value, 10),
+			strconv.FormatFloat(perc.Percentile, 'f', -1, 64),
+			strconv.FormatInt(perc.Count, 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// WriteMarkdown produces a Markdown table for Percentiles, followed by a
+// summary line
+func (p *Percentiles) WriteMarkdown(writer io.Writer) (err error) {
+	_, err = fmt.Fprint(writer, "| Value | Percentile | TotalCount |\n|---:|---:|---:|\n")
+	if err != nil {
+		return
+	}
+
+	for _, perc := range p.Percentiles {
+		_, err = fmt.Fprintf(writer, "| %d | %f | %d |\n", perc.Value, perc.Percentile, perc.Count)
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = fmt.Fprintf(writer, "\nMin = %d, Max = %d, Total count = %d\n", p.MinValue, p.MaxValue, p.TotalCount)
+	return
+}
+
+// comparisonHeader returns the column names of a comparison table
+func comparisonHeader(percentiles []float64) []string {
+	header := []string{"Name", "Count", "Min"}
+	for _, percentile := range percentiles {
+		header = append(header, "p"+strconv.FormatFloat(percentile, 'f', -1, 64))
+	}
+
+	return append(header, "Max")
+}
+
+// comparisonRow returns the cells of a comparison table row for p
+func comparisonRow(p *Percentiles, percentiles []float64) []string {
+	row := []string{
+		p.Tag,
+		strconv.FormatInt(p.TotalCount, 10),
+		strconv.FormatInt(p.MinValue, 10),
+	}
+	for _, percentile := range percentiles {
+		row = append(row, strconv.FormatInt(p.ValueAtPercentile(percentile), 10))
+	}
+
+	return append(row, strconv.FormatInt(p.MaxValue, 10))
+}
+
+// WriteComparisonCSV produces CSV output that compares several Percentiles,
+// with one row per Percentiles (named by Tag) and one column per percentile
+// (expressed as 0 to 100, e.g. 99.9)
+//
+//	Notes
+//		For exact values, create the Percentiles with the same explicit
+//		percentiles (see PercentilesOptions.Percentiles and
+//		Percentiles.ValueAtPercentile)
+//
+func WriteComparisonCSV(writer io.Writer, percentiles []float64, percs ...*Percentiles) error {
+	w := csv.NewWriter(writer)
+
+	if err := w.Write(comparisonHeader(percentiles)); err != nil {
+		return err
+	}
+
+	for _, p := range percs {
+		if err := w.Write(comparisonRow(p, percentiles)); err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// WriteComparisonMarkdown produces a Markdown table that compares several
+// Percentiles, with one row per Percentiles (named by Tag) and one column per
+// percentile (expressed as 0 to 100, e.g. 99.9)
+//
+//	Notes
+//		For exact values, create the Percentiles with the same explicit
+//		percentiles (see PercentilesOptions.Percentiles and
+//		Percentiles.ValueAtPercentile)
+//
+func WriteComparisonMarkdown(writer io.Writer, percentiles []float64, percs ...*Percentiles) (err error) {
+	header := comparisonHeader(percentiles)
+
+	_, err = fmt.Fprintf(writer, "| %s |\n|---|%s\n",
+		strings.Join(header, " | "),
+		strings.Repeat("---:|", len(header)-1))
+	if err != nil {
+		return
+	}
+
+	for _, p := range percs {
+		row := comparisonRow(p, percentiles)
+		row[0] = escapeMarkdown(row[0])
+
+		_, err = fmt.Fprintf(writer, "| %s |\n", strings.Join(row, " | "))
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// escapeMarkdown escapes the characters of s that would break a Markdown
+// table cell
+func escapeMarkdown(s string) string {
+	return strings.NewReplacer("|", "\\|", "\n", " ").Replace(s)
+}
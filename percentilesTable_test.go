@@ -0,0 +1,60 @@
+package safehdrhistogram
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Percentiles_Tables(t *testing.T) {
+	t.Run("Percentiles CSV", func(t *testing.T) {
+		t.Parallel()
+
+		p := &Percentiles{
+			MinValue:   10,
+			MaxValue:   20,
+			TotalCount: 2,
+			Percentiles: []Percentile{
+				{Value: 10, Percentile: 0.5, Count: 1},
+				{Value: 20, Percentile: 1, Count: 2},
+			},
+		}
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, p.WriteCSV(&buf), "WriteCSV should not fail") {
+			return
+		}
+		if !assert.Equal(t, "Value,Percentile,TotalCount\n10,0.5,1\n20,1,2\n", buf.String(), "unexpected CSV output") {
+			return
+		}
+	})
+
+	t.Run("Comparison Markdown", func(t *testing.T) {
+		t.Parallel()
+
+		hists := NewHistogramMap(1, 30000000, 3)
+		hists.Record(100, "a|b")
+		hists.Record(200, "c")
+
+		opts := &PercentilesOptions{Percentiles: []float64{50, 99.9}}
+		percs := []*Percentiles{
+			hists.Percentiles("a|b", false, opts),
+			hists.Percentiles("c", false, opts),
+		}
+		hists.Close()
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, WriteComparisonMarkdown(&buf, []float64{50, 99.9}, percs...), "WriteComparisonMarkdown should not fail") {
+			return
+		}
+
+		expected := "| Name | Count | Min | p50 | p99.9 | Max |\n" +
+			"|---|---:|---:|---:|---:|---:|\n" +
+			"| a\\|b | 1 | 100 | 100 | 100 | 100 |\n" +
+			"| c | 1 | 200 | 200 | 200 | 200 |\n"
+		if !assert.Equal(t, expected, buf.String(), "unexpected Markdown output") {
+			return
+		}
+	})
+}
@@ -0,0 +1,602 @@
+package safehdrhistogram
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPushInterval is the default interval at which a Pusher ships
+	// snapshots
+	DefaultPushInterval = 10 * time.Second
+	// DefaultPushBatchSize is the default maximum number of snapshots in a
+	// batch
+	DefaultPushBatchSize = 100
+	// DefaultPushBufferSize is the default maximum number of batches a
+	// Pusher buffers while the collector is unavailable
+	DefaultPushBufferSize = 1000
+	// DefaultPushTimeout is the default timeout of a request to the
+	// collector
+	DefaultPushTimeout = 10 * time.Second
+	// DefaultMinBackoff and DefaultMaxBackoff are the default bounds of the
+	// delay before a failed batch is retried
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+)
+
+// pushBatchExt is the file extension of the batches buffered on disk
+const pushBatchExt = ".batch"
+
+// PusherConfig represents the values used to construct a Pusher and is
+// designed for use in yaml or JSON configuration files
+type PusherConfig struct {
+	// URL is the snapshots endpoint of the collector (see Aggregator)
+	URL string `yaml:"url" json:"url"`
+	// Source identifies the process (or host) in the pushed snapshots
+	Source string `yaml:"source" json:"source"`
+	// Interval is the interval at which snapshots are pushed. If 0,
+	// DefaultPushInterval is used
+	Interval time.Duration `yaml:"interval" json:"interval"`
+	// BatchSize is the maximum number of snapshots in a batch (request). If
+	// 0, DefaultPushBatchSize is used
+	BatchSize int `yaml:"batchSize" json:"batchSize"`
+	// Gzip compresses the body of each request
+	Gzip bool `yaml:"gzip" json:"gzip"`
+	// Timeout is the timeout of each request. If 0, DefaultPushTimeout is
+	// used
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+	// MinBackoff is the delay before a failed batch is first retried, which
+	// doubles with each failure up to MaxBackoff. If 0, DefaultMinBackoff
+	// and DefaultMaxBackoff are used
+	MinBackoff time.Duration `yaml:"minBackoff" json:"minBackoff"`
+	MaxBackoff time.Duration `yaml:"maxBackoff" json:"maxBackoff"`
+	// BufferSize is the maximum number of batches that are buffered while
+	// the collector is unavailable, after which the oldest batches are
+	// dropped. If 0, DefaultPushBufferSize is used
+	BufferSize int `yaml:"bufferSize" json:"bufferSize"`
+	// BufferDir is a directory in which batches are buffered until they are
+	// sent, so they survive a restart. Each batch is written to a temporary
+	// file and renamed, so a batch file is always complete. If empty,
+	// batches are buffered in memory
+	BufferDir string `yaml:"bufferDir" json:"bufferDir"`
+
+	// Client is the http.Client used to send requests. If nil, a client
+	// with Timeout is used
+	Client *http.Client `yaml:"-" json:"-"`
+}
+
+// PusherStats reports the runtime statistics of a Pusher
+//
+//	Notes
+//		Stats are cumulative from the creation of the Pusher, with the
+//		exception of Pending
+//
+type PusherStats struct {
+	// Sent is the number of batches sent, and Snapshots is the number of
+	// snapshots they contained
+	Sent      int64 `json:"sent"`
+	Snapshots int64 `json:"snapshots"`
+	// Retries is the number of failed requests that were (or will be)
+	// retried
+	Retries int64 `json:"retries"`
+	// Rejected is the number of batches the collector rejected as invalid,
+	// which are not retried
+	Rejected int64 `json:"rejected"`
+	// Dropped is the number of batches dropped because the buffer was full
+	Dropped int64 `json:"dropped"`
+	// Pending is the number of buffered batches
+	Pending int `json:"pending"`
+}
+
+// Pusher periodically ships snapshots to a collector (see Aggregator), and
+// buffers them while the collector is unavailable (see
+// Histogram.StartPushing and HistogramMap.StartPushing)
+//
+//	Notes
+//		Each push takes snapshots with reset, so each snapshot contains the
+//		values recorded during an interval, and the collector can merge them
+//		without double counting. Don't combine a Pusher with other resets
+//		(such as a Checkpointer, which expects cumulative histograms)
+//
+//		Every batch has a unique ID, so if a request is retried after the
+//		collector merged it (but the response was lost), the collector
+//		doesn't merge it again
+//
+//		Requests that fail, time out, or return 408, 429, or 5xx are retried
+//		with exponential backoff. Other responses are not retried
+//
+type Pusher struct {
+	config   PusherConfig
+	client   *http.Client
+	snapshot func(ctx context.Context) (map[string]*Snapshot, error)
+	closed   <-chan struct{}
+
+	// idPrefix and nextID identify the batches of the Pusher
+	idPrefix string
+	nextID   int64
+
+	// wake is signalled when a retry is scheduled
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	// lock serializes pushes, and protects the state below
+	lock    sync.Mutex
+	pending []*pushBatch
+	backoff time.Duration
+	retryAt time.Time
+	stats   PusherStats
+	err     error
+}
+
+// pushBatch is a buffered batch
+type pushBatch struct {
+	id        string
+	body      []byte
+	snapshots int
+	// file is the file of the batch if it is buffered on disk
+	file string
+}
+
+// startPushing starts a go routine that pushes the snapshots returned by
+// snapshot every interval until the Pusher is stopped, or closed is closed
+//
+//	Notes
+//		If snapshot returns an error, the snapshots it returns with the
+//		error are still pushed (see collect)
+//
+func startPushing(config PusherConfig, snapshot func(ctx context.Context) (map[string]*Snapshot, error), closed <-chan struct{}) *Pusher {
+	if config.Interval <= 0 {
+		config.Interval = DefaultPushInterval
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultPushBatchSize
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultPushTimeout
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = DefaultMinBackoff
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = DefaultMaxBackoff
+		if config.MaxBackoff < config.MinBackoff {
+			config.MaxBackoff = config.MinBackoff
+		}
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = DefaultPushBufferSize
+	}
+
+	p := &Pusher{
+		config:   config,
+		client:   config.Client,
+		snapshot: snapshot,
+		closed:   closed,
+		idPrefix: fmt.Sprintf("%016x", time.Now().UnixNano()),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if p.client == nil {
+		p.client = &http.Client{Timeout: config.Timeout}
+	}
+
+	p.readBuffer()
+
+	go func() {
+		defer close(p.done)
+
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+
+		// retry is the timer of a retry that is backing off, if any
+		var retry *time.Timer
+		var retryC <-chan time.Time
+
+		for {
+			select {
+			case <-ticker.C:
+				_ = p.Push()
+			case <-retryC:
+				_ = p.retry()
+			case <-p.wake:
+			case <-p.stop:
+				return
+			case <-closed:
+				return
+			}
+
+			if retry != nil {
+				retry.Stop()
+				retry, retryC = nil, nil
+			}
+			if at := p.nextRetry(); !at.IsZero() {
+				retry = time.NewTimer(time.Until(at))
+				retryC = retry.C
+			}
+		}
+	}()
+
+	return p
+}
+
+// Push takes snapshots (with reset), buffers them as batches, and sends the
+// buffered batches (unless a retry is backing off)
+//
+//	Notes
+//		Push is called every interval, and can be called to push
+//		immediately. The error is that of the first batch that failed, if
+//		any
+//
+func (p *Pusher) Push() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := p.collect(); err != nil {
+		p.err = err
+		return err
+	}
+
+	if !p.retryAt.IsZero() && time.Now().Before(p.retryAt) {
+		return p.err
+	}
+
+	p.err = p.flush()
+	return p.err
+}
+
+// retry sends the buffered batches once a retry is no longer backing off
+func (p *Pusher) retry() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.retryAt.IsZero() || time.Now().Before(p.retryAt) {
+		return p.err
+	}
+
+	p.err = p.flush()
+	return p.err
+}
+
+// nextRetry returns the time of the next retry, or the zero time if no
+// retry is backing off
+func (p *Pusher) nextRetry() time.Time {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.retryAt
+}
+
+// collect takes snapshots and buffers them as batches (the lock must be
+// held by the caller)
+//
+//	Notes
+//		If taking the snapshots fails part way, the snapshots that were taken
+//		(and reset) are still buffered, so their values aren't lost, and the
+//		error is returned
+//
+func (p *Pusher) collect() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+	defer cancel()
+
+	snapshots, snapshotErr := p.snapshot(ctx)
+
+	names := make([]string, 0, len(snapshots))
+	for name, snapshot := range snapshots {
+		// skip empty intervals
+		if !snapshot.empty() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for len(names) > 0 {
+		count := len(names)
+		if count > p.config.BatchSize {
+			count = p.config.BatchSize
+		}
+
+		batch := AggregatorBatch{ID: p.newID()}
+		for _, name := range names[:count] {
+			encoded, err := EncodeSnapshot(name, snapshots[name])
+			if err != nil {
+				return err
+			}
+
+			encoded.Source = p.config.Source
+			batch.Snapshots = append(batch.Snapshots, encoded)
+		}
+
+		body, err := json.Marshal(&batch)
+		if err != nil {
+			return err
+		}
+
+		if err = p.buffer(&pushBatch{id: batch.ID, body: body, snapshots: count}); err != nil {
+			return err
+		}
+
+		names = names[count:]
+	}
+
+	return snapshotErr
+}
+
+// newID returns a unique batch ID, which is ordered by creation (the lock
+// must be held by the caller)
+func (p *Pusher) newID() string {
+	p.nextID++
+	return fmt.Sprintf("%s-%08x", p.idPrefix, p.nextID)
+}
+
+// buffer adds a batch to the buffer, dropping the oldest batches if the
+// buffer is full (the lock must be held by the caller)
+func (p *Pusher) buffer(batch *pushBatch) error {
+	if p.config.BufferDir != "" {
+		// the batch is renamed into place, so a batch file is never partial
+		batch.file = filepath.Join(p.config.BufferDir, batch.id+pushBatchExt)
+		if err := replaceFile(batch.file, func(writer io.Writer) error {
+			_, err := writer.Write(batch.body)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	p.pending = append(p.pending, batch)
+
+	for len(p.pending) > p.config.BufferSize {
+		p.remove()
+		p.stats.Dropped++
+	}
+
+	return nil
+}
+
+// remove removes the oldest batch from the buffer (the lock must be held by
+// the caller)
+func (p *Pusher) remove() {
+	if p.pending[0].file != "" {
+		_ = os.Remove(p.pending[0].file)
+	}
+
+	p.pending[0] = nil
+	p.pending = p.pending[1:]
+}
+
+// readBuffer buffers the batches left in BufferDir by a previous Pusher
+func (p *Pusher) readBuffer() {
+	if p.config.BufferDir == "" {
+		return
+	}
+
+	files, err := ioutil.ReadDir(p.config.BufferDir)
+	if err != nil {
+		return
+	}
+
+	// the IDs (and so the file names) are ordered by creation
+	for _, info := range files {
+		if info.IsDir() {
+			continue
+		}
+
+		file := filepath.Join(p.config.BufferDir, info.Name())
+
+		if strings.Contains(info.Name(), pushBatchExt+tempFileSuffix) {
+			// a batch that was partially written when the previous Pusher
+			// stopped
+			_ = os.Remove(file)
+			continue
+		} else if !strings.HasSuffix(info.Name(), pushBatchExt) {
+			continue
+		}
+
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		// batch files are complete (see buffer), so a batch that can't be
+		// decoded is left for inspection rather than removed
+		var batch AggregatorBatch
+		if err = json.Unmarshal(body, &batch); err != nil {
+			continue
+		}
+
+		p.pending = append(p.pending, &pushBatch{
+			id:        batch.ID,
+			body:      body,
+			snapshots: len(batch.Snapshots),
+			file:      file,
+		})
+	}
+
+	for len(p.pending) > p.config.BufferSize {
+		p.remove()
+		p.stats.Dropped++
+	}
+}
+
+// flush sends the buffered batches in order, and stops at the first batch
+// that should be retried (the lock must be held by the caller)
+func (p *Pusher) flush() (err error) {
+	for len(p.pending) > 0 {
+		retry, sendErr := p.send(p.pending[0])
+		if sendErr != nil && err == nil {
+			err = sendErr
+		}
+
+		if sendErr != nil && retry {
+			p.stats.Retries++
+
+			if p.backoff == 0 {
+				p.backoff = p.config.MinBackoff
+			} else if p.backoff *= 2; p.backoff > p.config.MaxBackoff {
+				p.backoff = p.config.MaxBackoff
+			}
+			p.retryAt = time.Now().Add(p.backoff)
+
+			// reschedule the retry timer
+			select {
+			case p.wake <- struct{}{}:
+			default:
+			}
+
+			return err
+		}
+
+		if sendErr != nil {
+			p.stats.Rejected++
+		} else {
+			p.stats.Sent++
+			p.stats.Snapshots += int64(p.pending[0].snapshots)
+		}
+
+		p.remove()
+		p.backoff = 0
+		p.retryAt = time.Time{}
+	}
+
+	return err
+}
+
+// send sends a batch, and returns true if a failure should be retried
+func (p *Pusher) send(batch *pushBatch) (retry bool, err error) {
+	body := batch.body
+
+	if p.config.Gzip {
+		var zipped bytes.Buffer
+
+		zipper := gzip.NewWriter(&zipped)
+		if _, err = zipper.Write(body); err == nil {
+			err = zipper.Close()
+		}
+		if err != nil {
+			return false, err
+		}
+
+		body = zipped.Bytes()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if p.config.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	// drain the body, so the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return true, fmt.Errorf("safehdrhistogram: push failed: %s", resp.Status)
+	default:
+		return false, fmt.Errorf("safehdrhistogram: push rejected: %s", resp.Status)
+	}
+}
+
+// Stats returns the runtime statistics of the Pusher
+func (p *Pusher) Stats() *PusherStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	stats := p.stats
+	stats.Pending = len(p.pending)
+
+	return &stats
+}
+
+// Err returns the error of the most recent push, or nil if it succeeded
+func (p *Pusher) Err() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.err
+}
+
+// Stop stops pushing, and makes a final push (without waiting for a retry
+// that is backing off)
+//
+//	Notes
+//		If the Histogram (or HistogramMap) is closed, the final push only
+//		sends the buffered batches. Batches that can't be sent are lost,
+//		unless BufferDir is used
+//
+//		Stop is safe to call more than once, but only the first call pushes
+//
+func (p *Pusher) Stop() (err error) {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		<-p.done
+
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		select {
+		case <-p.closed:
+		default:
+			err = p.collect()
+		}
+
+		if flushErr := p.flush(); err == nil {
+			err = flushErr
+		}
+
+		p.err = err
+	})
+
+	return err
+}
+
+// StartPushing pushes a snapshot of the histogram (named name) to a
+// collector every interval, until the Pusher is stopped or the Histogram is
+// closed (see Pusher)
+func (hdr *Histogram) StartPushing(name string, config PusherConfig) *Pusher {
+	return startPushing(config, func(ctx context.Context) (map[string]*Snapshot, error) {
+		snapshot, err := hdr.SnapshotContext(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]*Snapshot{name: snapshot}, nil
+	}, hdr.cmds.quit)
+}
+
+// StartPushing pushes a snapshot of every histogram to a collector every
+// interval, until the Pusher is stopped or the HistogramMap is closed (see
+// Pusher)
+func (hdr *HistogramMap) StartPushing(config PusherConfig) *Pusher {
+	return startPushing(config, func(ctx context.Context) (map[string]*Snapshot, error) {
+		return hdr.snapshots(ctx, nil, true)
+	}, hdr.cmds.quit)
+}
@@ -0,0 +1,345 @@
+package safehdrhistogram
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Pusher(t *testing.T) {
+	t.Run("Push To Aggregator", func(t *testing.T) {
+		t.Parallel()
+
+		agg := NewAggregator(AggregatorConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+		})
+
+		var gzipped int64
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				atomic.AddInt64(&gzipped, 1)
+			}
+			agg.ServeHTTP(w, r)
+		}))
+		defer server.Close()
+
+		hdrs := NewHistogramMap(1, 1000000, 3)
+		defer hdrs.Close()
+
+		pusher := hdrs.StartPushing(PusherConfig{
+			URL:       server.URL + "/snapshots",
+			Source:    "host",
+			Interval:  10 * time.Millisecond,
+			BatchSize: 1,
+			Gzip:      true,
+		})
+
+		for value := int64(1); value <= 100; value++ {
+			hdrs.Record(value, "get", "all")
+		}
+
+		if !assert.Eventually(t, func() bool {
+			snapshot := agg.Snapshot("all", 0, 0)
+			return snapshot != nil && snapshot.ToHistogram().TotalCount() == 100
+		}, time.Second, time.Millisecond, "the values should be pushed") {
+			return
+		}
+
+		hdrs.Record(1000, "put")
+
+		if !assert.NoError(t, pusher.Stop(), "Stop should push the final interval") {
+			return
+		}
+
+		// each interval is pushed once, so nothing is double counted
+		for name, count := range map[string]int64{"all": 100, "get": 100, "put": 1} {
+			if !assert.Equal(t, count, agg.Snapshot(name, 0, 0).ToHistogram().TotalCount(), "%s should be pushed once", name) {
+				return
+			}
+		}
+
+		stats := pusher.Stats()
+		if !assert.Equal(t, int64(3), stats.Snapshots, "three snapshots should be pushed") {
+			return
+		}
+		if !assert.Equal(t, int64(3), stats.Sent, "each snapshot should be a batch") {
+			return
+		}
+		if !assert.Equal(t, int64(3), atomic.LoadInt64(&gzipped), "the batches should be gzip compressed") {
+			return
+		}
+		if !assert.Equal(t, []string{"host"}, agg.Sources("all"), "the source should be pushed") {
+			return
+		}
+	})
+
+	t.Run("Retry Without Double Counting", func(t *testing.T) {
+		t.Parallel()
+
+		agg := NewAggregator(AggregatorConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+		})
+
+		// the first request is merged, but the response is lost
+		var requests int64
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt64(&requests, 1) == 1 {
+				agg.ServeHTTP(httptest.NewRecorder(), r)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			agg.ServeHTTP(w, r)
+		}))
+		defer server.Close()
+
+		shdr := NewHistogram(1, 1000000, 3)
+		defer shdr.Close()
+
+		pusher := shdr.StartPushing("latency", PusherConfig{
+			URL:        server.URL + "/snapshots",
+			Interval:   time.Hour,
+			MinBackoff: time.Millisecond,
+		})
+		defer pusher.Stop()
+
+		shdr.Record(42)
+		if !assert.Error(t, pusher.Push(), "the first request should fail") {
+			return
+		}
+
+		// the retry is sent after the backoff, without waiting for the
+		// interval
+		if !assert.Eventually(t, func() bool { return pusher.Stats().Sent == 1 }, time.Second, time.Millisecond, "the batch should be retried") {
+			return
+		}
+
+		if !assert.Equal(t, int64(1), agg.Snapshot("latency", 0, 0).ToHistogram().TotalCount(), "the retry should not be merged twice") {
+			return
+		}
+		if !assert.Equal(t, int64(1), agg.Stats().Duplicates, "the retry should be a duplicate") {
+			return
+		}
+		if !assert.Equal(t, int64(1), pusher.Stats().Retries, "one retry should be counted") {
+			return
+		}
+	})
+
+	t.Run("Bounded Buffer", func(t *testing.T) {
+		t.Parallel()
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		shdr := NewHistogram(1, 1000000, 3)
+		defer shdr.Close()
+
+		pusher := shdr.StartPushing("latency", PusherConfig{
+			URL:        server.URL,
+			Interval:   time.Hour,
+			BufferSize: 2,
+			MinBackoff: time.Hour,
+		})
+
+		for i := int64(1); i <= 4; i++ {
+			shdr.Record(i)
+			_ = pusher.Push()
+		}
+
+		stats := pusher.Stats()
+		if !assert.Equal(t, 2, stats.Pending, "the buffer should be bounded") {
+			return
+		}
+		if !assert.Equal(t, int64(2), stats.Dropped, "the oldest batches should be dropped") {
+			return
+		}
+		if !assert.Equal(t, int64(1), stats.Retries, "later pushes should wait for the backoff") {
+			return
+		}
+
+		// rejected batches are not retried
+		rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer rejecting.Close()
+
+		pusher.config.URL = rejecting.URL
+		if !assert.Error(t, pusher.Stop(), "Stop should report the rejection") {
+			return
+		}
+
+		stats = pusher.Stats()
+		if !assert.Equal(t, 0, stats.Pending, "the rejected batches should be removed") {
+			return
+		}
+		if !assert.Equal(t, int64(2), stats.Rejected, "the rejected batches should be counted") {
+			return
+		}
+	})
+
+	t.Run("Disk Buffer", func(t *testing.T) {
+		t.Parallel()
+
+		dir := t.TempDir()
+
+		down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer down.Close()
+
+		shdr := NewHistogram(1, 1000000, 3)
+		defer shdr.Close()
+
+		config := PusherConfig{
+			URL:       down.URL,
+			Interval:  time.Hour,
+			BufferDir: dir,
+		}
+
+		shdr.Record(7)
+		pusher := shdr.StartPushing("latency", config)
+		if !assert.Error(t, pusher.Stop(), "the collector should be down") {
+			return
+		}
+
+		files, _ := ioutil.ReadDir(dir)
+		if !assert.Len(t, files, 1, "the batch should be buffered on disk") {
+			return
+		}
+
+		// a new Pusher (after a restart) sends the buffered batch
+		agg := NewAggregator(AggregatorConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+		})
+		up := httptest.NewServer(agg)
+		defer up.Close()
+
+		config.URL = up.URL + "/snapshots"
+		pusher = shdr.StartPushing("latency", config)
+		if !assert.Equal(t, 1, pusher.Stats().Pending, "the buffered batch should be read") {
+			return
+		}
+		if !assert.NoError(t, pusher.Stop(), "the buffered batch should be sent") {
+			return
+		}
+
+		if !assert.Equal(t, int64(1), agg.Snapshot("latency", 0, 0).ToHistogram().TotalCount(), "the buffered values should be merged") {
+			return
+		}
+
+		files, _ = ioutil.ReadDir(dir)
+		if !assert.Len(t, files, 0, "the sent batch should be removed") {
+			return
+		}
+	})
+	t.Run("Disk Buffer Recovery", func(t *testing.T) {
+		t.Parallel()
+
+		dir := t.TempDir()
+
+		// a batch that was being written when the process stopped, and a
+		// complete batch that can't be decoded
+		partial := filepath.Join(dir, "a-00000001"+pushBatchExt+tempFileSuffix+"123")
+		corrupt := filepath.Join(dir, "a-00000002"+pushBatchExt)
+		if !assert.NoError(t, ioutil.WriteFile(partial, []byte(`{"id":`), 0644), "WriteFile should not fail") {
+			return
+		}
+		if !assert.NoError(t, ioutil.WriteFile(corrupt, []byte("not a batch"), 0644), "WriteFile should not fail") {
+			return
+		}
+
+		down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer down.Close()
+
+		shdr := NewHistogram(1, 1000000, 3)
+		defer shdr.Close()
+
+		shdr.Record(7)
+		pusher := shdr.StartPushing("latency", PusherConfig{
+			URL:       down.URL,
+			Interval:  time.Hour,
+			BufferDir: dir,
+		})
+		if !assert.Equal(t, 0, pusher.Stats().Pending, "neither file should be buffered") {
+			return
+		}
+		if !assert.Error(t, pusher.Stop(), "the collector should be down") {
+			return
+		}
+
+		var names []string
+		files, _ := ioutil.ReadDir(dir)
+		for _, info := range files {
+			names = append(names, info.Name())
+		}
+
+		if !assert.Len(t, names, 2, "the partial batch should be removed, and the new batch buffered") {
+			return
+		}
+		if !assert.Contains(t, names, filepath.Base(corrupt), "the corrupt batch should be left") {
+			return
+		}
+		for _, name := range names {
+			if !assert.NotContains(t, name, tempFileSuffix, "no temporary files should be left") {
+				return
+			}
+		}
+	})
+
+	t.Run("Partial Snapshots", func(t *testing.T) {
+		t.Parallel()
+
+		agg := NewAggregator(AggregatorConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+		})
+		server := httptest.NewServer(agg)
+		defer server.Close()
+
+		shdr := NewHistogram(1, 1000000, 3)
+		shdr.Record(42)
+		snapshot := shdr.Snapshot(true)
+		shdr.Close()
+
+		// the snapshots taken (and reset) before an error are still pushed
+		var calls int64
+		pusher := startPushing(PusherConfig{
+			URL:      server.URL + "/snapshots",
+			Interval: time.Hour,
+		}, func(ctx context.Context) (map[string]*Snapshot, error) {
+			if atomic.AddInt64(&calls, 1) > 1 {
+				return nil, nil
+			}
+			return map[string]*Snapshot{"a": snapshot}, ErrClosed
+		}, nil)
+
+		if !assert.Equal(t, ErrClosed, pusher.Push(), "Push should report the error") {
+			return
+		}
+		if !assert.Equal(t, 1, pusher.Stats().Pending, "the partial snapshots should be buffered") {
+			return
+		}
+
+		_ = pusher.Stop()
+		if !assert.Equal(t, int64(1), agg.Snapshot("a", 0, 0).ToHistogram().TotalCount(), "the partial snapshots should be pushed") {
+			return
+		}
+	})
+}
@@ -0,0 +1,321 @@
+package safehdrhistogram
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// ErrDuplicateName is returned when registering a name that is already
+// registered
+var ErrDuplicateName = errors.New("safehdrhistogram: name is already registered")
+
+// DefaultRegistry is the Registry used by the package level Register and
+// Lookup functions
+var DefaultRegistry = NewRegistry()
+
+// Registry is a collection of Histogram and HistogramMap instances that are
+// registered by name, so they can be looked up, snapshotted, and closed
+// collectively
+//
+//	Notes
+//		Histogram and HistogramMap instances share a single namespace. When
+//		operating on every histogram, the histograms of a HistogramMap are
+//		identified as mapName/histName
+//
+type Registry struct {
+	lock  sync.RWMutex
+	hists map[string]*Histogram
+	maps  map[string]*HistogramMap
+}
+
+// NewRegistry creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		hists: map[string]*Histogram{},
+		maps:  map[string]*HistogramMap{},
+	}
+}
+
+// RegisterHistogram registers a Histogram using the specified name
+func (r *Registry) RegisterHistogram(name string, hist *Histogram) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.exists(name) {
+		return ErrDuplicateName
+	}
+
+	r.hists[name] = hist
+	return nil
+}
+
+// RegisterHistogramMap registers a HistogramMap using the specified name
+func (r *Registry) RegisterHistogramMap(name string, hists *HistogramMap) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.exists(name) {
+		return ErrDuplicateName
+	}
+
+	r.maps[name] = hists
+	return nil
+}
+
+// exists returns true if name is registered (the caller must hold the lock)
+func (r *Registry) exists(name string) bool {
+	_, isHist := r.hists[name]
+	_, isMap := r.maps[name]
+
+	return isHist || isMap
+}
+
+// Unregister removes a Histogram or HistogramMap from the registry
+//
+//	Notes
+//		Unregister does not close the Histogram or HistogramMap
+//
+func (r *Registry) Unregister(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.hists, name)
+	delete(r.maps, name)
+}
+
+// Histogram returns the Histogram registered as name, or nil
+func (r *Registry) Histogram(name string) *Histogram {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.hists[name]
+}
+
+// HistogramMap returns the HistogramMap registered as name, or nil
+func (r *Registry) HistogramMap(name string) *HistogramMap {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.maps[name]
+}
+
+// Names returns the sorted names of the registered Histogram and
+// HistogramMap instances
+func (r *Registry) Names() (result []string) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for name := range r.hists {
+		result = append(result, name)
+	}
+	for name := range r.maps {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+	return
+}
+
+// HistogramNames returns the sorted names of every histogram, where the
+// histograms of a HistogramMap are named mapName/histName
+func (r *Registry) HistogramNames() []string {
+	return r.histogramNames(nil)
+}
+
+// histogramNames returns the sorted names of every histogram that matches
+// any of the patterns (or every histogram if there are no patterns)
+func (r *Registry) histogramNames(patterns []string) (result []string) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for name := range r.hists {
+		if matchName(name, patterns) {
+			result = append(result, name)
+		}
+	}
+
+	for mapName, hists := range r.maps {
+		for _, histName := range hists.Names() {
+			if name := path.Join(mapName, histName); matchName(name, patterns) {
+				result = append(result, name)
+			}
+		}
+	}
+
+	sort.Strings(result)
+	return
+}
+
+// SnapshotAll takes a snapshot of every histogram, keyed by histogram name
+// (see HistogramNames)
+func (r *Registry) SnapshotAll(reset bool) map[string]*Snapshot {
+	result := map[string]*Snapshot{}
+	for _, snap := range r.snapshots(nil, reset) {
+		result[snap.name] = snap.snapshot
+	}
+
+	return result
+}
+
+// PercentilesAll takes a percentiles snapshot of every histogram, keyed by
+// histogram name (see HistogramNames)
+//
+//	Notes
+//		If opts is nil, DefaultPercentilesOptions are used
+//
+func (r *Registry) PercentilesAll(reset bool, opts *PercentilesOptions) map[string]*Percentiles {
+	result := map[string]*Percentiles{}
+	for _, perc := range r.percentiles(nil, reset, opts) {
+		result[perc.name] = perc.percentiles
+	}
+
+	return result
+}
+
+// namedSnapshot is a snapshot of a histogram and the name used to identify
+// it
+type namedSnapshot struct {
+	name     string
+	snapshot *Snapshot
+}
+
+// namedPercentiles is the percentiles of a histogram and the name used to
+// identify it
+type namedPercentiles struct {
+	name        string
+	percentiles *Percentiles
+}
+
+// snapshots takes a snapshot of every histogram that matches any of the
+// patterns (or every histogram if there are no patterns), and returns them
+// in name order
+//
+//	Notes
+//		See each
+//
+func (r *Registry) snapshots(patterns []string, reset bool) (result []namedSnapshot) {
+	r.each(patterns, reset, func(name string, snapshot *Snapshot) {
+		result = append(result, namedSnapshot{name: name, snapshot: snapshot})
+	})
+
+	sort.Slice(result, func(i, j int) bool { return result[i].name < result[j].name })
+	return
+}
+
+// percentiles takes a percentiles snapshot of every histogram that matches
+// any of the patterns (or every histogram if there are no patterns), and
+// returns them in name order
+//
+//	Notes
+//		The percentiles are created as each snapshot is received, so only a
+//		few (dense) snapshots are in memory at once (see each)
+//
+func (r *Registry) percentiles(patterns []string, reset bool, opts *PercentilesOptions) (result []namedPercentiles) {
+	r.each(patterns, reset, func(name string, snapshot *Snapshot) {
+		result = append(result, namedPercentiles{name: name, percentiles: snapshot.percentiles(opts)})
+	})
+
+	sort.Slice(result, func(i, j int) bool { return result[i].name < result[j].name })
+	return
+}
+
+// each takes a snapshot of every histogram that matches any of the
+// patterns (or every histogram if there are no patterns), and calls f with
+// each snapshot
+//
+//	Notes
+//		Histograms that are closed are skipped. The histograms of a
+//		HistogramMap are snapshotted a few at a time (see
+//		HistogramMap.eachSnapshot), and are not created or marked as used
+//
+func (r *Registry) each(patterns []string, reset bool, f func(name string, snapshot *Snapshot)) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for name, hist := range r.hists {
+		if matchName(name, patterns) {
+			if snapshot := hist.Snapshot(reset); snapshot != nil {
+				f(name, snapshot)
+			}
+		}
+	}
+
+	for mapName, hists := range r.maps {
+		// polling does not create (or touch) the histograms of the map, so it
+		// doesn't affect which idle histograms are evicted
+		_ = hists.eachSnapshot(context.Background(), func(histName string) bool {
+			return matchName(path.Join(mapName, histName), patterns)
+		}, reset, func(histName string, snapshot *Snapshot) error {
+			f(path.Join(mapName, histName), snapshot)
+			return nil
+		})
+	}
+}
+
+// Close closes every registered Histogram and HistogramMap, removes them from
+// the registry, and returns the final histograms keyed by histogram name (see
+// HistogramNames)
+func (r *Registry) Close() map[string]*hdrhistogram.Histogram {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	result := map[string]*hdrhistogram.Histogram{}
+
+	for name, hist := range r.hists {
+		result[name] = hist.Close()
+	}
+
+	for mapName, hists := range r.maps {
+		for histName, hist := range hists.Close() {
+			result[path.Join(mapName, histName)] = hist
+		}
+	}
+
+	r.hists = map[string]*Histogram{}
+	r.maps = map[string]*HistogramMap{}
+
+	return result
+}
+
+// matchName returns true if name matches any of the patterns (see
+// path.Match), or there are no patterns
+func matchName(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RegisterHistogram registers a Histogram with the DefaultRegistry
+func RegisterHistogram(name string, hist *Histogram) error {
+	return DefaultRegistry.RegisterHistogram(name, hist)
+}
+
+// RegisterHistogramMap registers a HistogramMap with the DefaultRegistry
+func RegisterHistogramMap(name string, hists *HistogramMap) error {
+	return DefaultRegistry.RegisterHistogramMap(name, hists)
+}
+
+// LookupHistogram returns the Histogram registered with the DefaultRegistry
+// as name, or nil
+func LookupHistogram(name string) *Histogram {
+	return DefaultRegistry.Histogram(name)
+}
+
+// LookupHistogramMap returns the HistogramMap registered with the
+// DefaultRegistry as name, or nil
+func LookupHistogramMap(name string) *HistogramMap {
+	return DefaultRegistry.HistogramMap(name)
+}
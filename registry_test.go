@@ -0,0 +1,121 @@
+package safehdrhistogram
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Registry(t *testing.T) {
+	t.Run("Registry Register and Lookup", func(t *testing.T) {
+		t.Parallel()
+
+		registry := NewRegistry()
+		shdr := NewHistogram(1, 30000000, 3)
+		hists := NewHistogramMap(1, 30000000, 3)
+
+		if !assert.NoError(t, registry.RegisterHistogram("latency", shdr), "register should succeed") {
+			return
+		}
+		if !assert.NoError(t, registry.RegisterHistogramMap("requests", hists), "register should succeed") {
+			return
+		}
+		if !assert.Equal(t, ErrDuplicateName, registry.RegisterHistogramMap("latency", hists), "duplicate names should be rejected") {
+			return
+		}
+		if !assert.Equal(t, shdr, registry.Histogram("latency"), "lookup should return the registered Histogram") {
+			return
+		}
+		if !assert.Equal(t, hists, registry.HistogramMap("requests"), "lookup should return the registered HistogramMap") {
+			return
+		}
+		if !assert.Nil(t, registry.Histogram("requests"), "lookup of a HistogramMap name as a Histogram should be nil") {
+			return
+		}
+
+		registry.Close()
+	})
+
+	t.Run("Registry SnapshotAll and Close", func(t *testing.T) {
+		t.Parallel()
+
+		registry := NewRegistry()
+		shdr := NewHistogram(1, 30000000, 3)
+		hists := NewHistogramMap(1, 30000000, 3)
+
+		_ = registry.RegisterHistogram("latency", shdr)
+		_ = registry.RegisterHistogramMap("requests", hists)
+
+		shdr.Record(100)
+		hists.Record(200, "get-user", "api")
+
+		if !assert.Equal(t, []string{"latency", "requests/api", "requests/get-user"}, registry.HistogramNames(), "unexpected histogram names") {
+			return
+		}
+
+		snapshots := registry.SnapshotAll(false)
+		if !assert.Len(t, snapshots, 3, "SnapshotAll should snapshot every histogram") {
+			return
+		}
+		if !assert.Equal(t, int64(1), snapshots["requests/api"].ToHistogram().TotalCount(), "requests/api should have one value") {
+			return
+		}
+
+		final := registry.Close()
+		if !assert.Len(t, final, 3, "Close should return every histogram") {
+			return
+		}
+		if !assert.Empty(t, registry.Names(), "Close should empty the registry") {
+			return
+		}
+	})
+
+	t.Run("Registry Polling and Eviction", func(t *testing.T) {
+		t.Parallel()
+
+		clock := NewManualClock(time.Unix(1600000000, 0))
+		size := denseByteSize(1, 1000000, 3)
+		hists := NewHistogramMapFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			MemoryBudget:                   2 * size,
+			MemoryPolicy:                   MemoryPolicyEvictIdle,
+			Clock:                          clock,
+		})
+		defer hists.Close()
+
+		registry := NewRegistry()
+		_ = registry.RegisterHistogramMap("requests", hists)
+
+		hists.Record(1, "a")
+		clock.Advance(time.Second)
+		hists.Record(1, "b")
+		clock.Advance(time.Second)
+
+		// polling a (the least recently used) should not touch it
+		rec := httptest.NewRecorder()
+		NewHandler(registry).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?name=requests/a", nil))
+		if !assert.Equal(t, http.StatusOK, rec.Code, "unexpected status") {
+			return
+		}
+		clock.Advance(time.Second)
+
+		hists.Record(1, "c")
+		if !assert.ElementsMatch(t, []string{"b", "c"}, hists.Names(), "a should be evicted") {
+			return
+		}
+
+		// and polling an evicted name should not recreate it
+		if !assert.NotContains(t, registry.SnapshotAll(false), "requests/a", "a should not be recreated") {
+			return
+		}
+		if !assert.ElementsMatch(t, []string{"b", "c"}, hists.Names(), "a should not be recreated") {
+			return
+		}
+	})
+}
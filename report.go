@@ -0,0 +1,347 @@
+package safehdrhistogram
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// reportColors are the colors used for the series of a report
+var reportColors = []string{
+	"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd",
+	"#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf",
+}
+
+// reportPercentiles are the percentiles included in the summary table of a
+// report
+var reportPercentiles = []float64{50, 90, 99, 99.9, 99.99}
+
+// reportSeries is a labelled histogram in a report, and the unit metadata
+// of its snapshot (if any)
+type reportSeries struct {
+	label       string
+	hist        *hdrhistogram.Histogram
+	percentiles *Percentiles
+	unit        Unit
+	ratio       float64
+}
+
+// Report is a latency report that overlays the percentile distributions of
+// one or more histograms (the classic HdrHistogram log percentile chart) and
+// summarizes them in a table
+//
+//	Notes
+//		The output is standalone SVG or HTML with no external assets
+//
+type Report struct {
+	// Title is the title of the report
+	Title string
+	// Width is the width of the chart in pixels. A width that leaves less
+	// than 100 pixels for the plot (after the axis margins) is increased
+	Width int
+	// Height is the height of the chart in pixels, and is increased like
+	// Width
+	Height int
+	// ValueScale divides values for display (e.g. 1000 to display values
+	// recorded in microseconds as milliseconds). If 0, the
+	// ValueUnitScalingRatio of the first snapshot that has one is used (or
+	// 1)
+	ValueScale float64
+	// Unit labels the values (after scaling), e.g. "ms". If empty, the Unit
+	// of the first snapshot that has one is used
+	Unit string
+
+	series []reportSeries
+}
+
+// NewReport creates an empty Report
+func NewReport(title string) *Report {
+	return &Report{
+		Title:  title,
+		Width:  900,
+		Height: 500,
+	}
+}
+
+// AddSnapshot adds a Snapshot to the report as a series named label
+//
+//	Notes
+//		The Unit and ValueUnitScalingRatio of the snapshot are used to
+//		display the values, unless Unit or ValueScale is set
+//
+func (r *Report) AddSnapshot(label string, snapshot *Snapshot) *Report {
+	r.addHistogram(label, snapshot.ToHistogram())
+
+	series := &r.series[len(r.series)-1]
+	series.unit, series.ratio = snapshot.Unit, snapshot.ValueUnitScalingRatio
+
+	return r
+}
+
+// addHistogram adds a hdrhistogram.Histogram to the report as a series named
+// label
+func (r *Report) addHistogram(label string, hist *hdrhistogram.Histogram) *Report {
+	r.series = append(r.series, reportSeries{
+		label: label,
+		hist:  hist,
+		percentiles: CreatePercentilesWithOptions(hist, &PercentilesOptions{
+			TicksPerHalfDistance: 5,
+			IncludeMean:          true,
+		}),
+	})
+
+	return r
+}
+
+// AddIntervalLog adds the histograms of an HdrHistogram interval log to the
+// report, where the intervals are merged into one series per tag (untagged
+// intervals are labelled "default")
+//
+//	Notes
+//		A series is resized to the highest trackable value of its intervals,
+//		and spans the earliest start time and latest end time of its
+//		intervals. AddIntervalLog returns the number of values that were
+//		dropped because they couldn't be merged into their series
+//
+func (r *Report) AddIntervalLog(reader io.Reader) (dropped int64, err error) {
+	logReader := hdrhistogram.NewHistogramLogReader(reader)
+
+	var labels []string
+	merged := map[string]*hdrhistogram.Histogram{}
+
+	for {
+		interval, err := logReader.NextIntervalHistogram()
+		if err != nil {
+			return dropped, err
+		}
+		if interval == nil {
+			break
+		}
+
+		label := interval.Tag()
+		if label == "" {
+			label = "default"
+		}
+
+		hist, ok := merged[label]
+		if !ok {
+			hist = hdrhistogram.New(
+				interval.LowestTrackableValue(),
+				interval.HighestTrackableValue(),
+				int(interval.SignificantFigures()))
+			hist.SetTag(label)
+
+			merged[label] = hist
+			labels = append(labels, label)
+		} else if interval.HighestTrackableValue() > hist.HighestTrackableValue() {
+			resizeHistogram(hist, interval.HighestTrackableValue())
+		}
+
+		if start := interval.StartTimeMs(); start != 0 && (hist.StartTimeMs() == 0 || start < hist.StartTimeMs()) {
+			hist.SetStartTimeMs(start)
+		}
+		if end := interval.EndTimeMs(); end > hist.EndTimeMs() {
+			hist.SetEndTimeMs(end)
+		}
+
+		dropped += hist.Merge(interval)
+	}
+
+	for _, label := range labels {
+		r.addHistogram(label, merged[label])
+	}
+
+	return dropped, nil
+}
+
+// scale returns the value scaling ratio of the report, which defaults to the
+// ratio of the first series that has one
+func (r *Report) scale() float64 {
+	if r.ValueScale > 0 {
+		return r.ValueScale
+	}
+
+	for _, series := range r.series {
+		if series.ratio > 0 {
+			return series.ratio
+		}
+	}
+
+	return 1
+}
+
+// unit returns the unit label of the report, which defaults to the unit of
+// the first series that has one
+func (r *Report) unit() string {
+	if r.Unit != "" {
+		return r.Unit
+	}
+
+	for _, series := range r.series {
+		if series.unit != "" {
+			return string(series.unit)
+		}
+	}
+
+	return ""
+}
+
+// formatValue formats a (scaled) value for display
+func (r *Report) formatValue(value float64) string {
+	return strconv.FormatFloat(value/r.scale(), 'f', -1, 64)
+}
+
+// WriteSVG writes the percentile distribution chart of the report as a
+// standalone SVG document
+func (r *Report) WriteSVG(writer io.Writer) error {
+	var buf bytes.Buffer
+	r.writeSVG(&buf)
+
+	_, err := writer.Write(buf.Bytes())
+	return err
+}
+
+// writeSVG renders the percentile distribution chart
+func (r *Report) writeSVG(buf *bytes.Buffer) {
+	const left, right, top, bottom = 70, 20, 40, 50
+
+	// keep a minimum plot area, so a small (or zero) size still produces a
+	// valid chart
+	const minPlot = 100
+
+	width, height := r.Width, r.Height
+	if width < left+right+minPlot {
+		width = left + right + minPlot
+	}
+	if height < top+bottom+minPlot {
+		height = top + bottom + minPlot
+	}
+
+	plotWidth := float64(width - left - right)
+	plotHeight := float64(height - top - bottom)
+
+	// the x-axis spans whole decades of 1/(1-percentile), and the y-axis
+	// spans 0 to the largest max value
+	decades := 1
+	var maxValue int64 = 1
+	for _, series := range r.series {
+		for _, perc := range series.percentiles.Percentiles {
+			if perc.Percentile < 1.0 {
+				if x := int(math.Ceil(math.Log10(1.0 / (1.0 - perc.Percentile)))); x > decades {
+					decades = x
+				}
+			}
+		}
+		if series.percentiles.MaxValue > maxValue {
+			maxValue = series.percentiles.MaxValue
+		}
+	}
+
+	xOf := func(percentile float64) float64 {
+		x := float64(decades)
+		if percentile < 1.0 {
+			x = math.Min(math.Log10(1.0/(1.0-percentile)), x)
+		}
+		return left + x/float64(decades)*plotWidth
+	}
+	yOf := func(value int64) float64 {
+		return top + plotHeight - float64(value)/float64(maxValue)*plotHeight
+	}
+
+	fmt.Fprintf(buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="12">`+"\n",
+		width, height, width, height)
+	fmt.Fprintf(buf, `<rect width="%d" height="%d" fill="white"/>`+"\n", width, height)
+	fmt.Fprintf(buf, `<text x="%d" y="24" font-size="16" text-anchor="middle">%s</text>`+"\n", width/2, html.EscapeString(r.Title))
+
+	// x-axis grid lines and labels, one per decade
+	for decade := 0; decade <= decades; decade++ {
+		x := left + float64(decade)/float64(decades)*plotWidth
+		fmt.Fprintf(buf, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%.1f" stroke="#ddd"/>`+"\n", x, top, x, top+plotHeight)
+		fmt.Fprintf(buf, `<text x="%.1f" y="%.1f" text-anchor="middle">%s</text>`+"\n", x, top+plotHeight+18, decadeLabel(decade))
+	}
+	fmt.Fprintf(buf, `<text x="%.1f" y="%d" text-anchor="middle">Percentile</text>`+"\n", left+plotWidth/2, height-8)
+
+	// y-axis grid lines and labels
+	const yTicks = 5
+	for tick := 0; tick <= yTicks; tick++ {
+		value := maxValue * int64(tick) / yTicks
+		y := yOf(value)
+		fmt.Fprintf(buf, `<line x1="%d" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#ddd"/>`+"\n", left, y, left+plotWidth, y)
+		fmt.Fprintf(buf, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`+"\n", left-6, y+4, r.formatValue(float64(value)))
+	}
+	if unit := r.unit(); unit != "" {
+		fmt.Fprintf(buf, `<text x="14" y="%.1f" text-anchor="middle" transform="rotate(-90 14 %.1f)">%s</text>`+"\n",
+			top+plotHeight/2, top+plotHeight/2, html.EscapeString(unit))
+	}
+
+	// one step line per series
+	for i, series := range r.series {
+		color := reportColors[i%len(reportColors)]
+
+		fmt.Fprint(buf, `<polyline fill="none" stroke-width="2" stroke="`+color+`" points="`)
+		previous := yOf(0)
+		for j, perc := range series.percentiles.Percentiles {
+			x, y := xOf(perc.Percentile), yOf(perc.Value)
+			if j > 0 {
+				fmt.Fprintf(buf, " %.1f,%.1f", x, previous)
+			}
+			fmt.Fprintf(buf, " %.1f,%.1f", x, y)
+			previous = y
+		}
+		fmt.Fprint(buf, `"/>`+"\n")
+
+		// legend
+		fmt.Fprintf(buf, `<rect x="%d" y="%d" width="12" height="12" fill="%s"/>`+"\n", left+10, top+10+i*18, color)
+		fmt.Fprintf(buf, `<text x="%d" y="%d">%s</text>`+"\n", left+28, top+20+i*18, html.EscapeString(series.label))
+	}
+
+	fmt.Fprintf(buf, `<rect x="%d" y="%d" width="%.1f" height="%.1f" fill="none" stroke="#333"/>`+"\n", left, top, plotWidth, plotHeight)
+	fmt.Fprint(buf, "</svg>\n")
+}
+
+// WriteHTML writes the report as a standalone HTML document, containing the
+// percentile distribution chart and a summary table
+func (r *Report) WriteHTML(writer io.Writer) error {
+	var buf bytes.Buffer
+
+	title := html.EscapeString(r.Title)
+	fmt.Fprintf(&buf, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n", title)
+	fmt.Fprint(&buf, "<style>\n"+
+		"body { font-family: sans-serif; margin: 2em; }\n"+
+		"table { border-collapse: collapse; margin-top: 1em; }\n"+
+		"th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: right; }\n"+
+		"th:first-child, td:first-child { text-align: left; }\n"+
+		"</style>\n</head>\n<body>\n")
+	fmt.Fprintf(&buf, "<h1>%s</h1>\n", title)
+
+	r.writeSVG(&buf)
+
+	// summary table
+	fmt.Fprint(&buf, "<table>\n<tr><th>Name</th><th>Count</th><th>Min</th><th>Mean</th>")
+	for _, percentile := range reportPercentiles {
+		fmt.Fprintf(&buf, "<th>p%s</th>", strconv.FormatFloat(percentile, 'f', -1, 64))
+	}
+	fmt.Fprint(&buf, "<th>Max</th></tr>\n")
+
+	for _, series := range r.series {
+		fmt.Fprintf(&buf, "<tr><td>%s</td><td>%d</td><td>%s</td><td>%s</td>",
+			html.EscapeString(series.label),
+			series.hist.TotalCount(),
+			r.formatValue(float64(series.hist.Min())),
+			strconv.FormatFloat(series.hist.Mean()/r.scale(), 'f', 3, 64))
+		for _, percentile := range reportPercentiles {
+			fmt.Fprintf(&buf, "<td>%s</td>", r.formatValue(float64(series.hist.ValueAtQuantile(percentile))))
+		}
+		fmt.Fprintf(&buf, "<td>%s</td></tr>\n", r.formatValue(float64(series.hist.Max())))
+	}
+
+	fmt.Fprint(&buf, "</table>\n</body>\n</html>\n")
+
+	_, err := writer.Write(buf.Bytes())
+	return err
+}
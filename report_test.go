@@ -0,0 +1,159 @@
+package safehdrhistogram
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Report(t *testing.T) {
+	t.Run("Report HTML", func(t *testing.T) {
+		t.Parallel()
+
+		shdr := NewHistogram(1, 30000000, 3)
+		for value := int64(1); value <= 100; value++ {
+			shdr.Record(value)
+		}
+		snapshot := shdr.Snapshot(false)
+		shdr.Close()
+
+		report := NewReport("Latency <run 1>").AddSnapshot("get-user", snapshot).AddSnapshot("put-user", snapshot)
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, report.WriteHTML(&buf), "WriteHTML should not fail") {
+			return
+		}
+
+		output := buf.String()
+		if !assert.Contains(t, output, "<title>Latency &lt;run 1&gt;</title>", "the title should be escaped") {
+			return
+		}
+		if !assert.Equal(t, 2, strings.Count(output, "<polyline"), "there should be a line per series") {
+			return
+		}
+		if !assert.Contains(t, output, "<tr><td>get-user</td><td>100</td>", "the summary table should include the series") {
+			return
+		}
+	})
+
+	t.Run("Report Interval Log", func(t *testing.T) {
+		t.Parallel()
+
+		var log bytes.Buffer
+
+		// the intervals start a second apart and are a second long, and the
+		// last interval has a larger range than the first
+		for i := 0; i < 3; i++ {
+			highest := int64(1000)
+			if i == 2 {
+				highest = 30000000
+			}
+
+			interval := hdrhistogram.New(1, highest, 3)
+			_ = interval.RecordValue(int64(100 * (i + 1) * (i + 1) * (i + 1)))
+
+			payload, err := interval.Encode(hdrhistogram.V2CompressedEncodingCookieBase)
+			if !assert.NoError(t, err, "Encode should not fail") {
+				return
+			}
+
+			// the start time (in seconds) and interval length of each line are
+			// written directly, as HistogramLogWriter writes the start time in
+			// milliseconds
+			fmt.Fprintf(&log, "Tag=api,%d.000,1.000,%d.0,%s\n", 1600000000+i, interval.Max(), payload)
+		}
+
+		report := NewReport("Interval Log")
+		dropped, err := report.AddIntervalLog(&log)
+		if !assert.NoError(t, err, "AddIntervalLog should not fail") {
+			return
+		}
+		if !assert.Equal(t, int64(0), dropped, "the series should be resized so no values are dropped") {
+			return
+		}
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, report.WriteSVG(&buf), "WriteSVG should not fail") {
+			return
+		}
+
+		output := buf.String()
+		if !assert.True(t, strings.HasPrefix(output, "<svg "), "output should be an SVG document") {
+			return
+		}
+		if !assert.Equal(t, 1, strings.Count(output, "<polyline"), "intervals should be merged by tag") {
+			return
+		}
+		hist := report.series[0].hist
+		if !assert.Equal(t, int64(3), hist.TotalCount(), "every interval should be merged") {
+			return
+		}
+		if !assert.True(t, hist.ValuesAreEquivalent(2700, hist.Max()), "the largest value should be merged") {
+			return
+		}
+		if !assert.Equal(t, []int64{1600000000000, 1600000003000}, []int64{hist.StartTimeMs(), hist.EndTimeMs()}, "the series should span every interval") {
+			return
+		}
+	})
+
+	t.Run("Report Units", func(t *testing.T) {
+		t.Parallel()
+
+		// values recorded in microseconds, and displayed in milliseconds
+		hist := hdrhistogram.New(1, 30000000, 3)
+		_ = hist.RecordValue(1500)
+		snapshot := &Snapshot{Snapshot: hist.Export(), Unit: UnitMilliseconds, ValueUnitScalingRatio: 1000}
+
+		report := NewReport("Units").AddSnapshot("get", snapshot)
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, report.WriteHTML(&buf), "WriteHTML should not fail") {
+			return
+		}
+		if !assert.Contains(t, buf.String(), "<tr><td>get</td><td>1</td><td>1.5</td>", "the values should be scaled by the snapshot ratio") {
+			return
+		}
+		if !assert.Contains(t, buf.String(), ">ms</text>", "the values should be labelled with the snapshot unit") {
+			return
+		}
+
+		// the report fields override the snapshot
+		report.ValueScale, report.Unit = 1, "us"
+
+		buf.Reset()
+		if !assert.NoError(t, report.WriteHTML(&buf), "WriteHTML should not fail") {
+			return
+		}
+		if !assert.Contains(t, buf.String(), "<tr><td>get</td><td>1</td><td>1500</td>", "ValueScale should override the snapshot ratio") {
+			return
+		}
+		if !assert.Contains(t, buf.String(), ">us</text>", "Unit should override the snapshot unit") {
+			return
+		}
+	})
+
+	t.Run("Report Size", func(t *testing.T) {
+		t.Parallel()
+
+		hist := hdrhistogram.New(1, 30000000, 3)
+		_ = hist.RecordValue(100)
+
+		report := NewReport("Size").AddSnapshot("get", CreateSnapshot(hist))
+		report.Width, report.Height = 0, 10
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, report.WriteSVG(&buf), "WriteSVG should not fail") {
+			return
+		}
+		if !assert.Contains(t, buf.String(), `width="190" height="190"`, "the size should be increased to the minimum") {
+			return
+		}
+		if !assert.NotContains(t, buf.String(), `="-`, "no dimension should be negative") {
+			return
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package safehdrhistogram
+
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// ResizeEvent describes a histogram that was resized because a value
+// exceeded its highest trackable value (see HistogramConfig.AutoResize)
+type ResizeEvent struct {
+	// Tag is the tag of the histogram (the name for a HistogramMap)
+	Tag string `json:"tag"`
+	// Value is the value that triggered the resize
+	Value int64 `json:"value"`
+	// OldHighestTrackableValue is the highest trackable value before the
+	// resize
+	OldHighestTrackableValue int64 `json:"oldHighestTrackableValue"`
+	// NewHighestTrackableValue is the highest trackable value after the
+	// resize
+	NewHighestTrackableValue int64 `json:"newHighestTrackableValue"`
+	// Time is the time of the resize, in milliseconds since the epoch
+	Time int64 `json:"time"`
+}
+
+// record records n occurrences of a value to hist, resizing hist if the
+// value is too large and auto-resize is enabled
+func (p *processor) record(hist *hdrhistogram.Histogram, value, n int64) error {
+	err := hist.RecordValues(value, n)
+	if err == nil || !p.autoResize || value < 0 {
+		return err
+	}
+
+	oldHighest := hist.HighestTrackableValue()
+	newHighest := p.resizedHighest(oldHighest, value)
+	if newHighest <= oldHighest {
+		return err
+	}
+
+	resizeHistogram(hist, newHighest)
+	p.resized(hist.Tag(), value, oldHighest, newHighest)
+
+	// the value may still be out of range if the ceiling was reached
+	return hist.RecordValues(value, n)
+}
+
+// recordSparse records n occurrences of a value to a sparse histogram,
+// resizing it if the value is too large and auto-resize is enabled
+func (p *processor) recordSparse(hist *sparseHistogram, value, n int64) error {
+	err := hist.RecordValues(value, n)
+	if err == nil || !p.autoResize || value < 0 {
+		return err
+	}
+
+	oldHighest := hist.HighestTrackableValue()
+	newHighest := p.resizedHighest(oldHighest, value)
+	if newHighest <= oldHighest {
+		return err
+	}
+
+	hist.resize(newHighest)
+	p.resized(hist.tag, value, oldHighest, newHighest)
+
+	// the value may still be out of range if the ceiling was reached
+	return hist.RecordValues(value, n)
+}
+
+// resizedHighest returns the highest trackable value needed to record value,
+// by doubling oldHighest until the value fits, without exceeding the ceiling
+func (p *processor) resizedHighest(oldHighest, value int64) int64 {
+	newHighest := oldHighest
+	for newHighest < value {
+		if newHighest > math.MaxInt64/2 {
+			newHighest = math.MaxInt64
+			break
+		}
+		newHighest *= 2
+	}
+	if p.maxValue > 0 && newHighest > p.maxValue {
+		newHighest = p.maxValue
+	}
+
+	return newHighest
+}
+
+// resized counts a resize and calls onResize
+func (p *processor) resized(tag string, value, oldHighest, newHighest int64) {
+	atomic.AddInt64(&p.resizes, 1)
+
+	if p.onResize != nil {
+		p.onResize(ResizeEvent{
+			Tag:                      tag,
+			Value:                    value,
+			OldHighestTrackableValue: oldHighest,
+			NewHighestTrackableValue: newHighest,
+			Time:                     nowMs(p.clock),
+		})
+	}
+}
+
+// resizeHistogram replaces the contents of hist with a copy that has a
+// larger highest trackable value
+//
+//	Notes
+//		hist is updated in place, so references to it (such as those held by
+//		a HistogramMap, or queued commands) remain valid
+//
+func resizeHistogram(hist *hdrhistogram.Histogram, highestTrackableValue int64) {
+	resized := hdrhistogram.New(
+		hist.LowestTrackableValue(),
+		highestTrackableValue,
+		int(hist.SignificantFigures()))
+
+	resized.Merge(hist)
+	resized.SetStartTimeMs(hist.StartTimeMs())
+	resized.SetEndTimeMs(hist.EndTimeMs())
+	resized.SetTag(hist.Tag())
+
+	*hist = *resized
+}
@@ -0,0 +1,120 @@
+package safehdrhistogram
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AutoResize(t *testing.T) {
+	t.Run("AutoResize Histogram", func(t *testing.T) {
+		t.Parallel()
+
+		events := make(chan ResizeEvent, 10)
+		shdr := NewHistogramFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			AutoResize:                     true,
+			MaxTrackableValue:              100000,
+			OnResize:                       func(event ResizeEvent) { events <- event },
+		}).WithTag("latency")
+
+		shdr.Record(500)
+		shdr.Record(5000)
+
+		// values above the ceiling are dropped, after resizing to the ceiling
+		shdr.Record(200000)
+
+		snapshot := shdr.Snapshot(false)
+		hist := snapshot.ToHistogram()
+		if !assert.Equal(t, int64(2), hist.TotalCount(), "Two values should be recorded") {
+			return
+		}
+		if !assert.True(t, hist.ValuesAreEquivalent(500, hist.Min()), "The values recorded before the resize should be kept") {
+			return
+		}
+		if !assert.True(t, hist.ValuesAreEquivalent(5000, hist.Max()), "The value that triggered the resize should be recorded") {
+			return
+		}
+		if !assert.Equal(t, "latency", snapshot.Tag, "The tag should be kept") {
+			return
+		}
+
+		if !assert.Len(t, events, 2, "Two resizes should be reported") {
+			return
+		}
+		event := <-events
+		if !assert.Equal(t, ResizeEvent{
+			Tag:                      "latency",
+			Value:                    5000,
+			OldHighestTrackableValue: 1000,
+			NewHighestTrackableValue: 8000,
+			Time:                     event.Time,
+		}, event, "The first resize should double to fit the value") {
+			return
+		}
+		event = <-events
+		if !assert.Equal(t, int64(100000), event.NewHighestTrackableValue, "The second resize should stop at the ceiling") {
+			return
+		}
+
+		stats := shdr.Stats()
+		if !assert.Equal(t, int64(2), stats.Resizes, "Stats should report two resizes") {
+			return
+		}
+		if !assert.Equal(t, int64(1), stats.OutOfRangeRecords, "Stats should report one value out of range") {
+			return
+		}
+
+		if !assert.Equal(t, int64(100000), shdr.Close().HighestTrackableValue(), "The final histogram should be resized") {
+			return
+		}
+	})
+
+	t.Run("Out of Range Histogram", func(t *testing.T) {
+		t.Parallel()
+
+		shdr := NewHistogram(1, 1000, 3)
+		shdr.Record(5000)
+
+		if !assert.Equal(t, int64(0), shdr.Snapshot(false).ToHistogram().TotalCount(), "The value should be dropped") {
+			return
+		}
+
+		stats := shdr.Stats()
+		if !assert.Equal(t, int64(1), stats.OutOfRangeRecords, "Stats should report one value out of range") {
+			return
+		}
+		if !assert.Equal(t, int64(0), stats.Resizes, "Stats should report no resizes") {
+			return
+		}
+	})
+
+	t.Run("AutoResize HistogramMap", func(t *testing.T) {
+		t.Parallel()
+
+		hists := NewHistogramMapFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			AutoResize:                     true,
+		})
+
+		hists.Record(100, "a", "b")
+		hists.Record(3000, "b")
+
+		final := hists.Close()
+		if !assert.Equal(t, int64(1000), final["a"].HighestTrackableValue(), "a should not be resized") {
+			return
+		}
+		if !assert.Equal(t, int64(4000), final["b"].HighestTrackableValue(), "b should be resized") {
+			return
+		}
+		if !assert.Equal(t, int64(2), final["b"].TotalCount(), "b should have two values") {
+			return
+		}
+	})
+}
@@ -0,0 +1,351 @@
+package safehdrhistogram
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync/atomic"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// SignedHistogram is a concurrency safe histogram of signed values, such as
+// clock skew or balance deltas
+//
+//	Notes
+//		Values >= 0 are recorded to a positive hdrhistogram.Histogram, and the
+//		magnitudes of values < 0 are recorded to a negative
+//		hdrhistogram.Histogram. Both are processed by the same command
+//		processor, so snapshots, percentiles, and resets are consistent
+//		across both
+//
+type SignedHistogram struct {
+	pos    *hdrhistogram.Histogram
+	neg    *hdrhistogram.Histogram
+	config HistogramConfig
+	cmds   *commandQueue
+	proc   *processor
+	done   chan struct{}
+}
+
+// NewSignedHistogram creates a SignedHistogram that tracks values from
+// -highestTrackableValue to highestTrackableValue, where
+// lowestDiscernibleValue and highestTrackableValue are magnitudes
+func NewSignedHistogram(
+	lowestDiscernibleValue,
+	highestTrackableValue int64,
+	numberOfSignificantValueDigits int) *SignedHistogram {
+
+	// the configuration has no AppendLog, so it is always valid
+	hdr, _ := NewSignedHistogramFromConfig(
+		HistogramConfig{
+			LowestDiscernibleValue:         lowestDiscernibleValue,
+			HighestTrackableValue:          highestTrackableValue,
+			NumberOfSignificantValueDigits: numberOfSignificantValueDigits,
+			CommandBufferSize:              DefaultCommandBufferSize,
+		})
+
+	return hdr
+}
+
+// NewSignedHistogramFromConfig creates a SignedHistogram based on values
+// from a HistogramConfig, where LowestDiscernibleValue and
+// HighestTrackableValue are magnitudes
+//
+//	Notes
+//		ErrInvalidConfig is returned if config has an AppendLog, as the
+//		positive and negative histograms share a tag, so they can't be
+//		distinguished when the log is replayed
+//
+func NewSignedHistogramFromConfig(config HistogramConfig) (*SignedHistogram, error) {
+	if config.AppendLog != nil {
+		return nil, fmt.Errorf("%w: a SignedHistogram can't use an AppendLog", ErrInvalidConfig)
+	}
+
+	hdr := &SignedHistogram{
+		pos: hdrhistogram.New(
+			config.LowestDiscernibleValue,
+			config.HighestTrackableValue,
+			config.NumberOfSignificantValueDigits),
+		neg: hdrhistogram.New(
+			config.LowestDiscernibleValue,
+			config.HighestTrackableValue,
+			config.NumberOfSignificantValueDigits),
+		config: config,
+		done:   make(chan struct{}),
+		cmds:   newCommandQueue(config.CommandBufferSize),
+	}
+
+	// initialize both histograms. The command processor can't reference them
+	// until a command is queued, so it is safe to do this here
+	now := nowMs(config.clock())
+	hdr.pos.SetStartTimeMs(now)
+	hdr.neg.SetStartTimeMs(now)
+
+	// start the cmd processor
+	hdr.proc = process(hdr.cmds.cmds, hdr.done, config, func(now int64) {
+		hdr.pos.SetEndTimeMs(now)
+		hdr.neg.SetEndTimeMs(now)
+	})
+
+	return hdr, nil
+}
+
+// WithTag sets the tag associated with the SignedHistogram
+//
+//	Notes
+//		Like Histogram.WithTag, this method is not safe for concurrency
+//
+func (hdr *SignedHistogram) WithTag(tag string) *SignedHistogram {
+	hdr.pos.SetTag(tag)
+	hdr.neg.SetTag(tag)
+	return hdr
+}
+
+// Record requests that a value be recorded but will not block if the
+// channel is full
+//
+//	Notes
+//		Record will not block, so if the buffer is full the value is
+//		**dropped**. math.MinInt64 can't be recorded, and is also dropped
+//
+//		Record is a no-op once the SignedHistogram is closed
+//
+func (hdr *SignedHistogram) Record(value int64) {
+	hist := hdr.pos
+	if value < 0 {
+		if value == math.MinInt64 {
+			return
+		}
+
+		hist, value = hdr.neg, -value
+	}
+
+	hdr.cmds.trySend(command{
+		hist:    hist,
+		command: cmdRecord,
+		arg:     value,
+	})
+}
+
+// call queues f to be called on the processing go routine, and waits until
+// it has been called, or ctx is cancelled (or its deadline passes)
+//
+//	Notes
+//		f must reply on the (buffered) done channel, with false if the
+//		command was abandoned
+//
+func (hdr *SignedHistogram) call(ctx context.Context, f callFunc, done <-chan bool) error {
+	err := hdr.cmds.send(ctx, command{
+		command: cmdCall,
+		arg:     f,
+	})
+	if err != nil {
+		return err
+	}
+
+	return wait(ctx, done)
+}
+
+// reset resets both histograms (on the processing go routine)
+func (hdr *SignedHistogram) reset(p *processor) {
+	resetHistogram(hdr.pos, p.clock)
+	resetHistogram(hdr.neg, p.clock)
+}
+
+// Snapshot blocks until a snapshot request completes
+//
+//	Notes
+//		Snapshot returns nil if the SignedHistogram is closed
+//
+func (hdr *SignedHistogram) Snapshot(reset bool) *SignedSnapshot {
+	snapshot, _ := hdr.SnapshotContext(context.Background(), reset)
+	return snapshot
+}
+
+// SnapshotContext blocks until a snapshot request completes, or ctx is
+// cancelled (or its deadline passes)
+//
+//	Notes
+//		If ctx is done before the snapshot command is queued, the reset is
+//		not performed. Once queued, the snapshot (and reset) will be
+//		processed even if the caller gives up waiting
+//
+//		SnapshotContext returns ErrClosed if the SignedHistogram is closed
+//
+func (hdr *SignedHistogram) SnapshotContext(ctx context.Context, reset bool) (*SignedSnapshot, error) {
+	// the channels are buffered (and not closed) so processing never blocks
+	// if we stop waiting
+	var snapshot *SignedSnapshot
+	done := make(chan bool, 1)
+
+	err := hdr.call(ctx, func(p *processor, abandoned bool) {
+		if abandoned {
+			done <- false
+			return
+		}
+
+		snapshot = &SignedSnapshot{
+			Positive: p.snapshot(hdr.pos),
+			Negative: p.snapshot(hdr.neg),
+		}
+
+		if reset {
+			hdr.reset(p)
+		}
+
+		done <- true
+	}, done)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// Percentiles blocks until a percentiles snapshot request completes
+//
+//	Notes
+//		The percentiles span both the negative and positive values. If opts is
+//		nil, DefaultPercentilesOptions are used
+//
+//		Percentiles returns nil if the SignedHistogram is closed
+//
+func (hdr *SignedHistogram) Percentiles(reset bool, opts *PercentilesOptions) *Percentiles {
+	percentiles, _ := hdr.PercentilesContext(context.Background(), reset, opts)
+	return percentiles
+}
+
+// PercentilesContext blocks until a percentiles snapshot request completes,
+// or ctx is cancelled (or its deadline passes)
+//
+//	Notes
+//		The percentiles span both the negative and positive values. If opts is
+//		nil, DefaultPercentilesOptions are used
+//
+//		If ctx is done before the percentiles command is queued, the reset
+//		is not performed. Once queued, the percentiles (and reset) will be
+//		processed even if the caller gives up waiting
+//
+//		PercentilesContext returns ErrClosed if the SignedHistogram is closed
+//
+func (hdr *SignedHistogram) PercentilesContext(ctx context.Context, reset bool, opts *PercentilesOptions) (*Percentiles, error) {
+	var percentiles *Percentiles
+	done := make(chan bool, 1)
+
+	err := hdr.call(ctx, func(p *processor, abandoned bool) {
+		if abandoned {
+			done <- false
+			return
+		}
+
+		percentiles = signedPercentiles(hdr.pos, hdr.neg, opts)
+		percentiles.StartTime = hdr.pos.StartTimeMs()
+		percentiles.EndTime = nowMs(p.clock)
+		percentiles.Unit = p.unit
+		percentiles.ValueUnitScalingRatio = p.valueScale
+
+		if reset {
+			hdr.reset(p)
+		}
+
+		done <- true
+	}, done)
+	if err != nil {
+		return nil, err
+	}
+
+	return percentiles, nil
+}
+
+// Reset resets the histogram
+//
+//	Notes
+//		Reset waits for acknowledgement of the reset, and returns ErrClosed
+//		if the SignedHistogram is closed
+//
+func (hdr *SignedHistogram) Reset() error {
+	return hdr.ResetContext(context.Background())
+}
+
+// ResetContext resets the histogram
+//
+//	Notes
+//		ResetContext waits for acknowledgement of the reset, or until ctx is
+//		cancelled (or its deadline passes). Once queued, the reset will be
+//		processed even if the caller gives up waiting
+//
+//		ResetContext returns ErrClosed if the SignedHistogram is closed
+//
+func (hdr *SignedHistogram) ResetContext(ctx context.Context) error {
+	done := make(chan bool, 1)
+
+	return hdr.call(ctx, func(p *processor, abandoned bool) {
+		if !abandoned {
+			hdr.reset(p)
+		}
+
+		done <- !abandoned
+	}, done)
+}
+
+// Close closes the command channel, waits for all commands to be processed,
+// and returns the final positive and negative histograms
+//
+//	Notes
+//		Like Histogram.Close, Close returns the underlying histograms. Use
+//		Shutdown for a final SignedSnapshot
+//
+//		Close is safe to call more than once, and from multiple goroutines.
+//		Once closed, Record is a no-op and every other method returns
+//		ErrClosed (or nil)
+//
+func (hdr *SignedHistogram) Close() (pos, neg *hdrhistogram.Histogram) {
+	hdr.cmds.close()
+	<-hdr.done
+
+	return hdr.pos, hdr.neg
+}
+
+// Shutdown closes the command channel, processes the queued commands until
+// ctx is cancelled (or its deadline passes), and returns a final snapshot of
+// the histogram
+//
+//	Notes
+//		See Histogram.Shutdown
+//
+func (hdr *SignedHistogram) Shutdown(ctx context.Context) (final *SignedSnapshot, abandoned int, err error) {
+	// stop accepting commands
+	hdr.cmds.close()
+
+	// wait for the queued commands to be processed, or abandon them if ctx is
+	// done first
+	select {
+	case <-hdr.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+
+		hdr.proc.abandonQueue()
+		<-hdr.done
+	}
+
+	// processing has stopped, so the histograms are safe to access
+	final = &SignedSnapshot{
+		Positive: hdr.proc.snapshot(hdr.pos),
+		Negative: hdr.proc.snapshot(hdr.neg),
+	}
+
+	return final, int(atomic.LoadInt64(&hdr.proc.abandoned)), err
+}
+
+// Stats returns the runtime statistics of the command processor of the
+// SignedHistogram
+func (hdr *SignedHistogram) Stats() *Stats {
+	return hdr.proc.stats(hdr.cmds)
+}
+
+// Done returns a channel that is closed once the SignedHistogram is closed
+// and all queued commands have been processed
+func (hdr *SignedHistogram) Done() <-chan struct{} {
+	return hdr.done
+}
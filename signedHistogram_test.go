@@ -0,0 +1,211 @@
+package safehdrhistogram
+
+import (
+	"context"
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SignedHistogram(t *testing.T) {
+	t.Run("Record SignedHistogram", func(t *testing.T) {
+		t.Parallel()
+
+		shdr, err := NewSignedHistogramFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          100000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              1024,
+		})
+		if !assert.NoError(t, err, "NewSignedHistogramFromConfig should not fail") {
+			return
+		}
+		shdr.WithTag("skew")
+
+		// -100..-1, 0, 1..100
+		for value := int64(-100); value <= 100; value++ {
+			shdr.Record(value)
+		}
+
+		// math.MinInt64 can't be recorded
+		shdr.Record(math.MinInt64)
+
+		snapshot := shdr.Snapshot(false)
+		if !assert.Equal(t, int64(201), snapshot.TotalCount(), "201 values should be recorded") {
+			return
+		}
+		if !assert.Equal(t, int64(-100), snapshot.Min(), "Min should be -100") {
+			return
+		}
+		if !assert.Equal(t, int64(100), snapshot.Max(), "Max should be 100") {
+			return
+		}
+		if !assert.InDelta(t, 0, snapshot.Mean(), 0.01, "Mean should be 0") {
+			return
+		}
+		if !assert.Equal(t, int64(0), snapshot.ValueAtPercentile(50), "p50 should be 0") {
+			return
+		}
+		if !assert.Equal(t, int64(-51), snapshot.ValueAtPercentile(25), "p25 should be -51") {
+			return
+		}
+		if !assert.Equal(t, int64(50), snapshot.ValueAtPercentile(75), "p75 should be 50") {
+			return
+		}
+
+		percentiles := shdr.Percentiles(false, &PercentilesOptions{
+			Percentiles: []float64{1, 50, 100},
+			IncludeMean: true,
+		})
+		if !assert.Equal(t, "skew", percentiles.Tag, "Percentiles should have the tag") {
+			return
+		}
+		if !assert.Equal(t, int64(-100), percentiles.MinValue, "MinValue should be -100") {
+			return
+		}
+		if !assert.Equal(t, int64(100), percentiles.MaxValue, "MaxValue should be 100") {
+			return
+		}
+		if !assert.Len(t, percentiles.Percentiles, 3, "There should be three percentiles") {
+			return
+		}
+		if !assert.Equal(t, int64(-99), percentiles.Percentiles[0].Value, "p1 should be -99") {
+			return
+		}
+		if !assert.Equal(t, int64(0), percentiles.Percentiles[1].Value, "p50 should be 0") {
+			return
+		}
+		if !assert.Equal(t, int64(100), percentiles.Percentiles[2].Value, "p100 should be 100") {
+			return
+		}
+		if !assert.Equal(t, int64(201), percentiles.Percentiles[2].Count, "p100 should count every value") {
+			return
+		}
+		if !assert.InDelta(t, 0, *percentiles.Mean, 0.01, "Mean should be 0") {
+			return
+		}
+
+		// percentiles of the snapshot match the histogram
+		if !assert.Equal(t, percentiles.Percentiles, snapshot.Percentiles(&PercentilesOptions{
+			Percentiles: []float64{1, 50, 100},
+		}).Percentiles, "Snapshot percentiles should match") {
+			return
+		}
+
+		if !assert.NoError(t, shdr.Reset(), "Reset should not fail") {
+			return
+		}
+
+		shdr.Record(-7)
+
+		final, abandoned, err := shdr.Shutdown(context.Background())
+		if !assert.NoError(t, err, "Shutdown should not fail") {
+			return
+		}
+		if !assert.Equal(t, 0, abandoned, "No commands should be abandoned") {
+			return
+		}
+		if !assert.Equal(t, int64(1), final.TotalCount(), "Only -7 should be recorded after Reset") {
+			return
+		}
+		if !assert.Equal(t, int64(-7), final.Max(), "Max should be -7") {
+			return
+		}
+		if !assert.NotZero(t, final.Positive.EndTime, "Shutdown should set the end time") {
+			return
+		}
+		if !assert.Nil(t, shdr.Snapshot(false), "Snapshot() after Shutdown should be nil") {
+			return
+		}
+		if !assert.Equal(t, ErrClosed, shdr.Reset(), "Reset() after Shutdown should be ErrClosed") {
+			return
+		}
+
+		pos, neg := shdr.Close()
+		if !assert.Equal(t, []int64{0, 1}, []int64{pos.TotalCount(), neg.TotalCount()}, "Close should return the final histograms") {
+			return
+		}
+	})
+
+	t.Run("Positive values match Histogram", func(t *testing.T) {
+		t.Parallel()
+
+		shdr, err := NewSignedHistogramFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          100000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              1024,
+		})
+		if !assert.NoError(t, err, "NewSignedHistogramFromConfig should not fail") {
+			return
+		}
+		hist := hdrhistogram.New(1, 100000, 3)
+
+		for value := int64(1); value <= 1000; value += 3 {
+			shdr.Record(value)
+			_ = hist.RecordValue(value)
+		}
+
+		opts := &PercentilesOptions{
+			Percentiles:   []float64{50, 90, 99, 99.9},
+			IncludeMean:   true,
+			IncludeStdDev: true,
+			IncludeSum:    true,
+		}
+
+		expected := CreatePercentilesWithOptions(hist, opts)
+		actual := shdr.Percentiles(false, opts)
+
+		if !assert.Equal(t, expected.Percentiles, actual.Percentiles, "Percentiles should match") {
+			return
+		}
+		if !assert.Equal(t, expected.MinValue, actual.MinValue, "MinValue should match") {
+			return
+		}
+		if !assert.Equal(t, expected.MaxValue, actual.MaxValue, "MaxValue should match") {
+			return
+		}
+		if !assert.InDelta(t, *expected.Mean, *actual.Mean, 0.001, "Mean should match") {
+			return
+		}
+		if !assert.InDelta(t, *expected.StdDev, *actual.StdDev, 0.001, "StdDev should match") {
+			return
+		}
+
+		// the ticks of the distribution match too
+		ticks := &PercentilesOptions{TicksPerHalfDistance: 5}
+		if !assert.Equal(t,
+			CreatePercentilesWithOptions(hist, ticks).Percentiles,
+			shdr.Percentiles(false, ticks).Percentiles,
+			"Ticks should match") {
+			return
+		}
+
+		shdr.Close()
+	})
+
+	t.Run("AppendLog", func(t *testing.T) {
+		t.Parallel()
+
+		log, err := OpenAppendLog(filepath.Join(t.TempDir(), "skew.log"), nil)
+		if !assert.NoError(t, err, "OpenAppendLog should not fail") {
+			return
+		}
+		defer log.Close()
+
+		_, err = NewSignedHistogramFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          100000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			AppendLog:                      log,
+		})
+		if !assert.True(t, errors.Is(err, ErrInvalidConfig), "an AppendLog should be rejected") {
+			return
+		}
+	})
+}
@@ -0,0 +1,303 @@
+package safehdrhistogram
+
+import (
+	"math"
+	"sort"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// SignedSnapshot represents a snapshot of a SignedHistogram
+//
+//	Notes
+//		Negative holds the magnitudes of the negative values, so a recorded
+//		value of -5 is recorded to Negative as 5
+//
+type SignedSnapshot struct {
+	// Positive is a snapshot of the values >= 0
+	Positive *Snapshot
+	// Negative is a snapshot of the magnitudes of the values < 0
+	Negative *Snapshot
+}
+
+// histograms returns the positive and negative histograms of the snapshot
+func (snapshot *SignedSnapshot) histograms() (pos, neg *hdrhistogram.Histogram) {
+	return snapshot.Positive.ToHistogram(), snapshot.Negative.ToHistogram()
+}
+
+// TotalCount returns the number of recorded values
+func (snapshot *SignedSnapshot) TotalCount() int64 {
+	pos, neg := snapshot.histograms()
+	return pos.TotalCount() + neg.TotalCount()
+}
+
+// Min returns the (approximate) lowest recorded value
+func (snapshot *SignedSnapshot) Min() int64 {
+	return signedMin(snapshot.histograms())
+}
+
+// Max returns the (approximate) highest recorded value
+func (snapshot *SignedSnapshot) Max() int64 {
+	return signedMax(snapshot.histograms())
+}
+
+// Mean returns the (approximate) mean of the recorded values
+func (snapshot *SignedSnapshot) Mean() float64 {
+	return signedMean(signedBars(snapshot.histograms()))
+}
+
+// ValueAtPercentile returns the (approximate) value at percentile (expressed
+// as 0 to 100, e.g. 99.9)
+func (snapshot *SignedSnapshot) ValueAtPercentile(percentile float64) int64 {
+	return signedValueAt(signedBars(snapshot.histograms()), percentile)
+}
+
+// Percentiles creates Percentiles from the snapshot using the specified
+// options, where the percentiles span both the negative and positive values
+//
+//	Notes
+//		If opts is nil, DefaultPercentilesOptions are used
+//
+func (snapshot *SignedSnapshot) Percentiles(opts *PercentilesOptions) *Percentiles {
+	pos, neg := snapshot.histograms()
+
+	result := signedPercentiles(pos, neg, opts)
+	result.StartTime = snapshot.Positive.StartTime
+	result.EndTime = snapshot.Positive.EndTime
+	result.Unit = snapshot.Positive.Unit
+	result.ValueUnitScalingRatio = snapshot.Positive.ValueUnitScalingRatio
+
+	return result
+}
+
+// signedBar is a range of signed values, and the number of recorded values in
+// the range
+type signedBar struct {
+	// to is the highest value of the range (the lowest equivalent value of
+	// the magnitude for negative values), and median is the median
+	// equivalent value of the range
+	to, median, count int64
+}
+
+// signedBars returns the non-empty bars of neg (as negative values) and pos,
+// ordered lowest value to highest
+func signedBars(pos, neg *hdrhistogram.Histogram) (result []signedBar) {
+	negDist := neg.Distribution()
+	for i := len(negDist) - 1; i >= 0; i-- {
+		if bar := negDist[i]; bar.Count != 0 {
+			result = append(result, signedBar{
+				to:     -bar.From,
+				median: -(bar.From + (bar.To-bar.From+1)/2),
+				count:  bar.Count,
+			})
+		}
+	}
+
+	for _, bar := range pos.Distribution() {
+		if bar.Count != 0 {
+			result = append(result, signedBar{
+				to:     bar.To,
+				median: bar.From + (bar.To-bar.From+1)/2,
+				count:  bar.Count,
+			})
+		}
+	}
+
+	return
+}
+
+// totalOf returns the number of values in bars
+func totalOf(bars []signedBar) (total int64) {
+	for _, bar := range bars {
+		total += bar.count
+	}
+
+	return
+}
+
+// signedMin returns the lowest value of the positive and negative histograms
+func signedMin(pos, neg *hdrhistogram.Histogram) int64 {
+	if neg.TotalCount() > 0 {
+		return -neg.Max()
+	}
+
+	return pos.Min()
+}
+
+// signedMax returns the highest value of the positive and negative histograms
+func signedMax(pos, neg *hdrhistogram.Histogram) int64 {
+	if pos.TotalCount() > 0 || neg.TotalCount() == 0 {
+		return pos.Max()
+	}
+
+	return -neg.Min()
+}
+
+// signedMean returns the mean of bars, using the median equivalent value of
+// each bar (which is consistent with Histogram.Mean)
+func signedMean(bars []signedBar) float64 {
+	total := totalOf(bars)
+	if total == 0 {
+		return 0
+	}
+
+	var sum int64
+	for _, bar := range bars {
+		sum += bar.count * bar.median
+	}
+
+	return float64(sum) / float64(total)
+}
+
+// signedStdDev returns the standard deviation of bars (which is consistent
+// with Histogram.StdDev)
+func signedStdDev(bars []signedBar) float64 {
+	total := totalOf(bars)
+	if total == 0 {
+		return 0
+	}
+
+	mean := signedMean(bars)
+
+	var devTotal float64
+	for _, bar := range bars {
+		dev := float64(bar.median) - mean
+		devTotal += dev * dev * float64(bar.count)
+	}
+
+	return math.Sqrt(devTotal / float64(total))
+}
+
+// signedValueAt returns the value at percentile (expressed as 0 to 100) of
+// bars (which is consistent with Histogram.ValueAtQuantile)
+func signedValueAt(bars []signedBar, percentile float64) int64 {
+	if percentile > 100 {
+		percentile = 100
+	}
+
+	countAtPercentile := int64(percentile/100*float64(totalOf(bars)) + 0.5)
+	if countAtPercentile < 1 {
+		countAtPercentile = 1
+	}
+
+	var count int64
+	for _, bar := range bars {
+		count += bar.count
+		if count >= countAtPercentile {
+			return bar.to
+		}
+	}
+
+	return 0
+}
+
+// signedPercentiles creates Percentiles that span the values of the positive
+// and negative histograms (which is consistent with createPercentiles)
+//
+//	Notes
+//		The tag is taken from pos, and the start and end times are not set
+//
+func signedPercentiles(pos, neg *hdrhistogram.Histogram, opts *PercentilesOptions) (result *Percentiles) {
+	if opts == nil {
+		opts = &DefaultPercentilesOptions
+	}
+
+	bars := signedBars(pos, neg)
+	total := totalOf(bars)
+
+	result = &Percentiles{
+		MinValue:   signedMin(pos, neg),
+		MaxValue:   signedMax(pos, neg),
+		TotalCount: total,
+		Tag:        pos.Tag(),
+	}
+
+	if len(opts.Percentiles) > 0 {
+		for _, percentile := range opts.Percentiles {
+			value := signedValueAt(bars, percentile)
+
+			var count int64
+			for _, bar := range bars {
+				if bar.to > value {
+					break
+				}
+				count += bar.count
+			}
+
+			result.Percentiles = append(
+				result.Percentiles,
+				Percentile{
+					Percentile: percentile / 100.0,
+					Value:      value,
+					Count:      count,
+				})
+		}
+
+		// keep the percentiles ordered lowest to highest
+		sort.SliceStable(result.Percentiles, func(i, j int) bool {
+			return result.Percentiles[i].Percentile < result.Percentiles[j].Percentile
+		})
+	} else {
+		result.Percentiles = signedTicks(bars, total, opts.TicksPerHalfDistance)
+	}
+
+	if opts.IncludeMean {
+		mean := signedMean(bars)
+		result.Mean = &mean
+	}
+
+	if opts.IncludeStdDev {
+		stdDev := signedStdDev(bars)
+		result.StdDev = &stdDev
+	}
+
+	if opts.IncludeSum {
+		var sum int64
+		for _, bar := range bars {
+			sum += bar.count * bar.median
+		}
+		result.Sum = &sum
+	}
+
+	return
+}
+
+// signedTicks reports the percentiles of bars using ticks per half distance
+// to 100% (which is consistent with
+// Histogram.CumulativeDistributionWithTicks)
+func signedTicks(bars []signedBar, total int64, ticks int32) (result []Percentile) {
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	var count, value int64
+	var percentileTo float64
+
+	for _, bar := range bars {
+		count += bar.count
+		value = bar.to
+
+		// report every tick that the bar reaches, but only one for the bar
+		// that reaches the total count (which is followed by 100%)
+		for percentileTo <= 100.0*float64(count)/float64(total) {
+			result = append(result, Percentile{
+				Percentile: percentileTo / 100.0,
+				Value:      value,
+				Count:      count,
+			})
+
+			halfDistance := math.Trunc(math.Pow(2, math.Trunc(math.Log2(100.0/(100.0-percentileTo)))+1))
+			percentileTo += 100.0 / (float64(ticks) * halfDistance)
+
+			if count == total {
+				break
+			}
+		}
+	}
+
+	return append(result, Percentile{
+		Percentile: 1.0,
+		Value:      value,
+		Count:      count,
+	})
+}
@@ -1,8 +1,6 @@
 package safehdrhistogram
 
 import (
-	"time"
-
 	"github.com/HdrHistogram/hdrhistogram-go"
 )
 
@@ -15,6 +13,10 @@ type Snapshot struct {
 	StartTime int64
 	EndTime   int64
 	Tag       string
+	Unit      Unit
+	// ValueUnitScalingRatio is the ratio by which recorded values are
+	// divided to convert them to Unit (see HistogramConfig)
+	ValueUnitScalingRatio float64
 }
 
 // ToHistogram converts an Snapshot to a hdrhistogram.Histogram
@@ -27,11 +29,43 @@ func (snapshot *Snapshot) ToHistogram() (result *hdrhistogram.Histogram) {
 }
 
 // CreateSnapshot creates an instance of Snapshot from a hdrhistogram.Histogram
+//
+//	Notes
+//		The EndTime of the snapshot is the current time of SystemClock
+//
 func CreateSnapshot(hist *hdrhistogram.Histogram) *Snapshot {
+	return createSnapshot(hist, SystemClock)
+}
+
+// createSnapshot creates an instance of Snapshot from a
+// hdrhistogram.Histogram, where the EndTime is the current time of clock
+func createSnapshot(hist *hdrhistogram.Histogram, clock Clock) *Snapshot {
 	return &Snapshot{
 		Snapshot:  hist.Export(),
 		StartTime: hist.StartTimeMs(),
-		EndTime:   time.Now().UTC().UnixNano() / 1e6,
+		EndTime:   nowMs(clock),
 		Tag:       hist.Tag(),
 	}
 }
+
+// empty returns true if the snapshot has no values
+func (snapshot *Snapshot) empty() bool {
+	for _, count := range snapshot.Snapshot.Counts {
+		if count != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// percentiles creates an instance of Percentiles from the snapshot using the
+// specified options, keeping the EndTime of the snapshot
+func (snapshot *Snapshot) percentiles(opts *PercentilesOptions) *Percentiles {
+	result := CreatePercentilesWithOptions(snapshot.ToHistogram(), opts)
+	result.EndTime = snapshot.EndTime
+	result.Unit = snapshot.Unit
+	result.ValueUnitScalingRatio = snapshot.ValueUnitScalingRatio
+
+	return result
+}
@@ -0,0 +1,234 @@
+package safehdrhistogram
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+const (
+	// sparseHistogramBytes is the (approximate) size of a sparseHistogram
+	// with no counts
+	sparseHistogramBytes = 16 * 8
+	// sparseBucketBytes is the (approximate) size of each occupied bucket,
+	// allowing for the overhead of the map
+	sparseBucketBytes = 24
+)
+
+// sparseHistogram is a memory-compact histogram that only stores the counts
+// of occupied buckets (see HistogramConfig.Sparse)
+//
+//	Notes
+//		The buckets are identical to those of the equivalent (dense)
+//		hdrhistogram.Histogram, so a sparseHistogram accepts exactly the
+//		values the dense histogram does, and converts to it losslessly (see
+//		histogram)
+//
+//		Like hdrhistogram.Histogram, a sparseHistogram is not safe for
+//		concurrent use and is only accessed by the command processor
+//
+type sparseHistogram struct {
+	lowestDiscernibleValue         int64
+	highestTrackableValue          int64
+	numberOfSignificantValueDigits int
+
+	// the layout of the buckets (see hdrhistogram.New)
+	unitMagnitude               uint
+	subBucketHalfCountMagnitude uint
+	subBucketMask               int64
+	countsLen                   int64
+
+	// counts is the count of each occupied bucket, by the lowest equivalent
+	// value of the bucket
+	counts      map[int64]int64
+	totalCount  int64
+	startTimeMs int64
+	endTimeMs   int64
+	tag         string
+}
+
+// newSparseHistogram creates a sparseHistogram with the same buckets as
+// hdrhistogram.New
+func newSparseHistogram(
+	lowestDiscernibleValue,
+	highestTrackableValue int64,
+	numberOfSignificantValueDigits int) *sparseHistogram {
+
+	hist := &sparseHistogram{
+		lowestDiscernibleValue:         lowestDiscernibleValue,
+		highestTrackableValue:          highestTrackableValue,
+		numberOfSignificantValueDigits: numberOfSignificantValueDigits,
+		counts:                         map[int64]int64{},
+	}
+
+	hist.layout()
+
+	return hist
+}
+
+// layout calculates the layout of the buckets, as hdrhistogram.New does
+func (hist *sparseHistogram) layout() {
+	digits := hist.numberOfSignificantValueDigits
+	if digits < 1 {
+		digits = 1
+	} else if digits > 5 {
+		digits = 5
+	}
+
+	lowest := hist.lowestDiscernibleValue
+	if lowest < 1 {
+		lowest = 1
+	}
+
+	largestValueWithSingleUnitResolution := 2 * math.Pow10(digits)
+
+	subBucketCountMagnitude := int32(math.Ceil(math.Log2(largestValueWithSingleUnitResolution)))
+	subBucketHalfCountMagnitude := subBucketCountMagnitude
+	if subBucketHalfCountMagnitude < 1 {
+		subBucketHalfCountMagnitude = 1
+	}
+	subBucketHalfCountMagnitude--
+
+	unitMagnitude := int32(math.Floor(math.Log2(float64(lowest))))
+	if unitMagnitude < 0 {
+		unitMagnitude = 0
+	}
+
+	subBucketCount := int64(1) << uint(subBucketHalfCountMagnitude+1)
+
+	// determine the number of buckets needed to cover the highest trackable
+	// value
+	bucketCount := int64(1)
+	smallestUntrackableValue := subBucketCount << uint(unitMagnitude)
+	for smallestUntrackableValue < hist.highestTrackableValue {
+		if smallestUntrackableValue > math.MaxInt64/2 {
+			bucketCount++
+			break
+		}
+		smallestUntrackableValue <<= 1
+		bucketCount++
+	}
+
+	hist.unitMagnitude = uint(unitMagnitude)
+	hist.subBucketHalfCountMagnitude = uint(subBucketHalfCountMagnitude)
+	hist.subBucketMask = (subBucketCount - 1) << uint(unitMagnitude)
+	hist.countsLen = (bucketCount + 1) * (subBucketCount / 2)
+}
+
+// bucketOf returns the counts index and lowest equivalent value of the
+// bucket for value
+func (hist *sparseHistogram) bucketOf(value int64) (index, lowest int64) {
+	bucketIdx := int64(bitLen(value|hist.subBucketMask)) -
+		int64(hist.unitMagnitude) - int64(hist.subBucketHalfCountMagnitude+1)
+	shift := uint(bucketIdx + int64(hist.unitMagnitude))
+	subBucketIdx := value >> shift
+
+	index = (bucketIdx+1)<<hist.subBucketHalfCountMagnitude +
+		subBucketIdx - int64(1)<<hist.subBucketHalfCountMagnitude
+
+	return index, subBucketIdx << shift
+}
+
+// bitLen returns the number of bits required to represent x
+func bitLen(x int64) int {
+	n := 0
+	for ux := uint64(x); ux != 0; ux >>= 1 {
+		n++
+	}
+
+	return n
+}
+
+// RecordValue records a value, or returns an error if the value is out of
+// range
+func (hist *sparseHistogram) RecordValue(value int64) error {
+	return hist.RecordValues(value, 1)
+}
+
+// RecordValues records n occurrences of a value, or returns an error if the
+// value is out of range
+func (hist *sparseHistogram) RecordValues(value, n int64) error {
+	if value < 0 {
+		return fmt.Errorf("value %d is too large to be recorded", value)
+	}
+
+	index, lowest := hist.bucketOf(value)
+	if index < 0 || index >= hist.countsLen {
+		return fmt.Errorf("value %d is too large to be recorded", value)
+	}
+
+	hist.counts[lowest] += n
+	hist.totalCount += n
+
+	return nil
+}
+
+// merge records the values of a (dense) histogram, and returns the number
+// of values that were out of range
+func (hist *sparseHistogram) merge(from *hdrhistogram.Histogram) (dropped int64) {
+	for _, bar := range from.Distribution() {
+		if bar.Count == 0 {
+			continue
+		}
+
+		if err := hist.RecordValues(bar.From, bar.Count); err != nil {
+			dropped += bar.Count
+		}
+	}
+
+	return dropped
+}
+
+// TotalCount returns the number of recorded values
+func (hist *sparseHistogram) TotalCount() int64 {
+	return hist.totalCount
+}
+
+// ByteSize returns an estimate of the memory used by the histogram in bytes
+func (hist *sparseHistogram) ByteSize() int {
+	return sparseHistogramBytes + len(hist.counts)*sparseBucketBytes
+}
+
+// HighestTrackableValue returns the highest trackable value of the histogram
+func (hist *sparseHistogram) HighestTrackableValue() int64 {
+	return hist.highestTrackableValue
+}
+
+// resize changes the highest trackable value of the histogram
+//
+//	Notes
+//		Unlike a dense histogram, the counts are not copied as the buckets of
+//		the existing values do not change
+//
+func (hist *sparseHistogram) resize(highestTrackableValue int64) {
+	hist.highestTrackableValue = highestTrackableValue
+	hist.layout()
+}
+
+// reset clears the counts and restarts the time interval at startTimeMs
+func (hist *sparseHistogram) reset(startTimeMs int64) {
+	hist.counts = map[int64]int64{}
+	hist.totalCount = 0
+	hist.startTimeMs = startTimeMs
+}
+
+// histogram returns a (dense) hdrhistogram.Histogram with the same values,
+// times, and tag
+func (hist *sparseHistogram) histogram() *hdrhistogram.Histogram {
+	result := hdrhistogram.New(
+		hist.lowestDiscernibleValue,
+		hist.highestTrackableValue,
+		hist.numberOfSignificantValueDigits)
+
+	for value, count := range hist.counts {
+		// the buckets are the same, so the value is always in range
+		_ = result.RecordValues(value, count)
+	}
+
+	result.SetStartTimeMs(hist.startTimeMs)
+	result.SetEndTimeMs(hist.endTimeMs)
+	result.SetTag(hist.tag)
+
+	return result
+}
@@ -0,0 +1,145 @@
+package safehdrhistogram
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SparseHistogram(t *testing.T) {
+	t.Run("Sparse matches dense", func(t *testing.T) {
+		t.Parallel()
+
+		for _, config := range []struct {
+			lowest, highest int64
+			digits          int
+		}{
+			{1, 3600000000, 3},
+			{1000, 3600000000, 2},
+			{1, 1000, 5},
+			{7, 100000, 1},
+		} {
+			hist := hdrhistogram.New(config.lowest, config.highest, config.digits)
+			sparse := newSparseHistogram(config.lowest, config.highest, config.digits)
+
+			random := rand.New(rand.NewSource(42))
+			for i := 0; i < 10000; i++ {
+				value := random.Int63n(config.highest * 2)
+
+				err := hist.RecordValue(value)
+				if !assert.Equal(t, err == nil, sparse.RecordValue(value) == nil, "Value %d should be in range for both", value) {
+					return
+				}
+			}
+
+			if !assert.True(t, hist.Equals(sparse.histogram()), "The histograms should be equal") {
+				return
+			}
+			if !assert.Less(t, len(sparse.counts), len(hist.Export().Counts), "Only occupied buckets should be stored") {
+				return
+			}
+		}
+	})
+
+	t.Run("Sparse HistogramMap", func(t *testing.T) {
+		t.Parallel()
+
+		config := HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              1024,
+		}
+
+		dense := NewHistogramMapFromConfig(config)
+
+		config.Sparse = true
+		sparse := NewHistogramMapFromConfig(config)
+
+		for value := int64(0); value < 500; value++ {
+			dense.Record(value*value, "a", "b")
+			sparse.Record(value*value, "a", "b")
+		}
+
+		// out of range for both
+		dense.Record(2000000, "a")
+		sparse.Record(2000000, "a")
+
+		expected := dense.Snapshot("a", false)
+		actual := sparse.Snapshot("a", true)
+		if !assert.Equal(t, expected.Snapshot, actual.Snapshot, "The snapshots should be equal") {
+			return
+		}
+		if !assert.Equal(t, "a", actual.Tag, "The snapshot should have the tag") {
+			return
+		}
+		if !assert.Equal(t,
+			dense.Percentiles("b", false, nil).Percentiles,
+			sparse.Percentiles("b", false, nil).Percentiles,
+			"The percentiles should be equal") {
+			return
+		}
+		if !assert.Equal(t, int64(1), sparse.Stats().OutOfRangeRecords, "The out of range value should be counted") {
+			return
+		}
+
+		// a was reset by the snapshot
+		if !assert.Equal(t, int64(0), sparse.Snapshot("a", false).ToHistogram().TotalCount(), "a should be reset") {
+			return
+		}
+
+		if !assert.NoError(t, sparse.ResetAll(), "ResetAll should not fail") {
+			return
+		}
+		sparse.Record(42, "b")
+
+		dense.Close()
+		final := sparse.Close()
+		if !assert.Len(t, final, 2, "Close should return both histograms") {
+			return
+		}
+		if !assert.Equal(t, int64(1), final["b"].TotalCount(), "b should have one value") {
+			return
+		}
+		if !assert.NotZero(t, final["b"].EndTimeMs(), "Close should set the end time") {
+			return
+		}
+		if !assert.Equal(t, int64(1), sparse.Close()["b"].TotalCount(), "Close should be repeatable") {
+			return
+		}
+	})
+
+	t.Run("Sparse AutoResize", func(t *testing.T) {
+		t.Parallel()
+
+		hdrs := NewHistogramMapFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			AutoResize:                     true,
+			Sparse:                         true,
+		})
+
+		hdrs.Record(500, "a")
+		hdrs.Record(5000, "a")
+
+		hist := hdrs.Snapshot("a", false).ToHistogram()
+		if !assert.Equal(t, int64(2), hist.TotalCount(), "Two values should be recorded") {
+			return
+		}
+		if !assert.Equal(t, int64(8000), hist.HighestTrackableValue(), "The histogram should double to fit the value") {
+			return
+		}
+		if !assert.True(t, hist.ValuesAreEquivalent(5000, hist.Max()), "The value that triggered the resize should be recorded") {
+			return
+		}
+		if !assert.Equal(t, int64(1), hdrs.Stats().Resizes, "One resize should be counted") {
+			return
+		}
+
+		hdrs.Close()
+	})
+}
@@ -0,0 +1,115 @@
+package safehdrhistogram
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+const (
+	// maxLatency is the highest command processing latency (in nanoseconds)
+	// that is tracked by Stats. Higher latencies are recorded as maxLatency
+	maxLatency = int64(time.Minute)
+)
+
+// Stats reports the runtime statistics of the command processor of a
+// Histogram or HistogramMap, and is intended to help size the command buffer
+// (see HistogramConfig.CommandBufferSize)
+//
+//	Notes
+//		Stats are cumulative from the creation of the Histogram or
+//		HistogramMap, with the exception of QueueLength
+//
+type Stats struct {
+	// QueueLength is the number of commands currently queued
+	QueueLength int `json:"queueLength"`
+	// QueueCapacity is the size of the command buffer
+	QueueCapacity int `json:"queueCapacity"`
+	// HighWaterMark is the highest number of commands that have been queued
+	HighWaterMark int `json:"highWaterMark"`
+	// Processed is the number of commands processed, by command type
+	// (start, record, snapshot, percentiles, reset, sync, and call)
+	Processed map[string]int64 `json:"processed"`
+	// Abandoned is the number of commands that were abandoned by Shutdown
+	Abandoned int64 `json:"abandoned"`
+	// DroppedRecords is the number of values that were not recorded because
+	// the command buffer was full
+	DroppedRecords int64 `json:"droppedRecords"`
+	// OutOfRangeRecords is the number of values that were not recorded
+	// because they were out of range (see HistogramConfig.AutoResize)
+	OutOfRangeRecords int64 `json:"outOfRangeRecords"`
+	// Resizes is the number of times a histogram was resized (see
+	// HistogramConfig.AutoResize)
+	Resizes int64 `json:"resizes"`
+	// MemoryRefused is the number of times a histogram was not created
+	// because it would exceed the memory budget, MemoryEvicted is the number
+	// of histograms evicted, and MemoryDowngraded is the number of histograms
+	// created with fewer significant value digits (see
+	// HistogramConfig.MemoryBudget). All are 0 for a Histogram
+	MemoryRefused    int64 `json:"memoryRefused"`
+	MemoryEvicted    int64 `json:"memoryEvicted"`
+	MemoryDowngraded int64 `json:"memoryDowngraded"`
+	// Latency is a snapshot of the time taken to process each command, in
+	// nanoseconds
+	Latency *Snapshot `json:"latency"`
+}
+
+// latencyRecorder records the command processing latency of a processor
+type latencyRecorder struct {
+	clock Clock
+	lock  sync.Mutex
+	hist  *hdrhistogram.Histogram
+}
+
+// newLatencyRecorder creates a latencyRecorder that tracks latencies from 1ns
+// to maxLatency
+func newLatencyRecorder(clock Clock) *latencyRecorder {
+	hist := hdrhistogram.New(1, maxLatency, 3)
+	hist.SetStartTimeMs(nowMs(clock))
+
+	return &latencyRecorder{clock: clock, hist: hist}
+}
+
+// record records a latency
+func (l *latencyRecorder) record(latency time.Duration) {
+	value := int64(latency)
+	if value > maxLatency {
+		value = maxLatency
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_ = l.hist.RecordValue(value)
+}
+
+// snapshot returns a snapshot of the recorded latencies
+func (l *latencyRecorder) snapshot() *Snapshot {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return createSnapshot(l.hist, l.clock)
+}
+
+// stats returns the Stats for a processor and the queue that it processes
+func (p *processor) stats(q *commandQueue) *Stats {
+	stats := &Stats{
+		QueueLength:       len(q.cmds),
+		QueueCapacity:     cap(q.cmds),
+		HighWaterMark:     int(atomic.LoadInt64(&q.highWaterMark)),
+		Processed:         make(map[string]int64, numCommandTypes),
+		Abandoned:         atomic.LoadInt64(&p.abandoned),
+		DroppedRecords:    atomic.LoadInt64(&q.dropped),
+		OutOfRangeRecords: atomic.LoadInt64(&p.outOfRange),
+		Resizes:           atomic.LoadInt64(&p.resizes),
+		Latency:           p.latency.snapshot(),
+	}
+
+	for cmd := cmdStart; cmd < numCommandTypes; cmd++ {
+		stats.Processed[cmd.String()] = atomic.LoadInt64(&p.processed[cmd])
+	}
+
+	return stats
+}
@@ -0,0 +1,89 @@
+package safehdrhistogram
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Stats(t *testing.T) {
+	t.Run("Stats Histogram", func(t *testing.T) {
+		t.Parallel()
+
+		shdr := NewHistogramFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          30000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              4,
+		})
+
+		// stall the command processor so the buffer fills up
+		stalled := make(SnapshotChannel)
+		shdr.RequestSnapshot(stalled, false)
+
+		for i := 0; i < 10; i++ {
+			shdr.Record(100)
+		}
+
+		stats := shdr.Stats()
+		if !assert.Equal(t, 4, stats.QueueCapacity, "QueueCapacity should be the buffer size") {
+			return
+		}
+		if !assert.Equal(t, 4, stats.HighWaterMark, "The buffer should have filled up") {
+			return
+		}
+		if !assert.GreaterOrEqual(t, stats.DroppedRecords, int64(6), "Records should have been dropped") {
+			return
+		}
+
+		<-stalled
+		shdr.Close()
+
+		stats = shdr.Stats()
+		if !assert.Equal(t, 0, stats.QueueLength, "The queue should be empty") {
+			return
+		}
+		if !assert.Equal(t, int64(1), stats.Processed["start"], "One start should be processed") {
+			return
+		}
+		if !assert.Equal(t, int64(1), stats.Processed["snapshot"], "One snapshot should be processed") {
+			return
+		}
+		if !assert.Equal(t, int64(10), stats.Processed["record"]+stats.DroppedRecords, "Every record should be processed or dropped") {
+			return
+		}
+		if !assert.Equal(t, 2+stats.Processed["record"], stats.Latency.ToHistogram().TotalCount(), "Latency should be recorded per command") {
+			return
+		}
+	})
+
+	t.Run("Stats HistogramMap", func(t *testing.T) {
+		t.Parallel()
+
+		hists := NewHistogramMap(1, 30000000, 3)
+		hists.Record(100, "a", "b")
+
+		if !assert.NoError(t, hists.ResetAll(), "ResetAll should not fail") {
+			return
+		}
+
+		stats := hists.Stats()
+		if !assert.Equal(t, DefaultCommandBufferSize, stats.QueueCapacity, "QueueCapacity should be the buffer size") {
+			return
+		}
+		if !assert.Equal(t, int64(2), stats.Processed["record"], "Two records should be processed") {
+			return
+		}
+		if !assert.Equal(t, int64(2), stats.Processed["reset"], "Two resets should be processed") {
+			return
+		}
+		if !assert.Equal(t, int64(1), stats.Processed["sync"], "One sync should be processed") {
+			return
+		}
+		if !assert.Equal(t, int64(0), stats.DroppedRecords, "No records should be dropped") {
+			return
+		}
+
+		hists.Close()
+	})
+}
@@ -0,0 +1,468 @@
+package safehdrhistogram
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+const (
+	// DefaultStreamInterval is the default interval at which a Streamer
+	// sends snapshots to a subscriber
+	DefaultStreamInterval = time.Second
+	// DefaultMinStreamInterval is the default lower bound of the interval a
+	// subscriber can request
+	DefaultMinStreamInterval = 100 * time.Millisecond
+)
+
+const (
+	// FormatSSE streams events as Server-Sent Events (text/event-stream)
+	FormatSSE = "sse"
+	// FormatNDJSON streams events as newline delimited JSON
+	FormatNDJSON = "ndjson"
+)
+
+const (
+	// StreamSnapshots streams the interval snapshots (see EncodedSnapshot)
+	StreamSnapshots = "snapshots"
+	// StreamPercentiles streams the percentiles of the interval snapshots
+	StreamPercentiles = "percentiles"
+)
+
+// StreamerConfig represents the values used to construct a Streamer and is
+// designed for use in yaml or JSON configuration files
+type StreamerConfig struct {
+	// Interval is the interval used when a subscriber doesn't specify one.
+	// If 0, DefaultStreamInterval is used
+	Interval time.Duration `yaml:"interval" json:"interval"`
+	// MinInterval is the shortest interval a subscriber can request. If 0,
+	// DefaultMinStreamInterval is used
+	MinInterval time.Duration `yaml:"minInterval" json:"minInterval"`
+}
+
+// StreamEvent is an event of a snapshot stream, which contains the interval
+// snapshots (or percentiles) of the subscribed histograms
+//
+//	Notes
+//		Seq starts at 1 and increases by 1 with each event of a stream.
+//		Snapshots are ordered by name
+//
+type StreamEvent struct {
+	Seq         int64                   `json:"seq"`
+	Snapshots   []*EncodedSnapshot      `json:"snapshots,omitempty"`
+	Percentiles map[string]*Percentiles `json:"percentiles,omitempty"`
+}
+
+// Decode decodes the snapshots of the event by name
+func (event *StreamEvent) Decode() (map[string]*Snapshot, error) {
+	snapshots := make(map[string]*Snapshot, len(event.Snapshots))
+	for _, encoded := range event.Snapshots {
+		snapshot, err := encoded.Decode()
+		if err != nil {
+			return nil, err
+		}
+
+		snapshots[encoded.Name] = snapshot
+	}
+
+	return snapshots, nil
+}
+
+// Streamer is an http.Handler that streams the snapshots of the histograms
+// of a HistogramMap to subscribers, so live dashboards don't have to poll
+//
+//	Notes
+//		Each subscriber receives a StreamEvent every interval, containing
+//		the values recorded during the interval. The histograms are not
+//		reset, rather each interval snapshot is the difference between
+//		successive snapshots, so subscribers (and Checkpointers) don't
+//		interfere with each other. If a histogram is reset by another
+//		operation, the next interval snapshot contains the values recorded
+//		since the reset
+//
+//		The following query parameters are supported:
+//			format		sse or ndjson (see below)
+//			name		a path.Match pattern used to filter names (repeatable)
+//			interval	the interval of the events, e.g. 5s
+//			data		snapshots (default) or percentiles
+//			ticks		percentile ticks per half distance (default 1)
+//			p			an explicit percentile to report, e.g. 99.9 (repeatable)
+//			stats		include the mean, standard deviation, and sum
+//
+//		If format is not specified, Server-Sent Events are used if the
+//		request accepts text/event-stream, otherwise newline delimited JSON
+//		is used. The stream ends when the request is cancelled or the
+//		HistogramMap is closed. Use a StreamReader to decode the events
+//
+type Streamer struct {
+	hists  *HistogramMap
+	config StreamerConfig
+}
+
+// NewStreamer creates a Streamer for the histograms of hists
+func NewStreamer(hists *HistogramMap, config StreamerConfig) *Streamer {
+	if config.MinInterval <= 0 {
+		config.MinInterval = DefaultMinStreamInterval
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultStreamInterval
+	}
+	if config.Interval < config.MinInterval {
+		config.Interval = config.MinInterval
+	}
+
+	return &Streamer{hists: hists, config: config}
+}
+
+// ServeHTTP streams the interval snapshots of the subscribed histograms
+func (s *Streamer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	patterns := query["name"]
+
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			http.Error(w, fmt.Sprintf("invalid name pattern %q", pattern), http.StatusBadRequest)
+			return
+		}
+	}
+
+	interval := s.config.Interval
+	if value := query.Get("interval"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < s.config.MinInterval {
+			http.Error(w, fmt.Sprintf("invalid interval %q (the minimum is %s)", value, s.config.MinInterval), http.StatusBadRequest)
+			return
+		}
+		interval = parsed
+	}
+
+	data := query.Get("data")
+	if data == "" {
+		data = StreamSnapshots
+	}
+	if data != StreamSnapshots && data != StreamPercentiles {
+		http.Error(w, fmt.Sprintf("unsupported data %q", data), http.StatusBadRequest)
+		return
+	}
+
+	opts, err := percentilesOptionsParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = FormatNDJSON
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			format = FormatSSE
+		}
+	}
+
+	switch format {
+	case FormatSSE:
+		w.Header().Set("Content-Type", "text/event-stream")
+	case FormatNDJSON:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	default:
+		http.Error(w, fmt.Sprintf("unsupported format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+
+	// the first interval starts when the subscriber subscribes
+	sub := &streamSubscriber{hists: s.hists, patterns: patterns, previous: map[string]*Snapshot{}}
+	if _, err = sub.next(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for seq := int64(1); ; seq++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.hists.cmds.quit:
+			return
+		case <-ticker.C:
+		}
+
+		snapshots, err := sub.next(ctx)
+		if err != nil {
+			return
+		}
+
+		event := &StreamEvent{Seq: seq}
+		if data == StreamPercentiles {
+			event.Percentiles = make(map[string]*Percentiles, len(snapshots))
+			for name, snapshot := range snapshots {
+				event.Percentiles[name] = snapshot.percentiles(opts)
+			}
+		} else {
+			names := make([]string, 0, len(snapshots))
+			for name := range snapshots {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				encoded, err := EncodeSnapshot(name, snapshots[name])
+				if err != nil {
+					return
+				}
+
+				event.Snapshots = append(event.Snapshots, encoded)
+			}
+		}
+
+		body, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+
+		if format == FormatSSE {
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", seq, data, body)
+		} else {
+			_, err = w.Write(append(body, '\n'))
+		}
+		if err != nil {
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+// streamSubscriber tracks the cumulative snapshots of the histograms a
+// subscriber is subscribed to
+type streamSubscriber struct {
+	hists    *HistogramMap
+	patterns []string
+	// previous are the cumulative snapshots at the start of the interval
+	previous map[string]*Snapshot
+}
+
+// next returns the interval snapshots of the subscribed histograms, and
+// starts the next interval
+//
+//	Notes
+//		The snapshots don't create histograms, or mark them as used, so a
+//		subscriber never causes a histogram to be evicted (see
+//		MemoryPolicyEvictIdle)
+//
+func (sub *streamSubscriber) next(ctx context.Context) (map[string]*Snapshot, error) {
+	cumulative, err := sub.hists.snapshots(ctx, func(name string) bool {
+		return matchesAny(sub.patterns, name)
+	}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make(map[string]*Snapshot, len(cumulative))
+	for name, snapshot := range cumulative {
+		snapshots[name] = intervalSnapshot(sub.previous[name], snapshot)
+	}
+
+	// the histograms that no longer exist (such as evicted histograms) are
+	// forgotten
+	sub.previous = cumulative
+
+	return snapshots, nil
+}
+
+// matchesAny returns true if patterns is empty, or name matches one of the
+// (valid) patterns
+func matchesAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// intervalSnapshot returns the values recorded between two cumulative
+// snapshots of the same histogram
+//
+//	Notes
+//		If previous is nil, or the histogram was reset between the snapshots
+//		(so the counts can't be subtracted), current is returned
+//
+func intervalSnapshot(previous, current *Snapshot) *Snapshot {
+	if previous == nil ||
+		previous.StartTime != current.StartTime ||
+		previous.Snapshot.LowestTrackableValue != current.Snapshot.LowestTrackableValue ||
+		previous.Snapshot.SignificantFigures != current.Snapshot.SignificantFigures ||
+		len(previous.Snapshot.Counts) > len(current.Snapshot.Counts) {
+		return current
+	}
+
+	// a resized histogram has more counts, but the same bucket layout
+	counts := make([]int64, len(current.Snapshot.Counts))
+	for i, count := range current.Snapshot.Counts {
+		if i < len(previous.Snapshot.Counts) {
+			count -= previous.Snapshot.Counts[i]
+		}
+		if count < 0 {
+			return current
+		}
+
+		counts[i] = count
+	}
+
+	return &Snapshot{
+		Snapshot: &hdrhistogram.Snapshot{
+			LowestTrackableValue:  current.Snapshot.LowestTrackableValue,
+			HighestTrackableValue: current.Snapshot.HighestTrackableValue,
+			SignificantFigures:    current.Snapshot.SignificantFigures,
+			Counts:                counts,
+		},
+		StartTime:             previous.EndTime,
+		EndTime:               current.EndTime,
+		Tag:                   current.Tag,
+		Unit:                  current.Unit,
+		ValueUnitScalingRatio: current.ValueUnitScalingRatio,
+	}
+}
+
+// StreamReader decodes the events of a snapshot stream (see Streamer)
+//
+//	Notes
+//		Both Server-Sent Events and newline delimited JSON are decoded, so
+//		the format of the stream doesn't need to be specified
+//
+type StreamReader struct {
+	reader *bufio.Reader
+	closer io.Closer
+}
+
+// NewStreamReader creates a StreamReader that decodes the events read from
+// reader
+func NewStreamReader(reader io.Reader) *StreamReader {
+	return &StreamReader{reader: bufio.NewReader(reader)}
+}
+
+// Subscribe subscribes to a Streamer at url, which includes the query
+// parameters of the subscription (see Streamer)
+//
+//	Notes
+//		If client is nil, http.DefaultClient is used. The subscription ends
+//		when ctx is cancelled, or the StreamReader is closed
+//
+func Subscribe(ctx context.Context, client *http.Client, url string) (*StreamReader, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream, application/x-ndjson")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("safehdrhistogram: subscribe: %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+
+	reader := NewStreamReader(resp.Body)
+	reader.closer = resp.Body
+
+	return reader, nil
+}
+
+// Next blocks until the next event of the stream is decoded
+//
+//	Notes
+//		Next returns io.EOF when the stream ends
+//
+func (sr *StreamReader) Next() (*StreamEvent, error) {
+	// data accumulates the data lines of a Server-Sent Event
+	var data []byte
+
+	for {
+		line, err := sr.reader.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			if err == io.EOF && len(data) > 0 {
+				// the stream ended without the blank line of the event
+				return decodeStreamEvent(data)
+			}
+
+			return nil, err
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+
+		switch {
+		case len(line) == 0:
+			// a blank line dispatches a Server-Sent Event
+			if len(data) > 0 {
+				return decodeStreamEvent(data)
+			}
+		case line[0] == '{':
+			// newline delimited JSON
+			return decodeStreamEvent(line)
+		case bytes.HasPrefix(line, []byte("data:")):
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, bytes.TrimPrefix(line[len("data:"):], []byte(" "))...)
+		default:
+			// comments, and the id and event fields are ignored
+		}
+	}
+}
+
+// decodeStreamEvent decodes the JSON of a StreamEvent
+func decodeStreamEvent(data []byte) (*StreamEvent, error) {
+	var event StreamEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, fmt.Errorf("safehdrhistogram: invalid stream event: %v", err)
+	}
+
+	return &event, nil
+}
+
+// Close ends the subscription of a StreamReader created by Subscribe
+func (sr *StreamReader) Close() error {
+	if sr.closer == nil {
+		return nil
+	}
+
+	return sr.closer.Close()
+}
@@ -0,0 +1,293 @@
+package safehdrhistogram
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Streamer(t *testing.T) {
+	t.Run("NDJSON Snapshots", func(t *testing.T) {
+		t.Parallel()
+
+		hdrs := NewHistogramMap(1, 1000000, 3)
+		defer hdrs.Close()
+
+		server := httptest.NewServer(NewStreamer(hdrs, StreamerConfig{MinInterval: 1}))
+		defer server.Close()
+
+		// the values recorded before subscribing are not streamed
+		for value := int64(1); value <= 100; value++ {
+			hdrs.Record(value, "get", "put")
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		stream, err := Subscribe(ctx, nil, server.URL+"?format=ndjson&interval=10ms&name=g*")
+		if !assert.NoError(t, err, "Subscribe should not fail") {
+			return
+		}
+		defer stream.Close()
+
+		for value := int64(1); value <= 10; value++ {
+			hdrs.Record(value*1000, "get", "put")
+		}
+
+		var count int64
+		for seq := int64(1); count < 10; seq++ {
+			event, err := stream.Next()
+			if !assert.NoError(t, err, "Next should not fail") {
+				return
+			}
+			if !assert.Equal(t, seq, event.Seq, "the events should be in sequence") {
+				return
+			}
+
+			snapshots, err := event.Decode()
+			if !assert.NoError(t, err, "Decode should not fail") {
+				return
+			}
+			if !assert.Len(t, snapshots, 1, "only the subscribed names should be streamed") {
+				return
+			}
+
+			hist := snapshots["get"].ToHistogram()
+			if hist.TotalCount() > 0 && !assert.Equal(t, int64(1000), hist.Min(), "only the interval values should be streamed") {
+				return
+			}
+
+			count += hist.TotalCount()
+		}
+
+		if !assert.Equal(t, int64(10), count, "each value should be streamed once") {
+			return
+		}
+	})
+
+	t.Run("SSE Percentiles", func(t *testing.T) {
+		t.Parallel()
+
+		hdrs := NewHistogramMap(1, 1000000, 3)
+		defer hdrs.Close()
+
+		server := httptest.NewServer(NewStreamer(hdrs, StreamerConfig{MinInterval: 1}))
+		defer server.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"?data=percentiles&interval=10ms&p=50&p=100", nil)
+		req.Header.Set("Accept", "text/event-stream")
+
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, "the request should not fail") {
+			return
+		}
+		defer resp.Body.Close()
+
+		if !assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"), "the stream should be Server-Sent Events") {
+			return
+		}
+
+		// the values are recorded by one command, so they are in one interval
+		hdrs.RecordValues(7, 100, "latency")
+
+		stream := NewStreamReader(resp.Body)
+		for {
+			event, err := stream.Next()
+			if !assert.NoError(t, err, "Next should not fail") {
+				return
+			}
+
+			perc := event.Percentiles["latency"]
+			if !assert.NotNil(t, perc, "the percentiles should be streamed") {
+				return
+			}
+			if perc.TotalCount == 0 {
+				continue
+			}
+
+			if !assert.Equal(t, int64(100), perc.TotalCount, "the values should be streamed in one interval") {
+				return
+			}
+			if !assert.Equal(t, []Percentile{{Value: 7, Percentile: 0.5, Count: 100}, {Value: 7, Percentile: 1, Count: 100}}, perc.Percentiles, "unexpected percentiles") {
+				return
+			}
+
+			break
+		}
+	})
+
+	t.Run("Stream Reader", func(t *testing.T) {
+		t.Parallel()
+
+		raw := ": a comment\n" +
+			"id: 1\r\nevent: snapshots\r\ndata: {\"seq\":1,\r\ndata: \"snapshots\":[]}\r\n\r\n" +
+			"{\"seq\":2}\n" +
+			"data: {\"seq\":3}"
+
+		stream := NewStreamReader(strings.NewReader(raw))
+		for seq := int64(1); seq <= 3; seq++ {
+			event, err := stream.Next()
+			if !assert.NoError(t, err, "Next should not fail") {
+				return
+			}
+			if !assert.Equal(t, seq, event.Seq, "the event should be decoded") {
+				return
+			}
+		}
+
+		if _, err := stream.Next(); !assert.Equal(t, io.EOF, err, "the stream should end") {
+			return
+		}
+
+		if _, err := NewStreamReader(strings.NewReader("data: oops\n\n")).Next(); !assert.Error(t, err, "an invalid event should fail") {
+			return
+		}
+	})
+
+	t.Run("Interval Snapshot", func(t *testing.T) {
+		t.Parallel()
+
+		hist := hdrhistogram.New(1, 1000, 3)
+		hist.SetStartTimeMs(1000)
+		_ = hist.RecordValue(10)
+
+		previous := &Snapshot{Snapshot: hist.Export(), StartTime: 1000, EndTime: 2000}
+
+		// a resized histogram has more counts
+		resized := hdrhistogram.New(1, 1000000, 3)
+		resized.Merge(hist)
+		_ = resized.RecordValue(100000)
+
+		current := &Snapshot{Snapshot: resized.Export(), StartTime: 1000, EndTime: 3000}
+
+		interval := intervalSnapshot(previous, current)
+		if !assert.Equal(t, int64(2000), interval.StartTime, "the interval should start at the previous snapshot") {
+			return
+		}
+		if !assert.Equal(t, int64(1), interval.ToHistogram().TotalCount(), "the previous values should be subtracted") {
+			return
+		}
+		if !assert.True(t, resized.ValuesAreEquivalent(100000, interval.ToHistogram().Min()), "the previous values should be subtracted") {
+			return
+		}
+
+		// the values since a reset are returned as is
+		reset := hdrhistogram.New(1, 1000, 3)
+		_ = reset.RecordValue(5)
+
+		current = &Snapshot{Snapshot: reset.Export(), StartTime: 2500, EndTime: 3000}
+		if !assert.Equal(t, current, intervalSnapshot(previous, current), "the reset snapshot should be returned") {
+			return
+		}
+		current.StartTime = previous.StartTime
+		if !assert.Equal(t, current, intervalSnapshot(previous, current), "a reset in the same millisecond should be detected") {
+			return
+		}
+	})
+
+	t.Run("Invalid Parameters", func(t *testing.T) {
+		t.Parallel()
+
+		hdrs := NewHistogramMap(1, 1000000, 3)
+		defer hdrs.Close()
+
+		streamer := NewStreamer(hdrs, StreamerConfig{})
+
+		for _, query := range []string{"interval=10ms", "interval=x", "format=text", "data=counts", "name=[", "p=101"} {
+			rec := httptest.NewRecorder()
+			streamer.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+			if !assert.Equal(t, http.StatusBadRequest, rec.Code, "%s should be invalid", query) {
+				return
+			}
+		}
+
+		server := httptest.NewServer(streamer)
+		defer server.Close()
+
+		if _, err := Subscribe(context.Background(), nil, server.URL+"?interval=1ms"); !assert.Error(t, err, "Subscribe should fail") {
+			return
+		}
+	})
+
+	t.Run("Eviction", func(t *testing.T) {
+		t.Parallel()
+
+		clock := NewManualClock(time.Unix(1600000000, 0))
+		hdrs := NewHistogramMapFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          1000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			MemoryBudget:                   2 * denseByteSize(1, 1000000, 3),
+			MemoryPolicy:                   MemoryPolicyEvictIdle,
+			Clock:                          clock,
+		})
+		defer hdrs.Close()
+
+		server := httptest.NewServer(NewStreamer(hdrs, StreamerConfig{MinInterval: 1}))
+		defer server.Close()
+
+		hdrs.Record(1, "a")
+		clock.Advance(time.Second)
+		hdrs.Record(1, "b")
+		clock.Advance(time.Second)
+		hdrs.Record(1, "a")
+		clock.Advance(time.Second)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// a subscriber doesn't use the histograms
+		stream, err := Subscribe(ctx, nil, server.URL+"?interval=10ms")
+		if !assert.NoError(t, err, "Subscribe should not fail") {
+			return
+		}
+		defer stream.Close()
+
+		hdrs.Record(1, "c")
+
+		for i := 0; i < 3; i++ {
+			if _, err = stream.Next(); !assert.NoError(t, err, "Next should not fail") {
+				return
+			}
+		}
+
+		if !assert.ElementsMatch(t, []string{"a", "c"}, hdrs.Names(), "b should be evicted") {
+			return
+		}
+		if !assert.Equal(t, int64(1), hdrs.Stats().MemoryEvicted, "the subscriber should not evict histograms") {
+			return
+		}
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		t.Parallel()
+
+		hdrs := NewHistogramMap(1, 1000000, 3)
+
+		server := httptest.NewServer(NewStreamer(hdrs, StreamerConfig{}))
+		defer server.Close()
+
+		stream, err := Subscribe(context.Background(), nil, server.URL)
+		if !assert.NoError(t, err, "Subscribe should not fail") {
+			return
+		}
+		defer stream.Close()
+
+		// closing the HistogramMap ends the stream
+		hdrs.Close()
+		if _, err = stream.Next(); !assert.Equal(t, io.EOF, err, "the stream should end") {
+			return
+		}
+	})
+}
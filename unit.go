@@ -0,0 +1,166 @@
+package safehdrhistogram
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// Unit identifies the unit of the values recorded to a histogram
+type Unit string
+
+const (
+	// UnitNanoseconds indicates that durations are recorded in nanoseconds
+	UnitNanoseconds Unit = "ns"
+	// UnitMicroseconds indicates that durations are recorded in microseconds
+	UnitMicroseconds Unit = "us"
+	// UnitMilliseconds indicates that durations are recorded in milliseconds
+	UnitMilliseconds Unit = "ms"
+	// UnitBytes indicates that sizes are recorded in bytes
+	UnitBytes Unit = "B"
+)
+
+// DefaultDurationUnit is the unit used to record durations when no Unit is
+// configured
+const DefaultDurationUnit = UnitMicroseconds
+
+// durationUnit returns the time.Duration of one unit of u
+//
+//	Notes
+//		An empty (or unknown) unit is treated as DefaultDurationUnit
+//
+func (u Unit) durationUnit() time.Duration {
+	switch u {
+	case UnitNanoseconds:
+		return time.Nanosecond
+	case UnitMilliseconds:
+		return time.Millisecond
+	default:
+		return time.Microsecond
+	}
+}
+
+// FromDuration converts a duration to a value in the unit (truncating any
+// remainder)
+//
+//	Notes
+//		An empty (or unknown) unit is treated as DefaultDurationUnit
+//
+func (u Unit) FromDuration(d time.Duration) int64 {
+	return int64(d / u.durationUnit())
+}
+
+// durationValue converts a duration to a recorded value, which is in unit
+// multiplied by the value unit scaling ratio (truncating any remainder)
+//
+//	Notes
+//		With a ratio, the value has the same scale as the other recorded
+//		values, so dividing it by the ratio (see Percentiles.FormatValue)
+//		converts it back to unit
+//
+func durationValue(d time.Duration, unit Unit, ratio float64) int64 {
+	if ratio <= 0 || ratio == 1 {
+		return unit.FromDuration(d)
+	}
+
+	return int64(float64(d) * ratio / float64(unit.durationUnit()))
+}
+
+// isDuration returns true if u is a unit of time
+func (u Unit) isDuration() bool {
+	return u == UnitNanoseconds || u == UnitMicroseconds || u == UnitMilliseconds
+}
+
+// durationScales are the units used to format durations, largest first
+var durationScales = []struct {
+	suffix string
+	scale  float64
+}{
+	{"s", float64(time.Second)},
+	{"ms", float64(time.Millisecond)},
+	{"µs", float64(time.Microsecond)},
+	{"ns", 1},
+}
+
+// byteScales are the (IEC) units used to format sizes, largest first
+var byteScales = []struct {
+	suffix string
+	scale  float64
+}{
+	{"PiB", 1 << 50},
+	{"TiB", 1 << 40},
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"B", 1},
+}
+
+// Format formats a value in the unit for display, using the largest unit of
+// the same kind that keeps the value at or above 1 (e.g. 12.3ms or 4.1MiB)
+//
+//	Notes
+//		Durations and sizes are formatted with up to one decimal place.
+//		Values in other units are formatted as is, followed by the unit (which
+//		is omitted if the unit is empty)
+//
+func (u Unit) Format(value float64) string {
+	switch {
+	case u.isDuration():
+		ns := value * float64(u.durationUnit())
+		for _, unit := range durationScales {
+			if math.Abs(ns) >= unit.scale || unit.scale == 1 {
+				return formatScaled(ns/unit.scale) + unit.suffix
+			}
+		}
+	case u == UnitBytes:
+		for _, unit := range byteScales {
+			if math.Abs(value) >= unit.scale || unit.scale == 1 {
+				return formatScaled(value/unit.scale) + unit.suffix
+			}
+		}
+	}
+
+	return strconv.FormatFloat(value, 'f', -1, 64) + string(u)
+}
+
+// formatScaled formats a scaled value with one decimal place, omitting a
+// trailing .0
+func formatScaled(value float64) string {
+	result := strconv.FormatFloat(value, 'f', 1, 64)
+	if len(result) > 2 && result[len(result)-2:] == ".0" {
+		result = result[:len(result)-2]
+	}
+
+	return result
+}
+
+// Timer measures a duration and records it to one or more histograms when
+// stopped (see Histogram.Start and HistogramMap.Start)
+type Timer struct {
+	clock  Clock
+	start  time.Time
+	record func(d time.Duration)
+}
+
+// newTimer creates a Timer that starts at the current time of clock, and
+// records the duration using record
+func newTimer(clock Clock, record func(d time.Duration)) *Timer {
+	return &Timer{
+		clock:  clock,
+		start:  clock.Now(),
+		record: record,
+	}
+}
+
+// Stop records the duration since the timer was started, and returns it
+//
+//	Notes
+//		Each call to Stop records a duration, so a Timer can be used to
+//		record laps
+//
+func (t *Timer) Stop() time.Duration {
+	d := t.clock.Now().Sub(t.start)
+	t.record(d)
+
+	return d
+}
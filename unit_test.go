@@ -0,0 +1,235 @@
+package safehdrhistogram
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Unit(t *testing.T) {
+	t.Run("FromDuration", func(t *testing.T) {
+		t.Parallel()
+
+		d := 1500 * time.Microsecond
+
+		if !assert.Equal(t, int64(1500000), UnitNanoseconds.FromDuration(d), "Duration should convert to ns") {
+			return
+		}
+		if !assert.Equal(t, int64(1500), UnitMicroseconds.FromDuration(d), "Duration should convert to us") {
+			return
+		}
+		if !assert.Equal(t, int64(1), UnitMilliseconds.FromDuration(d), "Duration should convert to ms") {
+			return
+		}
+		if !assert.Equal(t, int64(1500), Unit("").FromDuration(d), "An empty unit should convert to us") {
+			return
+		}
+	})
+
+	t.Run("Timer Histogram", func(t *testing.T) {
+		t.Parallel()
+
+		clock := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		shdr := NewHistogramFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          30000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			Clock:                          clock,
+			Unit:                           UnitMilliseconds,
+		})
+
+		shdr.RecordDuration(2 * time.Second)
+		shdr.Time(func() { clock.Advance(3 * time.Second) })
+
+		timer := shdr.Start()
+		clock.Advance(4 * time.Second)
+		if !assert.Equal(t, 4*time.Second, timer.Stop(), "Stop() should return the elapsed duration") {
+			return
+		}
+
+		percentiles := shdr.Percentiles(false, nil)
+		if !assert.Equal(t, UnitMilliseconds, percentiles.Unit, "Percentiles should have the unit") {
+			return
+		}
+		if !assert.Equal(t, int64(3), percentiles.TotalCount, "Three durations should be recorded") {
+			return
+		}
+		if !assert.Equal(t, int64(2000), percentiles.MinValue, "Durations should be recorded in ms") {
+			return
+		}
+		if !assert.True(t, shdr.Snapshot(false).ToHistogram().ValuesAreEquivalent(4000, percentiles.MaxValue), "Durations should be recorded in ms") {
+			return
+		}
+
+		snapshot := shdr.Snapshot(false)
+		if !assert.Equal(t, UnitMilliseconds, snapshot.Unit, "Snapshot should have the unit") {
+			return
+		}
+		if !assert.Equal(t, UnitMilliseconds, NewHistogramFromSnapshot(snapshot).Snapshot(false).Unit, "The unit should be restored from a Snapshot") {
+			return
+		}
+	})
+
+	t.Run("Timer HistogramMap", func(t *testing.T) {
+		t.Parallel()
+
+		clock := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		hists := NewHistogramMapFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          30000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			Clock:                          clock,
+		})
+
+		hists.RecordDuration(time.Millisecond, "a")
+		hists.Time(func() { clock.Advance(2 * time.Millisecond) }, "a", "b")
+
+		timer := hists.Start("b")
+		clock.Advance(3 * time.Millisecond)
+		timer.Stop()
+
+		a := hists.Snapshot("a", false)
+		if !assert.Equal(t, DefaultDurationUnit, a.Unit, "Snapshot should have the default unit") {
+			return
+		}
+		if !assert.Equal(t, int64(1000), a.ToHistogram().Min(), "Durations should be recorded in us") {
+			return
+		}
+
+		b := hists.Percentiles("b", false, nil)
+		if !assert.Equal(t, DefaultDurationUnit, b.Unit, "Percentiles should have the default unit") {
+			return
+		}
+		if !assert.Equal(t, int64(2), b.TotalCount, "Two durations should be recorded") {
+			return
+		}
+		if !assert.True(t, hists.Snapshot("b", false).ToHistogram().ValuesAreEquivalent(3000, b.MaxValue), "Durations should be recorded in us") {
+			return
+		}
+	})
+}
+
+func Test_Unit_Format(t *testing.T) {
+	t.Run("Format", func(t *testing.T) {
+		t.Parallel()
+
+		tests := []struct {
+			unit     Unit
+			value    float64
+			expected string
+		}{
+			{UnitMicroseconds, 12345, "12.3ms"},
+			{UnitMicroseconds, 500, "500µs"},
+			{UnitNanoseconds, 999, "999ns"},
+			{UnitMilliseconds, 1500, "1.5s"},
+			{UnitMilliseconds, 0, "0ns"},
+			{UnitBytes, 512, "512B"},
+			{UnitBytes, 4.1 * 1024 * 1024, "4.1MiB"},
+			{UnitBytes, 2048, "2KiB"},
+			{Unit("req"), 12.5, "12.5req"},
+			{Unit(""), 931839, "931839"},
+		}
+
+		for _, test := range tests {
+			if !assert.Equal(t, test.expected, test.unit.Format(test.value), "Format(%v) in %q", test.value, test.unit) {
+				return
+			}
+		}
+	})
+
+	t.Run("Percentiles Unit", func(t *testing.T) {
+		t.Parallel()
+
+		shdr := NewHistogramFromConfig(HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          30000000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			Unit:                           UnitMicroseconds,
+			ValueUnitScalingRatio:          1000,
+		})
+
+		// values are recorded in nanoseconds, and reported in microseconds
+		shdr.Record(12300000)
+
+		percentiles := shdr.Percentiles(false, nil)
+		if !assert.Equal(t, 1000.0, percentiles.ValueUnitScalingRatio, "Percentiles should have the scaling ratio") {
+			return
+		}
+		if !assert.Equal(t, "12.3ms", percentiles.FormatValue(percentiles.MinValue), "Values should be formatted with the unit") {
+			return
+		}
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, percentiles.Write(&buf), "Write should not fail") {
+			return
+		}
+		if !assert.Contains(t, buf.String(), "[Min = 12.3ms", "Write should format values with the unit") {
+			return
+		}
+
+		data, err := json.Marshal(percentiles)
+		if !assert.NoError(t, err, "Marshal should not fail") {
+			return
+		}
+		if !assert.Contains(t, string(data), `"unit":"us","valueUnitScalingRatio":1000`, "JSON should carry the unit") {
+			return
+		}
+
+		snapshot := shdr.Snapshot(false)
+		if !assert.Equal(t, UnitMicroseconds, snapshot.Unit, "Snapshot should have the unit") {
+			return
+		}
+		if !assert.Equal(t, 1000.0, snapshot.ValueUnitScalingRatio, "Snapshot should have the scaling ratio") {
+			return
+		}
+
+		// hgrm output defaults to the scaling ratio
+		buf.Reset()
+		if !assert.NoError(t, percentiles.WriteHgrm(&buf, 0), "WriteHgrm should not fail") {
+			return
+		}
+		if !assert.Contains(t, buf.String(), "#[Max     =    12304.383", "WriteHgrm should scale values by the ratio") {
+			return
+		}
+	})
+
+	t.Run("Scaled Durations", func(t *testing.T) {
+		t.Parallel()
+
+		config := HistogramConfig{
+			LowestDiscernibleValue:         1,
+			HighestTrackableValue:          30000000000,
+			NumberOfSignificantValueDigits: 3,
+			CommandBufferSize:              DefaultCommandBufferSize,
+			Unit:                           UnitMicroseconds,
+			ValueUnitScalingRatio:          1000,
+		}
+
+		// durations are recorded at the same scale as values (nanoseconds)
+		shdr := NewHistogramFromConfig(config)
+		shdr.RecordDuration(time.Millisecond)
+
+		percentiles := shdr.Percentiles(false, nil)
+		if !assert.Equal(t, "1ms", percentiles.FormatValue(percentiles.MaxValue), "the duration should be scaled") {
+			return
+		}
+
+		shdr.Close()
+
+		hists := NewHistogramMapFromConfig(config)
+		hists.RecordDuration(1500*time.Microsecond, "get")
+
+		percentiles = hists.Percentiles("get", false, nil)
+		if !assert.Equal(t, "1.5ms", percentiles.FormatValue(percentiles.MaxValue), "the duration should be scaled") {
+			return
+		}
+
+		hists.Close()
+	})
+}